@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"genfity-wa-support/models"
@@ -55,6 +57,10 @@ func initDatabase() {
 	if err := autoMigrateTables(); err != nil {
 		log.Fatal("Failed to migrate database:", err)
 	}
+
+	if err := seedDefaultProviderNode(); err != nil {
+		log.Fatal("Failed to seed provider node:", err)
+	}
 }
 
 func autoMigrateTables() error {
@@ -64,9 +70,49 @@ func autoMigrateTables() error {
 		&models.WhatsAppSession{},
 		&models.SessionMessageStat{},
 		&models.SessionContact{},
+		&models.QuotaReservation{},
+		&models.RateLimitCounter{},
+		&models.RateLimitBlock{},
+		&models.RateLimitBucket{},
+		&models.PathPolicyRule{},
+		&models.IdempotencyRecord{},
+		&models.MessageJob{},
+		&models.ScheduledMessage{},
+		&models.SendLedgerEntry{},
+		&models.ProviderNode{},
+		&models.RecipientBlock{},
+		&models.WebhookEvent{},
+		&models.SessionWebhook{},
+		&models.WebhookDelivery{},
+		&models.WebhookDeliveryAttempt{},
+		&models.WebhookDeadLetter{},
+		&models.SessionStatusChange{},
+		&models.ReconcileOrphan{},
 	)
 }
 
+// seedDefaultProviderNode registers WA_SERVER_URL as the "default" node when
+// the registry is empty, so single-node deployments keep working unchanged.
+func seedDefaultProviderNode() error {
+	baseURL := strings.TrimSpace(os.Getenv("WA_SERVER_URL"))
+	if baseURL == "" {
+		return nil
+	}
+	var count int64
+	if err := DB.Model(&models.ProviderNode{}).Count(&count).Error; err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+	return DB.Create(&models.ProviderNode{
+		ID:       models.DefaultNodeID,
+		Provider: "genfity-wa",
+		BaseURL:  baseURL,
+		Status:   models.NodeHealthy,
+	}).Error
+}
+
 func GetDB() *gorm.DB {
 	return DB
 }
@@ -84,6 +130,147 @@ func StartSubscriptionExpiryCron() {
 			if result.Error != nil {
 				log.Printf("Subscription expiry cron error: %v", result.Error)
 			}
+
+			if err := releaseStaleQuotaReservations(time.Now()); err != nil {
+				log.Printf("Quota reservation cleanup error: %v", err)
+			}
+
+			if err := rolloverQuotaPeriods(time.Now()); err != nil {
+				log.Printf("Quota period rollover error: %v", err)
+			}
+
+			if err := DB.Where("expires_at <= ?", time.Now()).Delete(&models.IdempotencyRecord{}).Error; err != nil {
+				log.Printf("Idempotency key cleanup error: %v", err)
+			}
+
+			if err := purgeSendLedger(time.Now()); err != nil {
+				log.Printf("Send ledger retention error: %v", err)
+			}
+
+			if err := purgeWebhookEvents(time.Now()); err != nil {
+				log.Printf("Webhook event retention error: %v", err)
+			}
+
+			if err := purgeSessionStatusHistory(time.Now()); err != nil {
+				log.Printf("Session status history retention error: %v", err)
+			}
 		}
 	}()
 }
+
+// releaseStaleQuotaReservations gives back units whose send never settled
+// (e.g. the process died mid-request) and prunes old settled rows.
+func releaseStaleQuotaReservations(now time.Time) error {
+	err := DB.Exec(`
+		WITH released AS (
+			UPDATE wa_quota_reservations
+			SET status = ?, updated_at = ?
+			WHERE status = ? AND expires_at <= ?
+			RETURNING subscription_id
+		), counts AS (
+			SELECT subscription_id, COUNT(*) AS n FROM released GROUP BY subscription_id
+		)
+		UPDATE wa_user_subscriptions s
+		SET messages_reserved = GREATEST(s.messages_reserved - counts.n, 0)
+		FROM counts
+		WHERE s.id = counts.subscription_id`,
+		models.QuotaReleased, now, models.QuotaReserved, now).Error
+	if err != nil {
+		return err
+	}
+
+	return DB.Where("status <> ? AND updated_at <= ?", models.QuotaReserved, now.Add(-24*time.Hour)).
+		Delete(&models.QuotaReservation{}).Error
+}
+
+// rolloverQuotaPeriods starts the next quota window for every periodic
+// subscription whose current window has ended and resets its usage counter.
+func rolloverQuotaPeriods(now time.Time) error {
+	periodic := []models.QuotaPeriod{models.QuotaPeriodDaily, models.QuotaPeriodWeekly, models.QuotaPeriodMonthly}
+	var due []models.UserSubscription
+	if err := DB.Where("quota_period IN ? AND (quota_period_end IS NULL OR quota_period_end <= ?)", periodic, now).
+		Find(&due).Error; err != nil {
+		return err
+	}
+
+	for _, sub := range due {
+		start, end, ok := sub.QuotaWindow(now)
+		if !ok {
+			continue
+		}
+		updates := map[string]interface{}{
+			"quota_period_start": start,
+			"quota_period_end":   end,
+		}
+		// Guard on the previous window so a concurrent replica cannot reset twice.
+		query := DB.Model(&models.UserSubscription{}).Where("id = ?", sub.ID)
+		if sub.QuotaPeriodEnd != nil {
+			updates["messages_used"] = 0
+			query = query.Where("quota_period_end = ?", *sub.QuotaPeriodEnd)
+		} else {
+			query = query.Where("quota_period_end IS NULL")
+		}
+		if err := query.Updates(updates).Error; err != nil {
+			log.Printf("Quota period rollover failed for subscription %d: %v", sub.ID, err)
+		}
+	}
+	return nil
+}
+
+// purgeSendLedger drops ledger rows older than SEND_LEDGER_RETENTION_DAYS
+// (default 180, 0 keeps everything).
+func purgeSendLedger(now time.Time) error {
+	days, err := retentionDays("SEND_LEDGER_RETENTION_DAYS", 180)
+	if err != nil || days <= 0 {
+		return err
+	}
+	return DB.Where("created_at < ?", now.AddDate(0, 0, -days)).Delete(&models.SendLedgerEntry{}).Error
+}
+
+// purgeWebhookEvents drops relayed events older than
+// WEBHOOK_EVENT_RETENTION_DAYS (default 7) once they were delivered. Events
+// with a pending or dead delivery are kept so they can still be replayed.
+func purgeWebhookEvents(now time.Time) error {
+	days, err := retentionDays("WEBHOOK_EVENT_RETENTION_DAYS", 7)
+	if err != nil || days <= 0 {
+		return err
+	}
+	cutoff := now.AddDate(0, 0, -days)
+	if err := DB.Exec(`
+		DELETE FROM wa_webhook_delivery_attempts a
+		USING wa_webhook_deliveries d
+		WHERE a.delivery_id = d.id AND d.status = ? AND d.created_at < ?`,
+		models.WebhookDeliveryDelivered, cutoff).Error; err != nil {
+		return err
+	}
+	if err := DB.Where("status = ? AND created_at < ?", models.WebhookDeliveryDelivered, cutoff).
+		Delete(&models.WebhookDelivery{}).Error; err != nil {
+		return err
+	}
+	return DB.Exec(`
+		DELETE FROM wa_webhook_events e
+		WHERE e.created_at < ?
+		AND NOT EXISTS (SELECT 1 FROM wa_webhook_deliveries d WHERE d.event_id = e.id)`, cutoff).Error
+}
+
+// purgeSessionStatusHistory drops status transitions older than
+// SESSION_STATUS_HISTORY_RETENTION_DAYS (default 90, 0 keeps everything).
+func purgeSessionStatusHistory(now time.Time) error {
+	days, err := retentionDays("SESSION_STATUS_HISTORY_RETENTION_DAYS", 90)
+	if err != nil || days <= 0 {
+		return err
+	}
+	return DB.Where("created_at < ?", now.AddDate(0, 0, -days)).Delete(&models.SessionStatusChange{}).Error
+}
+
+func retentionDays(key string, fallback int) (int, error) {
+	raw := strings.TrimSpace(os.Getenv(key))
+	if raw == "" {
+		return fallback, nil
+	}
+	days, err := strconv.Atoi(raw)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %w", key, err)
+	}
+	return days, nil
+}
@@ -0,0 +1,310 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"genfity-wa-support/database"
+	"genfity-wa-support/models"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm/clause"
+)
+
+const maxBlocklistBatch = 1000
+
+type blocklistRequest struct {
+	Recipient  string   `json:"recipient"`
+	Recipients []string `json:"recipients"`
+	Reason     string   `json:"reason"`
+}
+
+func (r blocklistRequest) values() []string {
+	values := r.Recipients
+	if r.Recipient != "" {
+		values = append([]string{r.Recipient}, values...)
+	}
+	return values
+}
+
+type invalidRecipient struct {
+	Recipient string `json:"recipient"`
+	Reason    string `json:"reason"`
+}
+
+// blocklistKey is the form recipients are stored and matched in, shared with
+// the ledger hash so 08xx, +62 8xx and 628xx@s.whatsapp.net are one entry.
+func blocklistKey(raw string) (string, error) {
+	normalized, err := normalizeRecipient(raw)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(normalized, "@"+userJIDServer), nil
+}
+
+// isRecipientBlocked reports whether the user's opt-out list contains the
+// recipient. Callers should refuse the send when the lookup itself fails,
+// including for a recipient that cannot be normalized.
+func isRecipientBlocked(userID, recipient string) (bool, error) {
+	key, err := blocklistKey(recipient)
+	if err != nil {
+		return false, err
+	}
+	var count int64
+	err = database.GetDB().Model(&models.RecipientBlock{}).
+		Where("user_id = ? AND recipient = ?", userID, key).
+		Count(&count).Error
+	return count > 0, err
+}
+
+// addRecipientBlocks inserts the valid recipients, ignoring ones already on
+// the list, and reports how many rows were added.
+func addRecipientBlocks(userID string, recipients []string, reason, source string) (int64, []invalidRecipient, error) {
+	var invalid []invalidRecipient
+	seen := map[string]bool{}
+	rows := make([]models.RecipientBlock, 0, len(recipients))
+	for _, raw := range recipients {
+		key, err := blocklistKey(raw)
+		if err != nil {
+			invalid = append(invalid, invalidRecipient{Recipient: raw, Reason: err.Error()})
+			continue
+		}
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		rows = append(rows, models.RecipientBlock{UserID: userID, Recipient: key, Reason: reason, Source: source})
+	}
+	if len(rows) == 0 {
+		return 0, invalid, nil
+	}
+	res := database.GetDB().Clauses(clause.OnConflict{DoNothing: true}).Create(&rows)
+	return res.RowsAffected, invalid, res.Error
+}
+
+func removeRecipientBlocks(userID string, recipients []string) (int64, []invalidRecipient, error) {
+	var invalid []invalidRecipient
+	keys := make([]string, 0, len(recipients))
+	for _, raw := range recipients {
+		key, err := blocklistKey(raw)
+		if err != nil {
+			invalid = append(invalid, invalidRecipient{Recipient: raw, Reason: err.Error()})
+			continue
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return 0, invalid, nil
+	}
+	res := database.GetDB().Where("user_id = ? AND recipient IN ?", userID, keys).Delete(&models.RecipientBlock{})
+	return res.RowsAffected, invalid, res.Error
+}
+
+// optOutKeywords are the inbound texts that opt the sender out, from
+// OPT_OUT_KEYWORDS (comma-separated, case-insensitive).
+func optOutKeywords() []string {
+	raw := os.Getenv("OPT_OUT_KEYWORDS")
+	if raw == "" {
+		raw = "STOP,UNSUBSCRIBE,BERHENTI"
+	}
+	var keywords []string
+	for _, keyword := range strings.Split(raw, ",") {
+		if keyword = strings.TrimSpace(keyword); keyword != "" {
+			keywords = append(keywords, keyword)
+		}
+	}
+	return keywords
+}
+
+// applyOptOutKeyword blocks the sender of an inbound direct message whose
+// whole text is an opt-out keyword. payload is a relayed genfity-wa event:
+// {"type":"Message","event":{"Info":{...},"Message":{...}}}.
+func applyOptOutKeyword(session models.WhatsAppSession, payload map[string]interface{}) {
+	if eventType, _ := payload["type"].(string); eventType != "Message" {
+		return
+	}
+	event, _ := payload["event"].(map[string]interface{})
+	info, _ := event["Info"].(map[string]interface{})
+	message, _ := event["Message"].(map[string]interface{})
+	if info == nil || message == nil {
+		return
+	}
+	if fromMe, _ := info["IsFromMe"].(bool); fromMe {
+		return
+	}
+	if isGroup, _ := info["IsGroup"].(bool); isGroup {
+		return
+	}
+	sender, _ := info["Sender"].(string)
+
+	text, _ := message["conversation"].(string)
+	if extended, ok := message["extendedTextMessage"].(map[string]interface{}); ok && text == "" {
+		text, _ = extended["text"].(string)
+	}
+	text = strings.TrimSpace(text)
+	if sender == "" || text == "" {
+		return
+	}
+
+	for _, keyword := range optOutKeywords() {
+		if strings.EqualFold(text, keyword) {
+			if _, _, err := addRecipientBlocks(session.UserID, []string{sender}, "inbound "+strings.ToUpper(keyword), models.BlockSourceKeyword); err != nil {
+				log.Printf("Opt-out keyword for session %s failed: %v", session.SessionID, err)
+			}
+			return
+		}
+	}
+}
+
+func ListBlocklist(c *gin.Context) {
+	user := c.MustGet("user").(models.ServiceUser)
+	respondBlocklist(c, user.ID)
+}
+
+func AddBlocklist(c *gin.Context) {
+	user := c.MustGet("user").(models.ServiceUser)
+	handleAddBlocklist(c, user.ID, models.BlockSourceCustomer)
+}
+
+func RemoveBlocklist(c *gin.Context) {
+	user := c.MustGet("user").(models.ServiceUser)
+	handleRemoveBlocklist(c, user.ID)
+}
+
+func RemoveBlocklistRecipient(c *gin.Context) {
+	user := c.MustGet("user").(models.ServiceUser)
+	respondRemoveBlocklist(c, user.ID, []string{c.Param("recipient")})
+}
+
+func InternalListBlocklist(c *gin.Context) {
+	userID, ok := internalBlocklistUser(c)
+	if !ok {
+		return
+	}
+	respondBlocklist(c, userID)
+}
+
+func InternalAddBlocklist(c *gin.Context) {
+	userID, ok := internalBlocklistUser(c)
+	if !ok {
+		return
+	}
+	handleAddBlocklist(c, userID, models.BlockSourceInternal)
+}
+
+func InternalRemoveBlocklist(c *gin.Context) {
+	userID, ok := internalBlocklistUser(c)
+	if !ok {
+		return
+	}
+	handleRemoveBlocklist(c, userID)
+}
+
+func InternalRemoveBlocklistRecipient(c *gin.Context) {
+	userID, ok := internalBlocklistUser(c)
+	if !ok {
+		return
+	}
+	respondRemoveBlocklist(c, userID, []string{c.Param("recipient")})
+}
+
+func internalBlocklistUser(c *gin.Context) (string, bool) {
+	userID := c.Param("user_id")
+	if source, scoped := getInternalSourceScope(c); scoped {
+		if !internalCanAccessUser(userID, source) {
+			c.JSON(http.StatusForbidden, gin.H{"message": "user does not belong to this source"})
+			return "", false
+		}
+	}
+	return userID, true
+}
+
+// respondBlocklist serves ?search=&page=&limit=; search matches a prefix of
+// the normalized recipient.
+func respondBlocklist(c *gin.Context, userID string) {
+	page := parsePositiveInt(c.DefaultQuery("page", "1"), 1)
+	limit := parsePositiveInt(c.DefaultQuery("limit", "50"), 50)
+	if limit > 500 {
+		limit = 500
+	}
+
+	query := database.GetDB().Model(&models.RecipientBlock{}).Where("user_id = ?", userID)
+	if search := strings.TrimSpace(c.Query("search")); search != "" {
+		if key, err := blocklistKey(search); err == nil {
+			search = key
+		}
+		query = query.Where("recipient LIKE ?", search+"%")
+	}
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "failed to count blocklist"})
+		return
+	}
+	var entries []models.RecipientBlock
+	if err := query.Order("created_at desc, id desc").Limit(limit).Offset((page - 1) * limit).Find(&entries).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "failed to list blocklist"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"items": entries,
+		"meta": gin.H{
+			"page":  page,
+			"limit": limit,
+			"total": total,
+		},
+	})
+}
+
+func handleAddBlocklist(c *gin.Context, userID, source string) {
+	var req blocklistRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+	values := req.values()
+	if len(values) == 0 || len(values) > maxBlocklistBatch {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "provide recipient or recipients (max 1000)"})
+		return
+	}
+
+	added, invalid, err := addRecipientBlocks(userID, values, strings.TrimSpace(req.Reason), source)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "failed to update blocklist"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"added": added, "invalid": invalidOrEmpty(invalid)})
+}
+
+func handleRemoveBlocklist(c *gin.Context, userID string) {
+	var req blocklistRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+	values := req.values()
+	if len(values) == 0 || len(values) > maxBlocklistBatch {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "provide recipient or recipients (max 1000)"})
+		return
+	}
+	respondRemoveBlocklist(c, userID, values)
+}
+
+func respondRemoveBlocklist(c *gin.Context, userID string, values []string) {
+	removed, invalid, err := removeRecipientBlocks(userID, values)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "failed to update blocklist"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"removed": removed, "invalid": invalidOrEmpty(invalid)})
+}
+
+func invalidOrEmpty(invalid []invalidRecipient) []invalidRecipient {
+	if invalid == nil {
+		return []invalidRecipient{}
+	}
+	return invalid
+}
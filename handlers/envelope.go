@@ -0,0 +1,293 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"genfity-wa-support/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Machine-readable codes returned in the response envelope. Responses that do
+// not set one get a code derived from their HTTP status.
+const (
+	codeOK                   = "OK"
+	codeBadRequest           = "BAD_REQUEST"
+	codeUnauthorized         = "UNAUTHORIZED"
+	codeForbidden            = "FORBIDDEN"
+	codeNotFound             = "NOT_FOUND"
+	codeConflict             = "CONFLICT"
+	codeUnprocessable        = "UNPROCESSABLE_ENTITY"
+	codeRateLimited          = "RATE_LIMITED"
+	codeInternal             = "INTERNAL_ERROR"
+	codeUpstreamError        = "UPSTREAM_ERROR"
+	codeUpstreamUnavailable  = "UPSTREAM_UNAVAILABLE"
+	codeInvalidAPIKey        = "INVALID_API_KEY"
+	codeInvalidSessionToken  = "INVALID_SESSION_TOKEN"
+	codeSubscriptionExpired  = "SUBSCRIPTION_EXPIRED"
+	codeSubscriptionInactive = "SUBSCRIPTION_INACTIVE"
+	codeSessionNotFound      = "SESSION_NOT_FOUND"
+	codeSessionLimitExceeded = "SESSION_LIMIT_EXCEEDED"
+	codeQuotaExceeded        = "QUOTA_EXCEEDED"
+	codePolicyDenied         = "POLICY_DENIED"
+	codeInvalidRecipient     = "INVALID_RECIPIENT"
+	codeRecipientBlocked     = "RECIPIENT_BLOCKED"
+	codeIdempotencyConflict  = "IDEMPOTENCY_CONFLICT"
+	codeNoProviderNode       = "NO_PROVIDER_NODE"
+
+	responseCodeKey     = "response_code"
+	responseUpstreamKey = "response_upstream"
+	envelopeHeader      = "X-Response-Envelope"
+)
+
+var (
+	errSubscriptionExpired = errors.New("subscription expired")
+	errInvalidSessionToken = errors.New("invalid session token")
+)
+
+// setResponseCode records the envelope code for the response being written;
+// it does not change the plain (non-envelope) body.
+func setResponseCode(c *gin.Context, code string) {
+	c.Set(responseCodeKey, code)
+}
+
+func respondError(c *gin.Context, status int, code, message string) {
+	setResponseCode(c, code)
+	c.JSON(status, gin.H{"message": message})
+}
+
+func abortWithError(c *gin.Context, status int, code, message string) {
+	setResponseCode(c, code)
+	c.AbortWithStatusJSON(status, gin.H{"message": message})
+}
+
+// markUpstreamResponse flags the body as coming from the provider so the
+// envelope unwraps its native {code, data, error} shape.
+func markUpstreamResponse(c *gin.Context) {
+	c.Set(responseUpstreamKey, true)
+}
+
+func subscriptionErrorCode(err error) string {
+	if errors.Is(err, errSubscriptionExpired) {
+		return codeSubscriptionExpired
+	}
+	return codeSubscriptionInactive
+}
+
+func statusCode(status int) string {
+	switch {
+	case status < 400:
+		return codeOK
+	case status == http.StatusBadRequest:
+		return codeBadRequest
+	case status == http.StatusUnauthorized:
+		return codeUnauthorized
+	case status == http.StatusForbidden:
+		return codeForbidden
+	case status == http.StatusNotFound:
+		return codeNotFound
+	case status == http.StatusConflict:
+		return codeConflict
+	case status == http.StatusUnprocessableEntity:
+		return codeUnprocessable
+	case status == http.StatusTooManyRequests:
+		return codeRateLimited
+	case status == http.StatusBadGateway || status == http.StatusGatewayTimeout:
+		return codeUpstreamError
+	case status == http.StatusServiceUnavailable:
+		return codeUpstreamUnavailable
+	case status >= 500:
+		return codeInternal
+	}
+	return codeBadRequest
+}
+
+func wantsEnvelope(c *gin.Context) bool {
+	for _, value := range []string{c.GetHeader(envelopeHeader), c.Query("envelope")} {
+		switch strings.ToLower(strings.TrimSpace(value)) {
+		case "1", "true", "yes":
+			return true
+		}
+	}
+	return false
+}
+
+// ResponseEnvelope wraps JSON responses in models.GatewayResponse when the
+// client asks for it with X-Response-Envelope: 1 or ?envelope=1. Non-JSON
+// bodies (media, downloads, event streams) are streamed through unchanged.
+func ResponseEnvelope() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !wantsEnvelope(c) {
+			c.Next()
+			return
+		}
+
+		// Keep the opt-in out of what the gateway forwards upstream, and ask
+		// for an uncompressed body so it can be unwrapped.
+		c.Request.Header.Del(envelopeHeader)
+		c.Request.Header.Del("Accept-Encoding")
+		query := c.Request.URL.Query()
+		if query.Has("envelope") {
+			query.Del("envelope")
+			c.Request.URL.RawQuery = query.Encode()
+		}
+
+		writer := &envelopeWriter{ResponseWriter: c.Writer, status: http.StatusOK}
+		c.Writer = writer
+		c.Next()
+		c.Writer = writer.ResponseWriter
+
+		if writer.passthrough {
+			return
+		}
+		status := writer.status
+		if c.Request.Method == http.MethodHead || status == http.StatusNoContent || status == http.StatusNotModified {
+			writer.ResponseWriter.WriteHeader(status)
+			writer.ResponseWriter.WriteHeaderNow()
+			return
+		}
+
+		envelope := buildEnvelope(c, status, writer.buf.Bytes())
+		body, _ := json.Marshal(envelope)
+		header := writer.ResponseWriter.Header()
+		header.Del("Content-Length")
+		header.Set("Content-Type", "application/json; charset=utf-8")
+		writer.ResponseWriter.WriteHeader(status)
+		_, _ = writer.ResponseWriter.Write(body)
+	}
+}
+
+func buildEnvelope(c *gin.Context, status int, body []byte) models.GatewayResponse {
+	envelope := models.GatewayResponse{Status: status}
+	upstream := c.GetBool(responseUpstreamKey)
+
+	var parsed interface{}
+	if len(bytes.TrimSpace(body)) > 0 {
+		if err := json.Unmarshal(body, &parsed); err != nil {
+			parsed = string(body)
+		}
+	}
+
+	if object, ok := parsed.(map[string]interface{}); ok {
+		if upstream {
+			// genfity-wa: {"code": 200, "data": {...}, "success": true} or
+			// {"code": 400, "error": "...", "success": false}.
+			envelope.Message = firstString(object, "error", "message")
+			if data, ok := object["data"]; ok {
+				envelope.Data = data
+			} else if envelope.Message == "" {
+				envelope.Data = object
+			}
+		} else {
+			envelope.Message, _ = object["message"].(string)
+			delete(object, "message")
+			if len(object) > 0 {
+				envelope.Data = object
+			}
+		}
+	} else if parsed != nil {
+		envelope.Data = parsed
+	}
+
+	envelope.Code = c.GetString(responseCodeKey)
+	if envelope.Code == "" {
+		envelope.Code = statusCode(status)
+		if upstream && status >= 400 && status != http.StatusServiceUnavailable {
+			envelope.Code = codeUpstreamError
+		}
+	}
+	if envelope.Message == "" {
+		envelope.Message = http.StatusText(status)
+	}
+	return envelope
+}
+
+func firstString(object map[string]interface{}, keys ...string) string {
+	for _, key := range keys {
+		if value, ok := object[key].(string); ok && value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// envelopeWriter buffers JSON bodies until the handler chain finishes. The
+// first write decides: anything that is not JSON switches to passthrough and
+// streams (and flushes) as usual.
+type envelopeWriter struct {
+	gin.ResponseWriter
+	buf         bytes.Buffer
+	status      int
+	decided     bool
+	passthrough bool
+}
+
+func (w *envelopeWriter) decide() {
+	if w.decided {
+		return
+	}
+	w.decided = true
+	if !strings.Contains(w.Header().Get("Content-Type"), "json") {
+		w.passthrough = true
+		w.ResponseWriter.WriteHeader(w.status)
+	}
+}
+
+func (w *envelopeWriter) WriteHeader(code int) {
+	if w.passthrough {
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+	if code > 0 {
+		w.status = code
+	}
+}
+
+func (w *envelopeWriter) WriteHeaderNow() {
+	if w.passthrough {
+		w.ResponseWriter.WriteHeaderNow()
+	}
+}
+
+func (w *envelopeWriter) Write(data []byte) (int, error) {
+	w.decide()
+	if w.passthrough {
+		return w.ResponseWriter.Write(data)
+	}
+	return w.buf.Write(data)
+}
+
+func (w *envelopeWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+func (w *envelopeWriter) Flush() {
+	if w.passthrough {
+		w.ResponseWriter.Flush()
+	}
+}
+
+func (w *envelopeWriter) Status() int {
+	if w.passthrough {
+		return w.ResponseWriter.Status()
+	}
+	return w.status
+}
+
+func (w *envelopeWriter) Size() int {
+	if w.passthrough {
+		return w.ResponseWriter.Size()
+	}
+	return w.buf.Len()
+}
+
+func (w *envelopeWriter) Written() bool {
+	if w.passthrough {
+		return w.ResponseWriter.Written()
+	}
+	return w.decided
+}
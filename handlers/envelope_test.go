@@ -0,0 +1,104 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"genfity-wa-support/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestBuildEnvelope(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		upstream bool
+		code     string
+		status   int
+		body     string
+		want     models.GatewayResponse
+	}{
+		{
+			name: "local error", status: http.StatusNotFound, body: `{"message":"session not found"}`,
+			want: models.GatewayResponse{Status: 404, Code: codeNotFound, Message: "session not found"},
+		},
+		{
+			name: "local error with code", code: codeSessionNotFound, status: http.StatusNotFound, body: `{"message":"session not found"}`,
+			want: models.GatewayResponse{Status: 404, Code: codeSessionNotFound, Message: "session not found"},
+		},
+		{
+			name: "local success keeps other fields", status: http.StatusOK, body: `{"message":"ok","id":"x"}`,
+			want: models.GatewayResponse{Status: 200, Code: codeOK, Message: "ok", Data: map[string]interface{}{"id": "x"}},
+		},
+		{
+			name: "local empty body", status: http.StatusNoContent,
+			want: models.GatewayResponse{Status: 204, Code: codeOK, Message: "No Content"},
+		},
+		{
+			name: "non-json body", status: http.StatusInternalServerError, body: "boom",
+			want: models.GatewayResponse{Status: 500, Code: codeInternal, Message: "Internal Server Error", Data: "boom"},
+		},
+		{
+			name: "local array", status: http.StatusOK, body: `[1,2]`,
+			want: models.GatewayResponse{Status: 200, Code: codeOK, Message: "OK", Data: []interface{}{1.0, 2.0}},
+		},
+		{
+			name: "upstream success unwraps data", upstream: true, status: http.StatusOK,
+			body: `{"code":200,"data":{"Id":"m1"},"success":true}`,
+			want: models.GatewayResponse{Status: 200, Code: codeOK, Message: "OK", Data: map[string]interface{}{"Id": "m1"}},
+		},
+		{
+			name: "upstream error", upstream: true, status: http.StatusBadRequest,
+			body: `{"code":400,"error":"missing Phone","success":false}`,
+			want: models.GatewayResponse{Status: 400, Code: codeUpstreamError, Message: "missing Phone"},
+		},
+		{
+			name: "upstream unavailable keeps its code", upstream: true, status: http.StatusServiceUnavailable,
+			body: `{"message":"circuit open"}`,
+			want: models.GatewayResponse{Status: 503, Code: codeUpstreamUnavailable, Message: "circuit open"},
+		},
+		{
+			name: "upstream object without data", upstream: true, status: http.StatusOK, body: `{"Connected":true}`,
+			want: models.GatewayResponse{Status: 200, Code: codeOK, Message: "OK", Data: map[string]interface{}{"Connected": true}},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c, _ := gin.CreateTestContext(httptest.NewRecorder())
+			if tc.upstream {
+				c.Set(responseUpstreamKey, true)
+			}
+			if tc.code != "" {
+				c.Set(responseCodeKey, tc.code)
+			}
+			got := buildEnvelope(c, tc.status, []byte(tc.body))
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("buildEnvelope = %#v, want %#v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestStatusCode(t *testing.T) {
+	for status, want := range map[int]string{
+		http.StatusOK:                  codeOK,
+		http.StatusFound:               codeOK,
+		http.StatusBadRequest:          codeBadRequest,
+		http.StatusUnauthorized:        codeUnauthorized,
+		http.StatusForbidden:           codeForbidden,
+		http.StatusNotFound:            codeNotFound,
+		http.StatusConflict:            codeConflict,
+		http.StatusUnprocessableEntity: codeUnprocessable,
+		http.StatusTooManyRequests:     codeRateLimited,
+		http.StatusBadGateway:          codeUpstreamError,
+		http.StatusGatewayTimeout:      codeUpstreamError,
+		http.StatusServiceUnavailable:  codeUpstreamUnavailable,
+		http.StatusInternalServerError: codeInternal,
+		http.StatusTeapot:              codeBadRequest,
+	} {
+		if got := statusCode(status); got != want {
+			t.Errorf("statusCode(%d) = %q, want %q", status, got, want)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"genfity-wa-support/database"
+	"genfity-wa-support/models"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	idempotencyHeader = "Idempotency-Key"
+
+	// idempotencyLease bounds how long an in-flight claim blocks retries if
+	// the process dies before the upstream call completes.
+	idempotencyLease = 5 * time.Minute
+	// idempotencyWait is how long a duplicate waits for the in-flight
+	// original before giving up with 409.
+	idempotencyWait = 30 * time.Second
+)
+
+// beginIdempotentRequest claims the request's Idempotency-Key for the session.
+// It returns the claimed record when this request should be proxied, or
+// handled=true when a response (replay or error) has already been written.
+func beginIdempotentRequest(c *gin.Context, sessionID, targetPath string) (record *models.IdempotencyRecord, handled bool) {
+	key := strings.TrimSpace(c.GetHeader(idempotencyHeader))
+	if key == "" || c.Request.Method != http.MethodPost {
+		return nil, false
+	}
+	if len(key) > 255 {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Idempotency-Key must be at most 255 characters"})
+		return nil, true
+	}
+
+	db := database.GetDB()
+	for attempt := 0; attempt < 2; attempt++ {
+		now := time.Now()
+		claim := models.IdempotencyRecord{
+			SessionID:      sessionID,
+			IdempotencyKey: key,
+			Method:         c.Request.Method,
+			Path:           targetPath,
+			Status:         models.IdempotencyInFlight,
+			ExpiresAt:      now.Add(idempotencyLease),
+		}
+		res := db.Clauses(clause.OnConflict{DoNothing: true}).Create(&claim)
+		if res.Error != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"message": "failed to store idempotency key"})
+			return nil, true
+		}
+		if res.RowsAffected == 1 {
+			return &claim, false
+		}
+
+		var existing models.IdempotencyRecord
+		if err := db.Where("session_id = ? AND idempotency_key = ?", sessionID, key).First(&existing).Error; err != nil {
+			continue
+		}
+		if !now.Before(existing.ExpiresAt) {
+			// Stale claim or expired response: drop it and claim again.
+			db.Where("id = ? AND expires_at <= ?", existing.ID, now).Delete(&models.IdempotencyRecord{})
+			continue
+		}
+		if existing.Method != c.Request.Method || existing.Path != targetPath {
+			respondError(c, http.StatusUnprocessableEntity, codeIdempotencyConflict, "Idempotency-Key was already used for a different request")
+			return nil, true
+		}
+		replayIdempotentResponse(c, existing)
+		return nil, true
+	}
+
+	respondError(c, http.StatusConflict, codeIdempotencyConflict, "could not claim Idempotency-Key, retry later")
+	return nil, true
+}
+
+// replayIdempotentResponse writes the stored response, waiting for an
+// in-flight original to finish first.
+func replayIdempotentResponse(c *gin.Context, record models.IdempotencyRecord) {
+	deadline := time.Now().Add(idempotencyWait)
+	for record.Status != models.IdempotencyCompleted {
+		if time.Now().After(deadline) {
+			c.Header("Retry-After", "1")
+			c.JSON(http.StatusConflict, gin.H{"message": "a request with this Idempotency-Key is still in progress"})
+			return
+		}
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case <-time.After(250 * time.Millisecond):
+		}
+		if err := database.GetDB().Where("id = ?", record.ID).First(&record).Error; err != nil {
+			// The original never reached the provider and released its claim.
+			c.Header("Retry-After", "1")
+			c.JSON(http.StatusConflict, gin.H{"message": "the original request with this Idempotency-Key failed, retry"})
+			return
+		}
+	}
+
+	contentType := record.ContentType
+	if contentType == "" {
+		contentType = "application/json"
+	}
+	c.Header("Idempotent-Replayed", "true")
+	c.Data(record.ResponseStatus, contentType, record.ResponseBody)
+}
+
+// completeIdempotentRequest stores the first upstream response for replay,
+// whatever its status. A body that could not be captured is stored empty:
+// the provider has answered, so a retry must not send again.
+func completeIdempotentRequest(record *models.IdempotencyRecord, status int, contentType string, body []byte) {
+	if record == nil {
+		return
+	}
+	if body == nil {
+		body = []byte{}
+	}
+	_ = database.GetDB().Model(&models.IdempotencyRecord{}).Where("id = ?", record.ID).Updates(map[string]interface{}{
+		"status":          models.IdempotencyCompleted,
+		"response_status": status,
+		"content_type":    contentType,
+		"response_body":   body,
+		"expires_at":      time.Now().Add(idempotencyTTL()),
+	}).Error
+}
+
+// failIdempotentRequest stores the 502 for an upstream call that failed
+// after it may have reached the provider.
+func failIdempotentRequest(record *models.IdempotencyRecord, err error) {
+	body, _ := json.Marshal(gin.H{"message": err.Error()})
+	completeIdempotentRequest(record, http.StatusBadGateway, "application/json", body)
+}
+
+// abandonIdempotentRequest releases the claim so the caller can retry. Only
+// for requests that never reached the provider.
+func abandonIdempotentRequest(record *models.IdempotencyRecord) {
+	if record == nil {
+		return
+	}
+	_ = database.GetDB().Where("id = ?", record.ID).Delete(&models.IdempotencyRecord{}).Error
+}
+
+func idempotencyTTL() time.Duration {
+	return time.Duration(getEnvInt("IDEMPOTENCY_TTL_MINUTES", 1440)) * time.Minute
+}
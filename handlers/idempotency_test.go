@@ -0,0 +1,91 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"genfity-wa-support/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestUpstreamNeverSent(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"circuit open", &circuitOpenError{NodeID: "default"}, true},
+		{"request not built", fmt.Errorf("%w: bad url", errUpstreamNotSent), true},
+		{"dial refused", &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}, true},
+		{"wrapped dial", fmt.Errorf("Post: %w", &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("no route")}), true},
+		{"reset after write", &net.OpError{Op: "read", Net: "tcp", Err: errors.New("connection reset")}, false},
+		{"timeout", context.DeadlineExceeded, false},
+		{"body read failed", &recipientError{Reason: "send body has more than one recipient field"}, false},
+		{"other", errors.New("unexpected EOF"), false},
+	} {
+		if got := upstreamNeverSent(tc.err); got != tc.want {
+			t.Errorf("%s: upstreamNeverSent = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestBeginIdempotentRequestSkipsWithoutClaim(t *testing.T) {
+	for _, tc := range []struct {
+		name, method, key string
+		handled           bool
+		status            int
+	}{
+		{"no key", http.MethodPost, "", false, http.StatusOK},
+		{"blank key", http.MethodPost, "   ", false, http.StatusOK},
+		{"not a POST", http.MethodGet, "k1", false, http.StatusOK},
+		{"key too long", http.MethodPost, strings.Repeat("k", 256), true, http.StatusBadRequest},
+	} {
+		recorder := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(recorder)
+		c.Request = httptest.NewRequest(tc.method, "/wa/chat/send/text", nil)
+		if tc.key != "" {
+			c.Request.Header.Set(idempotencyHeader, tc.key)
+		}
+		record, handled := beginIdempotentRequest(c, "s1", "/chat/send/text")
+		if record != nil || handled != tc.handled || recorder.Code != tc.status {
+			t.Errorf("%s: record = %v, handled = %v, status = %d", tc.name, record, handled, recorder.Code)
+		}
+	}
+}
+
+func TestReplayIdempotentResponse(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		record      models.IdempotencyRecord
+		contentType string
+	}{
+		{
+			name:        "stored response",
+			record:      models.IdempotencyRecord{Status: models.IdempotencyCompleted, ResponseStatus: 200, ContentType: "application/json; charset=utf-8", ResponseBody: []byte(`{"id":"m1"}`)},
+			contentType: "application/json; charset=utf-8",
+		},
+		{
+			name:        "uncaptured body",
+			record:      models.IdempotencyRecord{Status: models.IdempotencyCompleted, ResponseStatus: 502, ResponseBody: []byte{}},
+			contentType: "application/json",
+		},
+	} {
+		recorder := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(recorder)
+		c.Request = httptest.NewRequest(http.MethodPost, "/wa/chat/send/text", nil)
+		replayIdempotentResponse(c, tc.record)
+		if recorder.Code != tc.record.ResponseStatus || recorder.Body.String() != string(tc.record.ResponseBody) {
+			t.Errorf("%s: replayed %d %q", tc.name, recorder.Code, recorder.Body.String())
+		}
+		if recorder.Header().Get("Idempotent-Replayed") != "true" || recorder.Header().Get("Content-Type") != tc.contentType {
+			t.Errorf("%s: headers = %v", tc.name, recorder.Header())
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package handlers
 
 import (
+	"errors"
 	"net/http"
 	"strconv"
 	"strings"
@@ -10,6 +11,7 @@ import (
 	"genfity-wa-support/models"
 
 	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
 )
 
 type upsertUserRequest struct {
@@ -19,7 +21,15 @@ type upsertUserRequest struct {
 	MaxSessions int       `json:"max_sessions"`
 	MaxMessages int       `json:"max_messages"`
 	Provider    string    `json:"provider"`
+	Plan        string    `json:"plan"`
 	CreatedBy   string    `json:"created_by"`
+
+	// Quota period: none (lifetime), daily, weekly or monthly. Windows start at
+	// the anchor's time of day in QuotaTimezone (default Asia/Jakarta). Omitted
+	// fields keep the subscription's current setting.
+	QuotaPeriod   string     `json:"quota_period"`
+	QuotaAnchorAt *time.Time `json:"quota_anchor_at"`
+	QuotaTimezone string     `json:"quota_timezone"`
 }
 
 type internalUserListItem struct {
@@ -32,10 +42,12 @@ type internalUserListItem struct {
 
 	Subscription struct {
 		Provider    string                    `json:"provider"`
+		Plan        string                    `json:"plan"`
 		Status      models.SubscriptionStatus `json:"status"`
 		ExpiresAt   time.Time                 `json:"expires_at"`
 		MaxSessions int                       `json:"max_sessions"`
 		MaxMessages int                       `json:"max_messages"`
+		Usage       *quotaUsage               `json:"usage,omitempty"`
 	} `json:"subscription"`
 
 	SessionCount int64 `json:"session_count"`
@@ -64,7 +76,7 @@ func InternalListUsers(c *gin.Context) {
 	if !scoped {
 		source = requestedSource
 	}
-	provider := strings.TrimSpace(c.DefaultQuery("provider", "genfity-wa"))
+	provider := strings.TrimSpace(c.DefaultQuery("provider", defaultProviderName))
 	page := parsePositiveInt(c.DefaultQuery("page", "1"), 1)
 	limit := parsePositiveInt(c.DefaultQuery("limit", "20"), 20)
 	if limit > 100 {
@@ -103,10 +115,13 @@ func InternalListUsers(c *gin.Context) {
 		var sub models.UserSubscription
 		if err := db.Where("user_id = ? AND provider = ?", user.ID, provider).Order("updated_at desc").First(&sub).Error; err == nil {
 			item.Subscription.Provider = sub.Provider
+			item.Subscription.Plan = sub.Plan
 			item.Subscription.Status = sub.Status
 			item.Subscription.ExpiresAt = sub.ExpiresAt
 			item.Subscription.MaxSessions = sub.MaxSessions
 			item.Subscription.MaxMessages = sub.MaxMessages
+			usage := buildQuotaUsage(sub)
+			item.Subscription.Usage = &usage
 		}
 
 		_ = db.Model(&models.WhatsAppSession{}).Where("user_id = ?", user.ID).Count(&item.SessionCount).Error
@@ -151,7 +166,15 @@ func InternalUpsertUser(c *gin.Context) {
 		req.MaxSessions = 1
 	}
 	if req.Provider == "" {
-		req.Provider = "genfity-wa"
+		req.Provider = defaultProviderName
+	}
+	if _, err := providerFor(req.Provider); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+	if _, err := applyQuotaSettings(&models.UserSubscription{}, req, time.Now()); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
 	}
 
 	db := database.GetDB()
@@ -185,25 +208,46 @@ func InternalUpsertUser(c *gin.Context) {
 	}
 
 	var sub models.UserSubscription
-	if err := db.Where("user_id = ? AND provider = ?", req.UserID, req.Provider).First(&sub).Error; err != nil {
+	err := db.Where("user_id = ? AND provider = ?", req.UserID, req.Provider).First(&sub).Error
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
 		sub = models.UserSubscription{
 			UserID:      req.UserID,
 			Provider:    req.Provider,
 			ExpiresAt:   req.ExpiresAt,
 			MaxSessions: req.MaxSessions,
 			MaxMessages: req.MaxMessages,
+			Plan:        req.Plan,
 			Status:      models.SubscriptionActive,
 		}
+		if _, err := applyQuotaSettings(&sub, req, time.Now()); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+			return
+		}
 		if err := db.Create(&sub).Error; err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"message": "failed to create subscription"})
 			return
 		}
-	} else {
-		sub.ExpiresAt = req.ExpiresAt
-		sub.MaxSessions = req.MaxSessions
-		sub.MaxMessages = req.MaxMessages
-		sub.Status = models.SubscriptionActive
-		if err := db.Save(&sub).Error; err != nil {
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "failed to load subscription"})
+		return
+	default:
+		// Targeted update: the usage counters move concurrently and must not
+		// be written back from the row read above.
+		updates, err := applyQuotaSettings(&sub, req, time.Now())
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+			return
+		}
+		updates["expires_at"] = req.ExpiresAt
+		updates["max_sessions"] = req.MaxSessions
+		updates["max_messages"] = req.MaxMessages
+		updates["status"] = models.SubscriptionActive
+		updates["updated_at"] = time.Now()
+		if req.Plan != "" {
+			updates["plan"] = req.Plan
+		}
+		if err := db.Model(&models.UserSubscription{}).Where("id = ?", sub.ID).Updates(updates).Error; err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"message": "failed to update subscription"})
 			return
 		}
@@ -236,13 +280,32 @@ func InternalUpdateUser(c *gin.Context) {
 	}
 
 	if req.Provider == "" {
-		req.Provider = "genfity-wa"
+		req.Provider = defaultProviderName
+	}
+	if _, err := providerFor(req.Provider); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
 	}
 	if req.MaxSessions <= 0 {
 		req.MaxSessions = 1
 	}
 
 	db := database.GetDB()
+	var sub models.UserSubscription
+	if err := db.Where("user_id = ? AND provider = ?", userID, req.Provider).First(&sub).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"message": "subscription not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "failed to load subscription"})
+		return
+	}
+	updates, err := applyQuotaSettings(&sub, req, time.Now())
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+
 	if err := db.Model(&models.ServiceUser{}).Where("id = ?", userID).Updates(map[string]interface{}{
 		"source_service": req.Source,
 		"updated_at":     time.Now(),
@@ -251,15 +314,16 @@ func InternalUpdateUser(c *gin.Context) {
 		return
 	}
 
-	if err := db.Model(&models.UserSubscription{}).
-		Where("user_id = ? AND provider = ?", userID, req.Provider).
-		Updates(map[string]interface{}{
-			"expires_at":   req.ExpiresAt,
-			"max_sessions": req.MaxSessions,
-			"max_messages": req.MaxMessages,
-			"status":       models.SubscriptionActive,
-			"updated_at":   time.Now(),
-		}).Error; err != nil {
+	updates["expires_at"] = req.ExpiresAt
+	updates["max_sessions"] = req.MaxSessions
+	updates["max_messages"] = req.MaxMessages
+	updates["status"] = models.SubscriptionActive
+	updates["updated_at"] = time.Now()
+	if req.Plan != "" {
+		updates["plan"] = req.Plan
+	}
+
+	if err := db.Model(&models.UserSubscription{}).Where("id = ?", sub.ID).Updates(updates).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"message": "failed to update subscription"})
 		return
 	}
@@ -0,0 +1,260 @@
+package handlers
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"genfity-wa-support/database"
+	"genfity-wa-support/models"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const (
+	ledgerSourceGateway   = "gateway"
+	ledgerSourceAPI       = "api"
+	ledgerSourceQueue     = "queue"
+	ledgerSourceScheduled = "scheduled"
+)
+
+func appendSendLedger(session models.WhatsAppSession, rec sendRecord) {
+	status := "failed"
+	if rec.Success {
+		status = "sent"
+	}
+	entry := models.SendLedgerEntry{
+		UserID:            session.UserID,
+		SessionID:         session.SessionID,
+		MessageType:       rec.MessageType,
+		RecipientHash:     hashRecipient(rec.Recipient),
+		UpstreamMessageID: extractUpstreamMessageID(rec.Body),
+		Status:            status,
+		HTTPStatus:        rec.HTTPStatus,
+		Source:            rec.Source,
+	}
+	if err := database.GetDB().Create(&entry).Error; err != nil {
+		log.Printf("Send ledger entry for session %s failed: %v", session.SessionID, err)
+	}
+}
+
+var ledgerHashKeyWarning sync.Once
+
+// ledgerHashKey is SEND_LEDGER_HASH_KEY, or nil when it is not set: an
+// unkeyed hash of a phone number is as good as the number, so recipient
+// hashing is then switched off.
+func ledgerHashKey() []byte {
+	key := os.Getenv("SEND_LEDGER_HASH_KEY")
+	if key == "" {
+		ledgerHashKeyWarning.Do(func() {
+			log.Print("SEND_LEDGER_HASH_KEY is not set, send ledger recipient hashing is disabled")
+		})
+		return nil
+	}
+	return []byte(key)
+}
+
+// hashRecipient keys the hash with SEND_LEDGER_HASH_KEY so phone numbers cannot
+// be recovered by brute force from a leaked ledger. It is empty when no key
+// is configured.
+func hashRecipient(recipient string) string {
+	key := ledgerHashKey()
+	normalized := ledgerRecipientKey(recipient)
+	if key == nil || normalized == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(normalized))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// ledgerRecipientKey reduces the ways one recipient can be written to a
+// single form: E.164 digits for phone numbers and user JIDs, the full JID for
+// groups/channels. Unparseable input is hashed as-is.
+func ledgerRecipientKey(recipient string) string {
+	key, err := blocklistKey(recipient)
+	if err != nil {
+		return strings.ToLower(strings.TrimSpace(recipient))
+	}
+	return key
+}
+
+func payloadRecipient(payload map[string]interface{}) string {
+	key, err := payloadRecipientKey(payload)
+	if err != nil || key == "" {
+		return ""
+	}
+	return payload[key].(string)
+}
+
+// extractUpstreamMessageID reads the message ID from a genfity-wa send
+// response ({"data":{"Id":"..."}}) or a flat {"id":"..."}.
+func extractUpstreamMessageID(body []byte) string {
+	var payload map[string]interface{}
+	if len(body) == 0 || json.Unmarshal(body, &payload) != nil {
+		return ""
+	}
+	candidates := []map[string]interface{}{payload}
+	if data, ok := payload["data"].(map[string]interface{}); ok {
+		candidates = append([]map[string]interface{}{data}, payload)
+	}
+	for _, candidate := range candidates {
+		for _, key := range []string{"Id", "id", "ID", "message_id", "MessageID"} {
+			if value, ok := candidate[key].(string); ok && value != "" {
+				if len(value) > 128 {
+					value = value[:128]
+				}
+				return value
+			}
+		}
+	}
+	return ""
+}
+
+func ListSendLedger(c *gin.Context) {
+	user := c.MustGet("user").(models.ServiceUser)
+	respondSendLedger(c, user.ID)
+}
+
+func InternalListSendLedger(c *gin.Context) {
+	userID := c.Param("user_id")
+	if source, scoped := getInternalSourceScope(c); scoped {
+		if !internalCanAccessUser(userID, source) {
+			c.JSON(http.StatusForbidden, gin.H{"message": "user does not belong to this source"})
+			return
+		}
+	}
+	respondSendLedger(c, userID)
+}
+
+// respondSendLedger serves ?from=&to=&session_id=&status=&type=&recipient=
+// as paginated JSON, or streams every match as CSV with ?format=csv.
+func respondSendLedger(c *gin.Context, userID string) {
+	query := database.GetDB().Model(&models.SendLedgerEntry{}).Where("user_id = ?", userID)
+
+	if raw := strings.TrimSpace(c.Query("from")); raw != "" {
+		from, err := parseLedgerTime(raw, false)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"message": "invalid from, use RFC3339 or YYYY-MM-DD"})
+			return
+		}
+		query = query.Where("created_at >= ?", from)
+	}
+	if raw := strings.TrimSpace(c.Query("to")); raw != "" {
+		to, err := parseLedgerTime(raw, true)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"message": "invalid to, use RFC3339 or YYYY-MM-DD"})
+			return
+		}
+		query = query.Where("created_at < ?", to)
+	}
+	if sessionID := strings.TrimSpace(c.Query("session_id")); sessionID != "" {
+		query = query.Where("session_id = ?", sessionID)
+	}
+	if status := strings.TrimSpace(c.Query("status")); status != "" {
+		query = query.Where("status = ?", status)
+	}
+	if messageType := strings.TrimSpace(c.Query("type")); messageType != "" {
+		query = query.Where("message_type = ?", messageType)
+	}
+	if recipient := strings.TrimSpace(c.Query("recipient")); recipient != "" {
+		if ledgerHashKey() == nil {
+			c.JSON(http.StatusBadRequest, gin.H{"message": "recipient search is disabled, SEND_LEDGER_HASH_KEY is not set"})
+			return
+		}
+		query = query.Where("recipient_hash = ?", hashRecipient(recipient))
+	}
+
+	if strings.EqualFold(c.Query("format"), "csv") {
+		streamSendLedgerCSV(c, query.Order("created_at asc, id asc"))
+		return
+	}
+
+	page := parsePositiveInt(c.DefaultQuery("page", "1"), 1)
+	limit := parsePositiveInt(c.DefaultQuery("limit", "50"), 50)
+	if limit > 500 {
+		limit = 500
+	}
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "failed to count ledger entries"})
+		return
+	}
+	var entries []models.SendLedgerEntry
+	if err := query.Order("created_at desc, id desc").Limit(limit).Offset((page - 1) * limit).Find(&entries).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "failed to list ledger entries"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"items": entries,
+		"meta":  gin.H{"page": page, "limit": limit, "total": total},
+	})
+}
+
+func streamSendLedgerCSV(c *gin.Context, query *gorm.DB) {
+	rows, err := query.Rows()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "failed to export ledger"})
+		return
+	}
+	defer rows.Close()
+
+	c.Header("Content-Type", "text/csv; charset=utf-8")
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=\"send-ledger-%s.csv\"", time.Now().Format("20060102-150405")))
+	c.Status(http.StatusOK)
+
+	w := csv.NewWriter(c.Writer)
+	_ = w.Write([]string{"created_at", "session_id", "message_type", "recipient_hash", "upstream_message_id", "status", "http_status", "source"})
+	db := database.GetDB()
+	for rows.Next() {
+		var entry models.SendLedgerEntry
+		if err := db.ScanRows(rows, &entry); err != nil {
+			break
+		}
+		_ = w.Write([]string{
+			entry.CreatedAt.Format(time.RFC3339),
+			entry.SessionID,
+			entry.MessageType,
+			entry.RecipientHash,
+			entry.UpstreamMessageID,
+			entry.Status,
+			strconv.Itoa(entry.HTTPStatus),
+			entry.Source,
+		})
+	}
+	w.Flush()
+}
+
+// parseLedgerTime accepts RFC3339 or a plain date in Asia/Jakarta; a plain
+// "to" date is inclusive, so it resolves to the start of the next day.
+func parseLedgerTime(raw string, endOfDay bool) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, raw); err == nil {
+		return t, nil
+	}
+	loc, err := time.LoadLocation(models.DefaultQuotaTimezone)
+	if err != nil {
+		loc = time.UTC
+	}
+	t, err := time.ParseInLocation("2006-01-02", raw, loc)
+	if err != nil {
+		return time.Time{}, errors.New("invalid date")
+	}
+	if endOfDay {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, nil
+}
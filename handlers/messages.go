@@ -0,0 +1,362 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"genfity-wa-support/database"
+	"genfity-wa-support/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+type sendMessageRequest struct {
+	Type    string                 `json:"type" binding:"required"`
+	Payload map[string]interface{} `json:"payload" binding:"required"`
+}
+
+// sendRejection is a local, non-retryable refusal to send (subscription,
+// plan policy, blocklist or quota) as opposed to an upstream transport
+// failure. Code is the envelope error code.
+type sendRejection struct {
+	Status  int
+	Code    string
+	Message string
+}
+
+func (e *sendRejection) Error() string {
+	return e.Message
+}
+
+var messageTypePattern = regexp.MustCompile(`^[a-z0-9_-]+$`)
+
+const (
+	messageQueuePollInterval = 2 * time.Second
+	messageJobBaseBackoff    = 5 * time.Second
+	messageJobMaxBackoff     = 10 * time.Minute
+	// messageJobStaleAfter requeues jobs whose worker died mid-dispatch.
+	messageJobStaleAfter = 10 * time.Minute
+)
+
+// SendSessionMessage sends POST /chat/send/<type> for the session, either
+// synchronously or, with ?async=true, by queueing a job and returning its ID.
+func SendSessionMessage(c *gin.Context) {
+	user := c.MustGet("user").(models.ServiceUser)
+	sessionID := c.Param("session_id")
+
+	var session models.WhatsAppSession
+	if err := database.GetDB().Where("user_id = ? AND session_id = ?", user.ID, sessionID).First(&session).Error; err != nil {
+		respondError(c, http.StatusNotFound, codeSessionNotFound, "session not found")
+		return
+	}
+
+	var req sendMessageRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+	messageType := strings.ToLower(strings.TrimSpace(req.Type))
+	if !messageTypePattern.MatchString(messageType) {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "invalid message type"})
+		return
+	}
+	if recipient, err := normalizePayloadRecipient(req.Payload); err != nil || recipient == "" {
+		if err == nil {
+			err = &recipientError{Reason: "recipient is required"}
+		}
+		respondInvalidRecipient(c, err)
+		return
+	}
+
+	if _, err := getActiveSubscription(user.ID, session.Provider); err != nil {
+		respondError(c, http.StatusForbidden, subscriptionErrorCode(err), err.Error())
+		return
+	}
+
+	if !strings.EqualFold(c.Query("async"), "true") {
+		status, body, err := dispatchSessionMessage(session, messageType, req.Payload)
+		var rejection *sendRejection
+		if errors.As(err, &rejection) {
+			respondError(c, rejection.Status, rejection.Code, rejection.Message)
+			return
+		}
+		recordSendOutcome(session, sendRecord{
+			MessageType: messageType,
+			Recipient:   payloadRecipient(req.Payload),
+			Source:      ledgerSourceAPI,
+			HTTPStatus:  status,
+			Body:        body,
+			Success:     err == nil && status >= 200 && status < 300,
+		})
+		if err != nil {
+			respondProviderError(c, err)
+			return
+		}
+		markUpstreamResponse(c)
+		c.Data(status, "application/json", body)
+		return
+	}
+
+	jobID, err := generateID("job")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "failed to generate job id"})
+		return
+	}
+	job := models.MessageJob{
+		ID:            jobID,
+		UserID:        user.ID,
+		SessionID:     session.SessionID,
+		MessageType:   messageType,
+		Payload:       models.JSONB(req.Payload),
+		Status:        models.MessageJobQueued,
+		MaxAttempts:   getEnvInt("MESSAGE_QUEUE_MAX_ATTEMPTS", 5),
+		NextAttemptAt: time.Now(),
+	}
+	if err := database.GetDB().Create(&job).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "failed to queue message"})
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{"job_id": job.ID, "status": job.Status, "job": job})
+}
+
+func GetMessageJob(c *gin.Context) {
+	user := c.MustGet("user").(models.ServiceUser)
+
+	var job models.MessageJob
+	if err := database.GetDB().Where("id = ? AND user_id = ?", c.Param("job_id"), user.ID).First(&job).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "job not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"job": job})
+}
+
+// dispatchSessionMessage performs one send with the same checks the gateway
+// applies: active subscription, plan policy, the recipient blocklist and an
+// atomic quota reservation that is committed on 2xx and released otherwise.
+// Message stats are left to the caller, which knows whether this attempt is
+// final.
+func dispatchSessionMessage(session models.WhatsAppSession, messageType string, payload map[string]interface{}) (int, []byte, error) {
+	sub, err := getActiveSubscription(session.UserID, session.Provider)
+	if err != nil {
+		return 0, nil, &sendRejection{Status: http.StatusForbidden, Code: subscriptionErrorCode(err), Message: err.Error()}
+	}
+	provider, err := providerFor(session.Provider)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	targetPath := "/chat/send/" + messageType
+	rule, err := evaluatePathPolicy(sub, http.MethodPost, targetPath)
+	if err != nil {
+		return 0, nil, err
+	}
+	if rule != nil && rule.Effect == models.PolicyDeny {
+		message, _ := policyDeniedMessage(rule)
+		return 0, nil, &sendRejection{Status: http.StatusForbidden, Code: codePolicyDenied, Message: message}
+	}
+
+	// A send whose recipient cannot be read is refused, so it cannot
+	// slip past the blocklist.
+	recipient := payloadRecipient(payload)
+	if recipient == "" {
+		return 0, nil, &sendRejection{Status: http.StatusUnprocessableEntity, Code: codeInvalidRecipient, Message: "recipient is required"}
+	}
+	blocked, err := isRecipientBlocked(session.UserID, recipient)
+	var invalid *recipientError
+	if errors.As(err, &invalid) {
+		return 0, nil, &sendRejection{Status: http.StatusUnprocessableEntity, Code: codeInvalidRecipient, Message: invalid.Error()}
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+	if blocked {
+		return 0, nil, &sendRejection{Status: http.StatusForbidden, Code: codeRecipientBlocked, Message: "recipient has opted out"}
+	}
+
+	token, err := sessionToken(session)
+	if err != nil {
+		return 0, nil, err
+	}
+	node, err := resolveSessionNode(session)
+	if err != nil {
+		return 0, nil, err
+	}
+	reservation, err := reserveMessageQuota(sub, session.SessionID)
+	if errors.Is(err, errQuotaExceeded) {
+		return 0, nil, &sendRejection{Status: http.StatusForbidden, Code: codeQuotaExceeded, Message: err.Error()}
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+
+	status, body, err := provider.Send(node, token, messageType, payload)
+	if err != nil || status < 200 || status >= 300 {
+		_ = releaseMessageQuota(reservation)
+		return status, body, err
+	}
+	_ = commitMessageQuota(reservation)
+	return status, body, nil
+}
+
+// StartMessageQueueWorkers starts MESSAGE_QUEUE_WORKERS goroutines draining
+// wa_message_jobs, plus a sweeper that requeues jobs abandoned mid-dispatch
+// and fails the ones with no attempts left.
+func StartMessageQueueWorkers() {
+	workers := getEnvInt("MESSAGE_QUEUE_WORKERS", 4)
+	for i := 0; i < workers; i++ {
+		go func() {
+			for {
+				job, ok := claimMessageJob()
+				if !ok {
+					time.Sleep(messageQueuePollInterval)
+					continue
+				}
+				processMessageJob(job)
+			}
+		}()
+	}
+
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		for now := range ticker.C {
+			cutoff := now.Add(-messageJobStaleAfter)
+			err := database.GetDB().Model(&models.MessageJob{}).
+				Where("status = ? AND locked_at < ? AND attempts < max_attempts", models.MessageJobProcessing, cutoff).
+				Updates(map[string]interface{}{"status": models.MessageJobQueued, "next_attempt_at": now, "locked_at": nil}).Error
+			if err == nil {
+				// The claim already counted the interrupted attempt.
+				err = database.GetDB().Model(&models.MessageJob{}).
+					Where("status = ? AND locked_at < ? AND attempts >= max_attempts", models.MessageJobProcessing, cutoff).
+					Updates(map[string]interface{}{
+						"status":       models.MessageJobFailed,
+						"last_error":   "dispatch interrupted",
+						"completed_at": now,
+						"locked_at":    nil,
+					}).Error
+			}
+			if err != nil {
+				log.Printf("Message queue sweeper error: %v", err)
+			}
+		}
+	}()
+}
+
+// claimMessageJob locks the next due job; SKIP LOCKED lets several workers
+// and replicas poll the same table without handing out a job twice.
+func claimMessageJob() (models.MessageJob, bool) {
+	var job models.MessageJob
+	now := time.Now()
+	res := database.GetDB().Raw(`
+		UPDATE wa_message_jobs
+		SET status = @processing, locked_at = @now, attempts = attempts + 1, updated_at = @now
+		WHERE id = (
+			SELECT id FROM wa_message_jobs
+			WHERE status = @queued AND next_attempt_at <= @now
+			ORDER BY next_attempt_at
+			LIMIT 1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING *`,
+		map[string]interface{}{
+			"processing": models.MessageJobProcessing,
+			"queued":     models.MessageJobQueued,
+			"now":        now,
+		}).Scan(&job)
+	if res.Error != nil {
+		log.Printf("Message queue claim error: %v", res.Error)
+		return job, false
+	}
+	return job, res.RowsAffected > 0 && job.ID != ""
+}
+
+func processMessageJob(job models.MessageJob) {
+	var session models.WhatsAppSession
+	if err := database.GetDB().Where("user_id = ? AND session_id = ?", job.UserID, job.SessionID).First(&session).Error; err != nil {
+		finishMessageJob(job, models.MessageJobFailed, "session not found", 0, nil)
+		return
+	}
+
+	status, body, err := dispatchSessionMessage(session, job.MessageType, job.Payload)
+	rec := sendRecord{
+		MessageType: job.MessageType,
+		Recipient:   payloadRecipient(job.Payload),
+		Source:      ledgerSourceQueue,
+		HTTPStatus:  status,
+		Body:        body,
+	}
+	var rejection *sendRejection
+	switch {
+	case errors.As(err, &rejection):
+		// Refused locally, nothing reached the provider: no stats or ledger row.
+		finishMessageJob(job, models.MessageJobFailed, rejection.Message, 0, nil)
+	case err != nil:
+		retryMessageJob(session, job, rec, err.Error())
+	case status >= 200 && status < 300:
+		rec.Success = true
+		recordSendOutcome(session, rec)
+		finishMessageJob(job, models.MessageJobSucceeded, "", status, body)
+	case status == http.StatusTooManyRequests || status >= 500:
+		retryMessageJob(session, job, rec, fmt.Sprintf("upstream returned %d", status))
+	default:
+		recordSendOutcome(session, rec)
+		finishMessageJob(job, models.MessageJobFailed, fmt.Sprintf("upstream returned %d", status), status, body)
+	}
+}
+
+// retryMessageJob schedules the next attempt with jittered exponential
+// backoff, or fails the job once its attempts are exhausted.
+func retryMessageJob(session models.WhatsAppSession, job models.MessageJob, rec sendRecord, reason string) {
+	if job.Attempts >= job.MaxAttempts {
+		recordSendOutcome(session, rec)
+		finishMessageJob(job, models.MessageJobFailed, reason, rec.HTTPStatus, rec.Body)
+		return
+	}
+
+	err := database.GetDB().Model(&models.MessageJob{}).Where("id = ?", job.ID).Updates(map[string]interface{}{
+		"status":          models.MessageJobQueued,
+		"next_attempt_at": time.Now().Add(retryBackoff(job.Attempts, messageJobBaseBackoff, messageJobMaxBackoff)),
+		"last_error":      reason,
+		"response_status": rec.HTTPStatus,
+		"response_body":   string(rec.Body),
+		"locked_at":       nil,
+	}).Error
+	if err != nil {
+		log.Printf("Message job %s reschedule error: %v", job.ID, err)
+	}
+}
+
+func finishMessageJob(job models.MessageJob, status models.MessageJobStatus, reason string, responseStatus int, body []byte) {
+	now := time.Now()
+	err := database.GetDB().Model(&models.MessageJob{}).Where("id = ?", job.ID).Updates(map[string]interface{}{
+		"status":          status,
+		"last_error":      reason,
+		"response_status": responseStatus,
+		"response_body":   string(body),
+		"completed_at":    now,
+		"locked_at":       nil,
+	}).Error
+	if err != nil {
+		log.Printf("Message job %s finish error: %v", job.ID, err)
+	}
+}
+
+// retryBackoff doubles base per attempt up to max, with up to 20% jitter so
+// retries from many jobs do not arrive in lockstep.
+func retryBackoff(attempt int, base, max time.Duration) time.Duration {
+	delay := base
+	for i := 1; i < attempt && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	return delay + time.Duration(rand.Int63n(int64(delay)/5+1))
+}
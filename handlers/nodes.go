@@ -0,0 +1,331 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"genfity-wa-support/database"
+	"genfity-wa-support/models"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+var errNoProviderNode = errors.New("no provider node available for new sessions")
+
+type providerNodeRequest struct {
+	ID         string  `json:"id"`
+	Provider   string  `json:"provider"`
+	BaseURL    *string `json:"base_url"`
+	AdminToken *string `json:"admin_token"`
+	Capacity   *int    `json:"capacity"`
+	Status     *string `json:"status"`
+}
+
+type providerNodeView struct {
+	models.ProviderNode
+	SessionCount int64           `json:"session_count"`
+	Breaker      breakerSnapshot `json:"breaker"`
+}
+
+// sessionNodeID is the ID of the node hosting the session; rows from before
+// node placement have none and live on the default node.
+func sessionNodeID(session models.WhatsAppSession) string {
+	if session.NodeID == "" {
+		return models.DefaultNodeID
+	}
+	return session.NodeID
+}
+
+// resolveSessionNode returns the node hosting the session. Sessions without a
+// node predate placement and live on the default node; if the registry has
+// no default node, WA_SERVER_URL is used directly. A session pinned to a node
+// that is no longer registered is an error: its token must not be sent to
+// whichever node happens to be the fallback.
+func resolveSessionNode(session models.WhatsAppSession) (models.ProviderNode, error) {
+	var node models.ProviderNode
+	if session.NodeID == "" {
+		if err := database.GetDB().Where("id = ?", models.DefaultNodeID).First(&node).Error; err == nil {
+			return node, nil
+		}
+		return fallbackProviderNode(), nil
+	}
+	if err := database.GetDB().Where("id = ?", session.NodeID).First(&node).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return node, fmt.Errorf("provider node %s of session %s is not registered", session.NodeID, session.SessionID)
+		}
+		return node, err
+	}
+	return node, nil
+}
+
+// sessionNodeOrAbort is resolveSessionNode for handlers; it answers 503 when
+// the node cannot be resolved.
+func sessionNodeOrAbort(c *gin.Context, session models.WhatsAppSession) (models.ProviderNode, bool) {
+	node, err := resolveSessionNode(session)
+	if err != nil {
+		respondError(c, http.StatusServiceUnavailable, codeNoProviderNode, err.Error())
+		return node, false
+	}
+	return node, true
+}
+
+func fallbackProviderNode() models.ProviderNode {
+	return models.ProviderNode{
+		ID:       models.DefaultNodeID,
+		Provider: defaultProviderName,
+		BaseURL:  os.Getenv("WA_SERVER_URL"),
+		Status:   models.NodeHealthy,
+	}
+}
+
+// nodeAdminToken falls back to WA_ADMIN_TOKEN for nodes without their own.
+func nodeAdminToken(node models.ProviderNode) string {
+	if node.AdminToken != "" {
+		return node.AdminToken
+	}
+	return os.Getenv("WA_ADMIN_TOKEN")
+}
+
+// placeSessionNode picks the healthy node of the provider with the lowest
+// load that still has room. Capacity is a soft limit: concurrent creates may
+// overshoot it by a few sessions.
+func placeSessionNode(provider string) (models.ProviderNode, error) {
+	db := database.GetDB()
+	var nodes []models.ProviderNode
+	if err := db.Where("provider = ? AND status = ?", provider, models.NodeHealthy).Order("id asc").Find(&nodes).Error; err != nil {
+		return models.ProviderNode{}, err
+	}
+	if len(nodes) == 0 {
+		return models.ProviderNode{}, errNoProviderNode
+	}
+
+	counts, err := sessionCountsByNode()
+	if err != nil {
+		return models.ProviderNode{}, err
+	}
+
+	var best *models.ProviderNode
+	bestLoad := 0.0
+	for i := range nodes {
+		count := counts[nodes[i].ID]
+		if nodes[i].Capacity > 0 && count >= int64(nodes[i].Capacity) {
+			continue
+		}
+		load := float64(count)
+		if nodes[i].Capacity > 0 {
+			load = float64(count) / float64(nodes[i].Capacity)
+		}
+		if best == nil || load < bestLoad {
+			best = &nodes[i]
+			bestLoad = load
+		}
+	}
+	if best == nil {
+		return models.ProviderNode{}, errNoProviderNode
+	}
+	return *best, nil
+}
+
+func sessionCountsByNode() (map[string]int64, error) {
+	var rows []struct {
+		NodeID string
+		Total  int64
+	}
+	err := database.GetDB().Raw(`
+		SELECT COALESCE(NULLIF(node_id, ''), @default) AS node_id, COUNT(*) AS total
+		FROM wa_sessions
+		GROUP BY 1
+	`, map[string]interface{}{"default": models.DefaultNodeID}).Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+	counts := make(map[string]int64, len(rows))
+	for _, row := range rows {
+		counts[row.NodeID] = row.Total
+	}
+	return counts, nil
+}
+
+// StartProviderHealthChecks probes every node's /health. A node is marked dead
+// after PROVIDER_HEALTH_FAIL_THRESHOLD consecutive failures and healthy again
+// on the next success; draining nodes keep their status.
+func StartProviderHealthChecks() {
+	interval := time.Duration(getEnvInt("PROVIDER_HEALTH_INTERVAL_SECONDS", 30)) * time.Second
+	threshold := getEnvInt("PROVIDER_HEALTH_FAIL_THRESHOLD", 3)
+	client := &http.Client{Timeout: 5 * time.Second}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			var nodes []models.ProviderNode
+			if err := database.GetDB().Find(&nodes).Error; err != nil {
+				log.Printf("Provider health check error: %v", err)
+				continue
+			}
+			for _, node := range nodes {
+				checkProviderNode(client, node, threshold)
+			}
+		}
+	}()
+}
+
+func checkProviderNode(client *http.Client, node models.ProviderNode, threshold int) {
+	now := time.Now()
+	probeErr := ""
+	resp, err := client.Get(node.URL("/health"))
+	if err != nil {
+		probeErr = err.Error()
+	} else {
+		resp.Body.Close()
+		if resp.StatusCode >= 500 {
+			probeErr = fmt.Sprintf("health returned %d", resp.StatusCode)
+		}
+	}
+
+	updates := map[string]interface{}{"last_checked_at": now, "last_error": probeErr}
+	status := node.Status
+	if probeErr == "" {
+		updates["fail_count"] = 0
+		if node.Status == models.NodeDead {
+			status = models.NodeHealthy
+		}
+	} else {
+		updates["fail_count"] = node.FailCount + 1
+		if node.Status == models.NodeHealthy && node.FailCount+1 >= threshold {
+			status = models.NodeDead
+		}
+	}
+	if status != node.Status {
+		updates["status"] = status
+		log.Printf("Provider node %s changed %s -> %s (%s)", node.ID, node.Status, status, probeErr)
+	}
+
+	if err := database.GetDB().Model(&models.ProviderNode{}).Where("id = ?", node.ID).Updates(updates).Error; err != nil {
+		log.Printf("Provider node %s health update error: %v", node.ID, err)
+	}
+}
+
+func InternalListProviderNodes(c *gin.Context) {
+	if _, scoped := getInternalSourceScope(c); scoped {
+		c.JSON(http.StatusForbidden, gin.H{"message": "provider nodes require a global internal key"})
+		return
+	}
+
+	var nodes []models.ProviderNode
+	if err := database.GetDB().Order("provider asc, id asc").Find(&nodes).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "failed to list nodes"})
+		return
+	}
+	counts, _ := sessionCountsByNode()
+
+	items := make([]providerNodeView, 0, len(nodes))
+	for _, node := range nodes {
+		items = append(items, providerNodeView{
+			ProviderNode: node,
+			SessionCount: counts[node.ID],
+			Breaker:      breakerFor(node.ID).snapshot(time.Now()),
+		})
+	}
+	c.JSON(http.StatusOK, gin.H{"nodes": items})
+}
+
+func InternalCreateProviderNode(c *gin.Context) {
+	if _, scoped := getInternalSourceScope(c); scoped {
+		c.JSON(http.StatusForbidden, gin.H{"message": "provider nodes require a global internal key"})
+		return
+	}
+
+	var req providerNodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+	if strings.TrimSpace(req.ID) == "" || req.BaseURL == nil || strings.TrimSpace(*req.BaseURL) == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "id and base_url are required"})
+		return
+	}
+
+	node := models.ProviderNode{
+		ID:       strings.TrimSpace(req.ID),
+		Provider: strings.TrimSpace(req.Provider),
+		BaseURL:  strings.TrimSpace(*req.BaseURL),
+		Status:   models.NodeHealthy,
+	}
+	if node.Provider == "" {
+		node.Provider = defaultProviderName
+	}
+	if _, err := providerFor(node.Provider); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+	if req.AdminToken != nil {
+		node.AdminToken = *req.AdminToken
+	}
+	if req.Capacity != nil {
+		node.Capacity = *req.Capacity
+	}
+	if err := database.GetDB().Create(&node).Error; err != nil {
+		c.JSON(http.StatusConflict, gin.H{"message": "failed to create node"})
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"node": node})
+}
+
+func InternalUpdateProviderNode(c *gin.Context) {
+	if _, scoped := getInternalSourceScope(c); scoped {
+		c.JSON(http.StatusForbidden, gin.H{"message": "provider nodes require a global internal key"})
+		return
+	}
+
+	var req providerNodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+
+	db := database.GetDB()
+	var node models.ProviderNode
+	if err := db.Where("id = ?", c.Param("node_id")).First(&node).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "node not found"})
+		return
+	}
+
+	// Only the fields in the request: health and breaker columns are written
+	// concurrently by the health checker.
+	updates := map[string]interface{}{"updated_at": time.Now()}
+	if req.BaseURL != nil {
+		updates["base_url"] = strings.TrimSpace(*req.BaseURL)
+	}
+	if req.AdminToken != nil {
+		updates["admin_token"] = *req.AdminToken
+	}
+	if req.Capacity != nil {
+		updates["capacity"] = *req.Capacity
+	}
+	if req.Status != nil {
+		status := models.ProviderNodeStatus(*req.Status)
+		if status != models.NodeHealthy && status != models.NodeDraining && status != models.NodeDead {
+			c.JSON(http.StatusBadRequest, gin.H{"message": "status must be healthy, draining or dead"})
+			return
+		}
+		updates["status"] = status
+		updates["fail_count"] = 0
+	}
+	if err := db.Model(&models.ProviderNode{}).Where("id = ?", node.ID).Updates(updates).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "failed to update node"})
+		return
+	}
+	if err := db.Where("id = ?", node.ID).First(&node).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "failed to load node"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"node": node})
+}
@@ -0,0 +1,277 @@
+package handlers
+
+import (
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"genfity-wa-support/database"
+	"genfity-wa-support/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+type pathPolicyRequest struct {
+	Plan        string `json:"plan"`
+	Effect      string `json:"effect" binding:"required"`
+	Method      string `json:"method"`
+	PathGlob    string `json:"path_glob" binding:"required"`
+	Entitlement string `json:"entitlement"`
+	Priority    *int   `json:"priority"`
+}
+
+// evaluatePathPolicy returns the first rule matching method and path, looking
+// at the subscription's own rules before its plan's rules (lower priority
+// first). Without a matching rule the call is allowed.
+func evaluatePathPolicy(sub models.UserSubscription, method, targetPath string) (*models.PathPolicyRule, error) {
+	plan := sub.Plan
+	if plan == "" {
+		plan = defaultPlan
+	}
+
+	var rules []models.PathPolicyRule
+	err := database.GetDB().
+		Where("subscription_id = ? OR (subscription_id IS NULL AND plan = ?)", sub.ID, plan).
+		Order("subscription_id IS NULL, priority asc, id asc").
+		Find(&rules).Error
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range rules {
+		if policyMethodMatches(rules[i].Method, method) && matchPathGlob(rules[i].PathGlob, targetPath) {
+			return &rules[i], nil
+		}
+	}
+	return nil, nil
+}
+
+func policyMethodMatches(ruleMethods, method string) bool {
+	if ruleMethods == "" || ruleMethods == "*" {
+		return true
+	}
+	for _, m := range strings.Split(ruleMethods, ",") {
+		if strings.EqualFold(strings.TrimSpace(m), method) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchPathGlob matches slash-separated segments: "*" and other path.Match
+// patterns stay within one segment, "**" spans any number of segments.
+func matchPathGlob(pattern, target string) bool {
+	return matchGlobSegments(splitPath(pattern), splitPath(target))
+}
+
+func splitPath(p string) []string {
+	p = strings.Trim(p, "/")
+	if p == "" {
+		return nil
+	}
+	return strings.Split(p, "/")
+}
+
+func matchGlobSegments(pattern, parts []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			if len(pattern) == 1 {
+				return true
+			}
+			for i := 0; i <= len(parts); i++ {
+				if matchGlobSegments(pattern[1:], parts[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(parts) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], parts[0]); !ok {
+			return false
+		}
+		pattern, parts = pattern[1:], parts[1:]
+	}
+	return len(parts) == 0
+}
+
+func policyDeniedMessage(rule *models.PathPolicyRule) (string, string) {
+	entitlement := rule.Entitlement
+	if entitlement == "" {
+		entitlement = rule.PathGlob
+	}
+	return "your plan does not include the '" + entitlement + "' entitlement", entitlement
+}
+
+func buildPathPolicyRule(req pathPolicyRequest) (models.PathPolicyRule, bool) {
+	effect := models.PolicyEffect(strings.ToLower(strings.TrimSpace(req.Effect)))
+	if effect != models.PolicyAllow && effect != models.PolicyDeny {
+		return models.PathPolicyRule{}, false
+	}
+	rule := models.PathPolicyRule{
+		Plan:        strings.TrimSpace(req.Plan),
+		Effect:      effect,
+		Method:      strings.ToUpper(strings.TrimSpace(req.Method)),
+		PathGlob:    "/" + strings.Trim(strings.TrimSpace(req.PathGlob), "/"),
+		Entitlement: strings.TrimSpace(req.Entitlement),
+		Priority:    100,
+	}
+	if rule.Method == "" {
+		rule.Method = "*"
+	}
+	if req.Priority != nil {
+		rule.Priority = *req.Priority
+	}
+	return rule, true
+}
+
+func InternalListPlanPolicies(c *gin.Context) {
+	if _, scoped := getInternalSourceScope(c); scoped {
+		c.JSON(http.StatusForbidden, gin.H{"message": "plan policies require a global internal key"})
+		return
+	}
+
+	query := database.GetDB().Where("subscription_id IS NULL")
+	if plan := strings.TrimSpace(c.Query("plan")); plan != "" {
+		query = query.Where("plan = ?", plan)
+	}
+	var rules []models.PathPolicyRule
+	if err := query.Order("plan asc, priority asc, id asc").Find(&rules).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "failed to list policies"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"policies": rules})
+}
+
+func InternalCreatePlanPolicy(c *gin.Context) {
+	if _, scoped := getInternalSourceScope(c); scoped {
+		c.JSON(http.StatusForbidden, gin.H{"message": "plan policies require a global internal key"})
+		return
+	}
+
+	var req pathPolicyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+	rule, ok := buildPathPolicyRule(req)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "effect must be allow or deny"})
+		return
+	}
+	if rule.Plan == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "plan is required"})
+		return
+	}
+	if err := database.GetDB().Create(&rule).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "failed to create policy"})
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"policy": rule})
+}
+
+func InternalDeletePlanPolicy(c *gin.Context) {
+	if _, scoped := getInternalSourceScope(c); scoped {
+		c.JSON(http.StatusForbidden, gin.H{"message": "plan policies require a global internal key"})
+		return
+	}
+
+	id, err := strconv.ParseUint(c.Param("policy_id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "invalid policy_id"})
+		return
+	}
+	res := database.GetDB().Where("id = ? AND subscription_id IS NULL", id).Delete(&models.PathPolicyRule{})
+	if res.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "failed to delete policy"})
+		return
+	}
+	if res.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"message": "policy not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "deleted"})
+}
+
+func InternalListUserPolicies(c *gin.Context) {
+	sub, ok := internalUserSubscription(c)
+	if !ok {
+		return
+	}
+	var rules []models.PathPolicyRule
+	if err := database.GetDB().Where("subscription_id = ?", sub.ID).Order("priority asc, id asc").Find(&rules).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "failed to list policies"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"subscription_id": sub.ID, "plan": sub.Plan, "policies": rules})
+}
+
+func InternalCreateUserPolicy(c *gin.Context) {
+	sub, ok := internalUserSubscription(c)
+	if !ok {
+		return
+	}
+
+	var req pathPolicyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+	rule, valid := buildPathPolicyRule(req)
+	if !valid {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "effect must be allow or deny"})
+		return
+	}
+	rule.Plan = ""
+	rule.SubscriptionID = &sub.ID
+	if err := database.GetDB().Create(&rule).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "failed to create policy"})
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"policy": rule})
+}
+
+func InternalDeleteUserPolicy(c *gin.Context) {
+	sub, ok := internalUserSubscription(c)
+	if !ok {
+		return
+	}
+
+	id, err := strconv.ParseUint(c.Param("policy_id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "invalid policy_id"})
+		return
+	}
+	res := database.GetDB().Where("id = ? AND subscription_id = ?", id, sub.ID).Delete(&models.PathPolicyRule{})
+	if res.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "failed to delete policy"})
+		return
+	}
+	if res.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"message": "policy not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "deleted"})
+}
+
+// internalUserSubscription resolves the :user_id subscription for the
+// ?provider= (default genfity-wa), enforcing the internal key's source scope.
+func internalUserSubscription(c *gin.Context) (models.UserSubscription, bool) {
+	userID := c.Param("user_id")
+	if source, scoped := getInternalSourceScope(c); scoped {
+		if !internalCanAccessUser(userID, source) {
+			c.JSON(http.StatusForbidden, gin.H{"message": "user does not belong to this source"})
+			return models.UserSubscription{}, false
+		}
+	}
+
+	provider := strings.TrimSpace(c.DefaultQuery("provider", defaultProviderName))
+	var sub models.UserSubscription
+	if err := database.GetDB().Where("user_id = ? AND provider = ?", userID, provider).Order("updated_at desc").First(&sub).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "subscription not found"})
+		return sub, false
+	}
+	return sub, true
+}
@@ -0,0 +1,51 @@
+package handlers
+
+import "testing"
+
+func TestMatchPathGlob(t *testing.T) {
+	tests := []struct {
+		pattern, target string
+		want            bool
+	}{
+		{"/chat/send/text", "/chat/send/text", true},
+		{"/chat/send/text", "/chat/send/image", false},
+		{"/chat/send/*", "/chat/send/image", true},
+		{"/chat/send/*", "/chat/send", false},
+		{"/chat/send/*", "/chat/send/image/extra", false},
+		{"/chat/*/text", "/chat/send/text", true},
+		{"/admin/**", "/admin", true},
+		{"/admin/**", "/admin/users/1", true},
+		{"/admin/**", "/administrator", false},
+		{"/**/presence", "/chat/presence", true},
+		{"/**/presence", "/presence", true},
+		{"/**/presence", "/chat/presence/x", false},
+		{"/**", "/", true},
+		{"/chat/send/{text,image}", "/chat/send/text", false},
+		{"/chat/send/[it]*", "/chat/send/image", true},
+		{"chat/send/text/", "/chat/send/text", true},
+	}
+	for _, tt := range tests {
+		if got := matchPathGlob(tt.pattern, tt.target); got != tt.want {
+			t.Errorf("matchPathGlob(%q, %q) = %v, want %v", tt.pattern, tt.target, got, tt.want)
+		}
+	}
+}
+
+func TestPolicyMethodMatches(t *testing.T) {
+	tests := []struct {
+		rule, method string
+		want         bool
+	}{
+		{"", "POST", true},
+		{"*", "DELETE", true},
+		{"POST", "POST", true},
+		{"post", "POST", true},
+		{"GET, POST", "POST", true},
+		{"GET,PUT", "POST", false},
+	}
+	for _, tt := range tests {
+		if got := policyMethodMatches(tt.rule, tt.method); got != tt.want {
+			t.Errorf("policyMethodMatches(%q, %q) = %v, want %v", tt.rule, tt.method, got, tt.want)
+		}
+	}
+}
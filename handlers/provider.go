@@ -0,0 +1,130 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"genfity-wa-support/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+const defaultProviderName = "genfity-wa"
+
+// Provider is the backend-specific half of session management. Handlers pick
+// the adapter from the subscription or session provider, so adding a backend
+// means registering another adapter in providers.
+type Provider interface {
+	CreateSession(node models.ProviderNode, spec providerSessionSpec) (providerSession, error)
+	UpdateSession(node models.ProviderNode, sessionID string, req updateSessionRequest) error
+	DeleteSession(node models.ProviderNode, sessionID string) error
+	// SetToken replaces the token the session authenticates with.
+	SetToken(node models.ProviderNode, sessionID string, token string) error
+	// ListSessions returns every session the node knows about, for the
+	// reconciler.
+	ListSessions(node models.ProviderNode) ([]providerSession, error)
+	Connect(node models.ProviderNode, token string, events []string) error
+	SessionStatus(node models.ProviderNode, token string) (providerSession, error)
+	// QRCode returns the current login QR as a data:image/png;base64 URL,
+	// or "" while the provider has not produced one yet.
+	QRCode(node models.ProviderNode, token string) (string, error)
+	// PairPhone requests a pairing code for logging in by phone number.
+	PairPhone(node models.ProviderNode, token string, phone string) (string, error)
+	FetchContacts(node models.ProviderNode, token string) ([]providerContact, error)
+	// Send returns the raw upstream status and body; a non-nil error means
+	// the request never completed.
+	Send(node models.ProviderNode, token string, messageType string, payload map[string]interface{}) (int, []byte, error)
+	SetWebhook(node models.ProviderNode, token string, webhookURL string) error
+}
+
+type providerSessionSpec struct {
+	Name          string
+	Token         string
+	WebhookURL    string
+	Events        string
+	ExpirationSec int
+	History       int
+}
+
+// providerSession is a session as the provider reports it. CreateSession
+// only fills the identifying fields.
+type providerSession struct {
+	SessionID  string
+	Name       string
+	Token      string
+	WebhookURL string
+	JID        string
+	Connected  bool
+	LoggedIn   bool
+}
+
+type providerContact struct {
+	JID    string
+	Fields map[string]interface{}
+}
+
+// providerHTTPError carries a non-2xx upstream response so handlers can pass
+// it through unchanged.
+type providerHTTPError struct {
+	Status int
+	Body   []byte
+}
+
+func (e *providerHTTPError) Error() string {
+	return fmt.Sprintf("provider returned status %d", e.Status)
+}
+
+var providers = map[string]Provider{
+	defaultProviderName: genfityWAProvider{},
+}
+
+func providerFor(name string) (Provider, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		name = defaultProviderName
+	}
+	provider, ok := providers[name]
+	if !ok {
+		return nil, fmt.Errorf("unsupported provider %q", name)
+	}
+	return provider, nil
+}
+
+// requestProvider is the provider a /v1 request without a session targets.
+func requestProvider(c *gin.Context) string {
+	if provider := strings.TrimSpace(c.Query("provider")); provider != "" {
+		return provider
+	}
+	return defaultProviderName
+}
+
+// ProviderParamMiddleware rejects an unknown ?provider= up front, so no
+// handler falls back to another backend's subscription for it.
+func ProviderParamMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if provider := strings.TrimSpace(c.Query("provider")); provider != "" {
+			if _, err := providerFor(provider); err != nil {
+				c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+				return
+			}
+		}
+		c.Next()
+	}
+}
+
+func respondProviderError(c *gin.Context, err error) {
+	var httpErr *providerHTTPError
+	if errors.As(err, &httpErr) {
+		markUpstreamResponse(c)
+		c.Data(httpErr.Status, "application/json", httpErr.Body)
+		return
+	}
+	var openErr *circuitOpenError
+	if errors.As(err, &openErr) {
+		respondCircuitOpen(c, openErr)
+		return
+	}
+	c.JSON(http.StatusBadGateway, gin.H{"message": err.Error()})
+}
@@ -0,0 +1,267 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"genfity-wa-support/models"
+)
+
+// genfityWAProvider talks to genfity-wa: sessions are admin users managed
+// with the node admin token, everything else authenticates with the session
+// token header.
+type genfityWAProvider struct{}
+
+func (genfityWAProvider) CreateSession(node models.ProviderNode, spec providerSessionSpec) (providerSession, error) {
+	status, body, err := proxyAdminToWAServer(node, http.MethodPost, "/admin/users", map[string]interface{}{
+		"name":       spec.Name,
+		"token":      spec.Token,
+		"webhook":    spec.WebhookURL,
+		"expiration": spec.ExpirationSec,
+		"events":     spec.Events,
+		"history":    spec.History,
+	})
+	if err := genfityWAResult(status, body, err); err != nil {
+		return providerSession{}, err
+	}
+
+	id, token, webhook := parseWAAdminUserResponse(body)
+	if id == "" {
+		return providerSession{}, errors.New("invalid wa response for session provisioning")
+	}
+	if token == "" {
+		token = spec.Token
+	}
+	if webhook == "" {
+		webhook = spec.WebhookURL
+	}
+	return providerSession{SessionID: id, Token: token, WebhookURL: webhook}, nil
+}
+
+func (genfityWAProvider) UpdateSession(node models.ProviderNode, sessionID string, req updateSessionRequest) error {
+	payload := map[string]interface{}{}
+	if req.SessionName != nil {
+		payload["name"] = *req.SessionName
+	}
+	if req.WebhookURL != nil {
+		payload["webhook"] = *req.WebhookURL
+	}
+	if req.Events != nil {
+		payload["events"] = *req.Events
+	}
+	if req.ExpirationSec != nil {
+		payload["expiration"] = *req.ExpirationSec
+	}
+	if req.History != nil {
+		payload["history"] = *req.History
+	}
+	if len(payload) == 0 {
+		return nil
+	}
+	status, body, err := proxyAdminToWAServer(node, http.MethodPut, "/admin/users/"+sessionID, payload)
+	return genfityWAResult(status, body, err)
+}
+
+func (genfityWAProvider) DeleteSession(node models.ProviderNode, sessionID string) error {
+	status, body, err := proxyAdminToWAServer(node, http.MethodDelete, "/admin/users/"+sessionID+"/full", nil)
+	return genfityWAResult(status, body, err)
+}
+
+func (genfityWAProvider) SetToken(node models.ProviderNode, sessionID string, token string) error {
+	status, body, err := proxyAdminToWAServer(node, http.MethodPut, "/admin/users/"+sessionID, map[string]interface{}{"token": token})
+	return genfityWAResult(status, body, err)
+}
+
+func (genfityWAProvider) ListSessions(node models.ProviderNode) ([]providerSession, error) {
+	status, body, err := proxyAdminToWAServer(node, http.MethodGet, "/admin/users", nil)
+	if err := genfityWAResult(status, body, err); err != nil {
+		return nil, err
+	}
+	return parseWAAdminUsers(body)
+}
+
+func (genfityWAProvider) Connect(node models.ProviderNode, token string, events []string) error {
+	status, body, err := proxyWithToken(node, http.MethodPost, "/session/connect", token, map[string]interface{}{"subscribe": events})
+	return genfityWAResult(status, body, err)
+}
+
+func (genfityWAProvider) SessionStatus(node models.ProviderNode, token string) (providerSession, error) {
+	status, body, err := proxyWithToken(node, http.MethodGet, "/session/status", token, nil)
+	if err := genfityWAResult(status, body, err); err != nil {
+		return providerSession{}, err
+	}
+	return parseWASessionStatus(body)
+}
+
+func (genfityWAProvider) QRCode(node models.ProviderNode, token string) (string, error) {
+	status, body, err := proxyWithToken(node, http.MethodGet, "/session/qr", token, nil)
+	if err := genfityWAResult(status, body, err); err != nil {
+		return "", err
+	}
+	var payload struct {
+		Data struct {
+			QRCode string `json:"QRCode"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return "", errors.New("invalid qr response")
+	}
+	return payload.Data.QRCode, nil
+}
+
+func (genfityWAProvider) PairPhone(node models.ProviderNode, token string, phone string) (string, error) {
+	status, body, err := proxyWithToken(node, http.MethodPost, "/session/pairphone", token, map[string]interface{}{"Phone": phone})
+	if err := genfityWAResult(status, body, err); err != nil {
+		return "", err
+	}
+	var payload struct {
+		Data struct {
+			LinkingCode string `json:"LinkingCode"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil || payload.Data.LinkingCode == "" {
+		return "", errors.New("invalid pairphone response")
+	}
+	return payload.Data.LinkingCode, nil
+}
+
+func (genfityWAProvider) FetchContacts(node models.ProviderNode, token string) ([]providerContact, error) {
+	status, body, err := proxyWithToken(node, http.MethodGet, "/user/contacts", token, nil)
+	if err := genfityWAResult(status, body, err); err != nil {
+		return nil, err
+	}
+	return parseWAContacts(body)
+}
+
+func (genfityWAProvider) Send(node models.ProviderNode, token string, messageType string, payload map[string]interface{}) (int, []byte, error) {
+	return proxyWithToken(node, http.MethodPost, "/chat/send/"+messageType, token, payload)
+}
+
+func (genfityWAProvider) SetWebhook(node models.ProviderNode, token string, webhookURL string) error {
+	status, body, err := proxyWithToken(node, http.MethodPut, "/webhook", token, map[string]interface{}{"webhookURL": webhookURL})
+	return genfityWAResult(status, body, err)
+}
+
+func genfityWAResult(status int, body []byte, err error) error {
+	if err != nil {
+		return err
+	}
+	if status < 200 || status >= 300 {
+		return &providerHTTPError{Status: status, Body: body}
+	}
+	return nil
+}
+
+func parseWAAdminUserResponse(body []byte) (id string, token string, webhook string) {
+	var payload map[string]interface{}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return "", "", ""
+	}
+	data, _ := payload["data"].(map[string]interface{})
+	if data == nil {
+		data = payload
+	}
+	id, _ = data["id"].(string)
+	token, _ = data["token"].(string)
+	webhook, _ = data["webhook"].(string)
+	return
+}
+
+// parseWAAdminUsers reads the user list of GET /admin/users, either under
+// data or as a bare array.
+func parseWAAdminUsers(body []byte) ([]providerSession, error) {
+	var list []map[string]interface{}
+	if err := json.Unmarshal(body, &list); err != nil {
+		var payload struct {
+			Data []map[string]interface{} `json:"data"`
+		}
+		if err := json.Unmarshal(body, &payload); err != nil {
+			return nil, errors.New("invalid admin users response")
+		}
+		list = payload.Data
+	}
+
+	sessions := make([]providerSession, 0, len(list))
+	for _, user := range list {
+		session := providerSession{}
+		session.SessionID, _ = user["id"].(string)
+		session.Name, _ = user["name"].(string)
+		session.Token, _ = user["token"].(string)
+		session.WebhookURL, _ = user["webhook"].(string)
+		session.JID, _ = user["jid"].(string)
+		session.Connected, _ = user["connected"].(bool)
+		session.LoggedIn, _ = user["loggedIn"].(bool)
+		if session.SessionID != "" {
+			sessions = append(sessions, session)
+		}
+	}
+	return sessions, nil
+}
+
+// parseWASessionStatus reads GET /session/status, which reports
+// Connected/LoggedIn with either capitalization depending on the version.
+func parseWASessionStatus(body []byte) (providerSession, error) {
+	var payload map[string]interface{}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return providerSession{}, errors.New("invalid session status response")
+	}
+	data, _ := payload["data"].(map[string]interface{})
+	if data == nil {
+		data = payload
+	}
+	field := func(keys ...string) interface{} {
+		for _, key := range keys {
+			if value, ok := data[key]; ok {
+				return value
+			}
+		}
+		return nil
+	}
+
+	session := providerSession{}
+	session.SessionID, _ = field("id", "ID").(string)
+	session.JID, _ = field("jid", "JID").(string)
+	session.Connected, _ = field("connected", "Connected").(bool)
+	session.LoggedIn, _ = field("loggedIn", "LoggedIn").(bool)
+	return session, nil
+}
+
+// parseWAContacts accepts genfity-wa's map[jid]contactInfo shape as well as
+// an array under data/contacts.
+func parseWAContacts(raw []byte) ([]providerContact, error) {
+	var payload map[string]interface{}
+	if err := json.Unmarshal(raw, &payload); err != nil {
+		return nil, errors.New("invalid contacts response")
+	}
+
+	var contacts []providerContact
+	for key, value := range payload {
+		entry, ok := value.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		contacts = append(contacts, providerContact{JID: key, Fields: entry})
+	}
+	if len(contacts) > 0 {
+		return contacts, nil
+	}
+
+	listAny := payload["data"]
+	if listAny == nil {
+		listAny = payload["contacts"]
+	}
+	list, _ := listAny.([]interface{})
+	for _, item := range list {
+		entry, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		jid, _ := entry["jid"].(string)
+		if jid == "" {
+			jid, _ = entry["id"].(string)
+		}
+		contacts = append(contacts, providerContact{JID: jid, Fields: entry})
+	}
+	return contacts, nil
+}
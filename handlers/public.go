@@ -2,12 +2,14 @@ package handlers
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"log"
 	"net/http"
-	"os"
+	"path"
 	"strings"
 	"time"
 
@@ -20,6 +22,7 @@ import (
 
 type createSessionRequest struct {
 	SessionName   string `json:"session_name" binding:"required"`
+	Provider      string `json:"provider"`
 	WebhookURL    string `json:"webhook_url"`
 	Events        string `json:"events"`
 	ExpirationSec int    `json:"expiration_sec"`
@@ -37,12 +40,12 @@ type updateSessionRequest struct {
 
 func GetCurrentUser(c *gin.Context) {
 	user := c.MustGet("user").(models.ServiceUser)
-	sub, err := getActiveSubscription(user.ID)
+	sub, err := getActiveSubscription(user.ID, requestProvider(c))
 	if err != nil {
-		c.JSON(http.StatusForbidden, gin.H{"message": err.Error()})
+		respondError(c, http.StatusForbidden, subscriptionErrorCode(err), err.Error())
 		return
 	}
-	c.JSON(http.StatusOK, gin.H{"user": user, "subscription": sub})
+	c.JSON(http.StatusOK, gin.H{"user": user, "subscription": sub, "usage": buildQuotaUsage(sub)})
 }
 
 func ListSessions(c *gin.Context) {
@@ -52,32 +55,50 @@ func ListSessions(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"message": "failed to list sessions"})
 		return
 	}
+	maskSessionTokens(sessions)
 	c.JSON(http.StatusOK, gin.H{"sessions": sessions})
 }
 
 func CreateSession(c *gin.Context) {
 	user := c.MustGet("user").(models.ServiceUser)
-	sub, err := getActiveSubscription(user.ID)
-	if err != nil {
-		c.JSON(http.StatusForbidden, gin.H{"message": err.Error()})
-		return
-	}
 
 	var req createSessionRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
 		return
 	}
+	if err := validateSessionWebhookURL(req.WebhookURL); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+	if req.Provider == "" {
+		req.Provider = requestProvider(c)
+	}
+	provider, err := providerFor(req.Provider)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+	sub, err := getActiveSubscription(user.ID, req.Provider)
+	if err != nil {
+		respondError(c, http.StatusForbidden, subscriptionErrorCode(err), err.Error())
+		return
+	}
 	if req.Events == "" {
 		req.Events = "Message,Connected,Disconnected,QR"
 	}
 
+	// Every session still held at the provider counts, whatever its
+	// connection state; only ones the reconciler found gone are free.
 	var current int64
-	database.GetDB().Model(&models.WhatsAppSession{}).
-		Where("user_id = ? AND status IN ?", user.ID, []string{"active", "connected", "qr_waiting"}).
-		Count(&current)
+	if err := database.GetDB().Model(&models.WhatsAppSession{}).
+		Where("user_id = ? AND status <> ?", user.ID, sessionStatusMissing).
+		Count(&current).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "failed to count sessions"})
+		return
+	}
 	if int(current) >= sub.MaxSessions {
-		c.JSON(http.StatusForbidden, gin.H{"message": "session limit exceeded"})
+		respondError(c, http.StatusForbidden, codeSessionLimitExceeded, "session limit exceeded")
 		return
 	}
 
@@ -87,57 +108,81 @@ func CreateSession(c *gin.Context) {
 		return
 	}
 
-	adminPayload := map[string]interface{}{
-		"name":       req.SessionName,
-		"token":      sessionTokenRaw,
-		"webhook":    req.WebhookURL,
-		"expiration": req.ExpirationSec,
-		"events":     req.Events,
-		"history":    req.History,
-	}
-	status, body, err := proxyAdminToWAServer(http.MethodPost, "/admin/users", adminPayload)
+	node, err := placeSessionNode(sub.Provider)
 	if err != nil {
-		c.JSON(http.StatusBadGateway, gin.H{"message": err.Error()})
-		return
-	}
-	if status < 200 || status >= 300 {
-		c.Data(status, "application/json", body)
+		respondError(c, http.StatusServiceUnavailable, codeNoProviderNode, err.Error())
 		return
 	}
 
-	waUserID, waToken, waWebhook := parseWAAdminUserResponse(body)
-	if waUserID == "" {
-		c.JSON(http.StatusBadGateway, gin.H{"message": "invalid wa response for session provisioning"})
-		return
+	// With the relay on, the ingest URL needs the provider's session ID, so it
+	// is registered right after creation instead.
+	providerWebhook := req.WebhookURL
+	if webhookRelayEnabled() {
+		providerWebhook = ""
 	}
-	if waToken == "" {
-		waToken = sessionTokenRaw
-	}
-	if waWebhook == "" {
-		waWebhook = req.WebhookURL
+	created, err := provider.CreateSession(node, providerSessionSpec{
+		Name:          req.SessionName,
+		Token:         sessionTokenRaw,
+		WebhookURL:    providerWebhook,
+		Events:        providerEvents(req.Events),
+		ExpirationSec: req.ExpirationSec,
+		History:       req.History,
+	})
+	if err != nil {
+		respondProviderError(c, err)
+		return
 	}
 
 	now := time.Now()
 	session := models.WhatsAppSession{
 		UserID:       user.ID,
 		Provider:     sub.Provider,
-		SessionID:    waUserID,
+		NodeID:       node.ID,
+		SessionID:    created.SessionID,
 		SessionName:  req.SessionName,
-		SessionToken: waToken,
-		WebhookURL:   waWebhook,
+		WebhookURL:   created.WebhookURL,
+		Events:       normalizeWebhookEvents(req.Events),
 		Status:       "created",
 		LastSyncedAt: &now,
 	}
-	if err := database.GetDB().Create(&session).Error; err != nil {
+	if webhookRelayEnabled() {
+		session.WebhookURL = req.WebhookURL
+	}
+	if session.WebhookSecret, _, err = generateAPIKey("whsec"); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "failed generating webhook secret"})
+		return
+	}
+	err = setSessionToken(&session, created.Token)
+	if err == nil {
+		err = database.GetDB().Create(&session).Error
+	}
+	if err != nil {
+		// Do not leave an orphan at the provider; the reconciler catches it
+		// if this fails too.
+		if err := provider.DeleteSession(node, created.SessionID); err != nil {
+			log.Printf("Session %s rollback at provider failed: %v", created.SessionID, err)
+		}
 		c.JSON(http.StatusInternalServerError, gin.H{"message": "failed to store session"})
 		return
 	}
 
+	if webhookRelayEnabled() {
+		// On failure the session stays unregistered and the background
+		// pass in StartWebhookRelayWorkers retries it.
+		err := provider.SetWebhook(node, created.Token, ingestURL(session))
+		if err != nil {
+			log.Printf("Session %s webhook relay registration failed, retrying in background: %v", session.SessionID, err)
+		}
+		setRelayRegistered(session, err == nil)
+	}
+
 	if req.AutoConnect {
-		_, _, _ = proxyWithToken(http.MethodPost, "/session/connect", waToken, map[string]interface{}{"subscribe": strings.Split(req.Events, ",")})
+		_ = provider.Connect(node, created.Token, strings.Split(providerEvents(req.Events), ","))
 	}
 
-	c.JSON(http.StatusCreated, gin.H{"session": session})
+	// The full token is only shown here; listings mask it.
+	session.TokenDisplay = created.Token
+	c.JSON(http.StatusCreated, gin.H{"session": session, "webhook_secret": session.WebhookSecret})
 	return
 }
 
@@ -150,47 +195,56 @@ func UpdateSession(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
 		return
 	}
+	if req.WebhookURL != nil {
+		if err := validateSessionWebhookURL(*req.WebhookURL); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+			return
+		}
+	}
 
 	var session models.WhatsAppSession
 	if err := database.GetDB().Where("user_id = ? AND session_id = ?", user.ID, sessionID).First(&session).Error; err != nil {
-		c.JSON(http.StatusForbidden, gin.H{"message": "session not found for user"})
+		respondError(c, http.StatusForbidden, codeSessionNotFound, "session not found for user")
 		return
 	}
 
-	adminPayload := map[string]interface{}{}
-	if req.SessionName != nil {
-		adminPayload["name"] = *req.SessionName
-		session.SessionName = *req.SessionName
+	provider, err := providerFor(session.Provider)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": err.Error()})
+		return
+	}
+	node, ok := sessionNodeOrAbort(c, session)
+	if !ok {
+		return
 	}
+	upstreamReq := req
 	if req.WebhookURL != nil {
-		adminPayload["webhook"] = *req.WebhookURL
-		session.WebhookURL = *req.WebhookURL
+		webhook := upstreamWebhookURL(session, *req.WebhookURL)
+		upstreamReq.WebhookURL = &webhook
 	}
 	if req.Events != nil {
-		adminPayload["events"] = *req.Events
+		events := providerEvents(*req.Events)
+		upstreamReq.Events = &events
 	}
-	if req.ExpirationSec != nil {
-		adminPayload["expiration"] = *req.ExpirationSec
+	if err := provider.UpdateSession(node, sessionID, upstreamReq); err != nil {
+		respondProviderError(c, err)
+		return
 	}
-	if req.History != nil {
-		adminPayload["history"] = *req.History
+	if req.SessionName != nil {
+		session.SessionName = *req.SessionName
 	}
-
-	if len(adminPayload) > 0 {
-		status, body, err := proxyAdminToWAServer(http.MethodPut, "/admin/users/"+sessionID, adminPayload)
-		if err != nil {
-			c.JSON(http.StatusBadGateway, gin.H{"message": err.Error()})
-			return
-		}
-		if status < 200 || status >= 300 {
-			c.Data(status, "application/json", body)
-			return
-		}
+	if req.WebhookURL != nil {
+		session.WebhookURL = *req.WebhookURL
 	}
 
 	updates := map[string]interface{}{"updated_at": time.Now()}
 	if req.WebhookURL != nil {
 		updates["webhook_url"] = *req.WebhookURL
+		updates["relay_registered"] = webhookRelayEnabled()
+	}
+	if req.Events != nil {
+		session.Events = normalizeWebhookEvents(*req.Events)
+		updates["events"] = session.Events
 	}
 
 	if err := database.GetDB().Model(&models.WhatsAppSession{}).Where("id = ?", session.ID).Updates(updates).Error; err != nil {
@@ -198,27 +252,38 @@ func UpdateSession(c *gin.Context) {
 		return
 	}
 
+	if token, err := sessionToken(session); err == nil {
+		session.TokenDisplay = maskSessionToken(token)
+	}
 	c.JSON(http.StatusOK, gin.H{"session": session})
 }
 
 func DeleteSession(c *gin.Context) {
 	user := c.MustGet("user").(models.ServiceUser)
 	sessionID := c.Param("session_id")
-	if !userOwnsSession(user.ID, sessionID) {
-		c.JSON(http.StatusForbidden, gin.H{"message": "session not found for user"})
+	var session models.WhatsAppSession
+	if err := database.GetDB().Where("user_id = ? AND session_id = ?", user.ID, sessionID).First(&session).Error; err != nil {
+		respondError(c, http.StatusForbidden, codeSessionNotFound, "session not found for user")
 		return
 	}
 
-	status, body, err := proxyAdminToWAServer(http.MethodDelete, "/admin/users/"+sessionID+"/full", nil)
+	provider, err := providerFor(session.Provider)
 	if err != nil {
-		c.JSON(http.StatusBadGateway, gin.H{"message": err.Error()})
+		c.JSON(http.StatusInternalServerError, gin.H{"message": err.Error()})
 		return
 	}
-
-	if status >= 200 && status < 300 {
-		_ = database.GetDB().Where("user_id = ? AND session_id = ?", user.ID, sessionID).Delete(&models.WhatsAppSession{}).Error
+	node, ok := sessionNodeOrAbort(c, session)
+	if !ok {
+		return
+	}
+	if err := provider.DeleteSession(node, sessionID); err != nil {
+		respondProviderError(c, err)
+		return
 	}
-	c.Data(status, "application/json", body)
+
+	_ = database.GetDB().Where("user_id = ? AND session_id = ?", user.ID, sessionID).Delete(&models.WhatsAppSession{}).Error
+	_ = database.GetDB().Where("user_id = ? AND session_id = ?", user.ID, sessionID).Delete(&models.SessionWebhook{}).Error
+	c.JSON(http.StatusOK, gin.H{"message": "session deleted"})
 }
 
 func GetSessionSettings(c *gin.Context) {
@@ -227,13 +292,21 @@ func GetSessionSettings(c *gin.Context) {
 
 	var session models.WhatsAppSession
 	if err := database.GetDB().Where("user_id = ? AND session_id = ?", user.ID, sessionID).First(&session).Error; err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"message": "session not found"})
+		respondError(c, http.StatusNotFound, codeSessionNotFound, "session not found")
+		return
+	}
+
+	secret, err := ensureWebhookSecret(&session)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "failed to load webhook secret"})
 		return
 	}
 
 	c.JSON(http.StatusOK, gin.H{
 		"session_id":          session.SessionID,
 		"webhook_url":         session.WebhookURL,
+		"webhook_secret":      secret,
+		"webhook_relay":       webhookRelayEnabled(),
 		"message_stat_sent":   session.LastMessageSent,
 		"message_stat_failed": session.LastMessageFail,
 	})
@@ -244,7 +317,7 @@ func UpdateSessionSettings(c *gin.Context) {
 	sessionID := c.Param("session_id")
 	var session models.WhatsAppSession
 	if err := database.GetDB().Where("user_id = ? AND session_id = ?", user.ID, sessionID).First(&session).Error; err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"message": "session not found"})
+		respondError(c, http.StatusNotFound, codeSessionNotFound, "session not found")
 		return
 	}
 
@@ -255,6 +328,12 @@ func UpdateSessionSettings(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
 		return
 	}
+	if req.WebhookURL != nil {
+		if err := validateSessionWebhookURL(*req.WebhookURL); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+			return
+		}
+	}
 
 	updates := map[string]interface{}{"updated_at": time.Now()}
 	if req.WebhookURL != nil {
@@ -269,7 +348,17 @@ func UpdateSessionSettings(c *gin.Context) {
 	}
 
 	if req.WebhookURL != nil {
-		_, _, _ = proxyWithToken(http.MethodPut, "/webhook", session.SessionToken, map[string]interface{}{"webhookURL": *req.WebhookURL})
+		if provider, err := providerFor(session.Provider); err == nil {
+			token, err := sessionToken(session)
+			var node models.ProviderNode
+			if err == nil {
+				node, err = resolveSessionNode(session)
+			}
+			if err == nil {
+				err = provider.SetWebhook(node, token, upstreamWebhookURL(session, *req.WebhookURL))
+			}
+			setRelayRegistered(session, err == nil)
+		}
 	}
 	c.JSON(http.StatusOK, gin.H{"message": "settings updated"})
 }
@@ -280,15 +369,20 @@ func ListSessionContacts(c *gin.Context) {
 
 	var session models.WhatsAppSession
 	if err := database.GetDB().Where("user_id = ? AND session_id = ?", user.ID, sessionID).First(&session).Error; err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"message": "session not found"})
+		respondError(c, http.StatusNotFound, codeSessionNotFound, "session not found")
 		return
 	}
 
 	autoSync := c.DefaultQuery("sync", "true")
 	if strings.EqualFold(autoSync, "true") {
-		status, body, err := proxyWithToken(http.MethodGet, "/user/contacts", session.SessionToken, nil)
-		if err == nil && status >= 200 && status < 300 {
-			_, _ = upsertContacts(user.ID, sessionID, body)
+		if provider, err := providerFor(session.Provider); err == nil {
+			if token, err := sessionToken(session); err == nil {
+				if node, err := resolveSessionNode(session); err == nil {
+					if contacts, err := provider.FetchContacts(node, token); err == nil {
+						upsertContacts(user.ID, sessionID, contacts)
+					}
+				}
+			}
 		}
 	}
 
@@ -307,29 +401,47 @@ func SyncSessionContacts(c *gin.Context) {
 
 	var session models.WhatsAppSession
 	if err := database.GetDB().Where("user_id = ? AND session_id = ?", user.ID, sessionID).First(&session).Error; err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"message": "session not found"})
+		respondError(c, http.StatusNotFound, codeSessionNotFound, "session not found")
 		return
 	}
 
-	status, body, err := proxyWithToken(http.MethodGet, "/user/contacts", session.SessionToken, nil)
+	provider, err := providerFor(session.Provider)
 	if err != nil {
-		c.JSON(http.StatusBadGateway, gin.H{"message": err.Error()})
+		c.JSON(http.StatusInternalServerError, gin.H{"message": err.Error()})
 		return
 	}
-	if status < 200 || status >= 300 {
-		c.Data(status, "application/json", body)
+	token, err := sessionToken(session)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "failed to read session token"})
 		return
 	}
-
-	count, err := upsertContacts(user.ID, sessionID, body)
+	node, ok := sessionNodeOrAbort(c, session)
+	if !ok {
+		return
+	}
+	contacts, err := provider.FetchContacts(node, token)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"message": err.Error()})
+		respondProviderError(c, err)
 		return
 	}
 
+	count := upsertContacts(user.ID, sessionID, contacts)
+
 	c.JSON(http.StatusOK, gin.H{"synced": count})
 }
 
+// gatewayTargetPath is the provider path of a /wa request, cleaned once so
+// "//admin" or "/./chat/send" cannot slip past the prefix checks. Every
+// check and the upstream request use this value. A trailing slash is kept.
+func gatewayTargetPath(requestPath string) string {
+	raw := strings.TrimPrefix(requestPath, "/wa")
+	cleaned := path.Clean("/" + raw)
+	if strings.HasSuffix(raw, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+	return cleaned
+}
+
 func WhatsAppGateway(c *gin.Context) {
 	token := getTokenFromRequest(c)
 	if token == "" {
@@ -337,87 +449,204 @@ func WhatsAppGateway(c *gin.Context) {
 		return
 	}
 
-	session, sub, err := validateSessionToken(token)
+	session, sub, err := resolveSessionToken(c, token)
+	if errors.Is(err, errInvalidSessionToken) {
+		respondError(c, http.StatusForbidden, codeInvalidSessionToken, err.Error())
+		return
+	}
 	if err != nil {
-		c.JSON(http.StatusForbidden, gin.H{"message": err.Error()})
+		respondError(c, http.StatusForbidden, subscriptionErrorCode(err), err.Error())
 		return
 	}
 	if sub.Status != models.SubscriptionActive {
-		c.JSON(http.StatusForbidden, gin.H{"message": "subscription inactive"})
+		respondError(c, http.StatusForbidden, codeSubscriptionInactive, "subscription inactive")
 		return
 	}
-
-	targetPath := strings.TrimPrefix(c.Request.URL.Path, "/wa")
-	if targetPath == "" {
-		targetPath = "/"
+	if err := forwardSessionToken(c, session, token); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "failed to read session token"})
+		return
 	}
+
+	targetPath := gatewayTargetPath(c.Request.URL.Path)
 	if strings.HasPrefix(targetPath, "/admin") {
 		c.JSON(http.StatusForbidden, gin.H{"message": "admin path is not exposed"})
 		return
 	}
 
-	if sub.MaxMessages > 0 && c.Request.Method == http.MethodPost && strings.HasPrefix(targetPath, "/chat/send") {
-		remaining := sub.MaxMessages - int(session.LastMessageSent)
-		if remaining <= 0 {
-			c.JSON(http.StatusForbidden, gin.H{"message": "message quota exceeded"})
+	rule, err := evaluatePathPolicy(sub, c.Request.Method, targetPath)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "failed to evaluate plan policy"})
+		return
+	}
+	if rule != nil && rule.Effect == models.PolicyDeny {
+		message, entitlement := policyDeniedMessage(rule)
+		setResponseCode(c, codePolicyDenied)
+		c.JSON(http.StatusForbidden, gin.H{"message": message, "entitlement": entitlement})
+		return
+	}
+
+	if interceptWebhookPath(c, session, targetPath) {
+		return
+	}
+	if webhookRelayEnabled() && c.Request.Method == http.MethodPost && strings.TrimRight(targetPath, "/") == "/session/connect" {
+		subscribeStatusEvents(c, session)
+	}
+
+	isSend := c.Request.Method == http.MethodPost && strings.HasPrefix(targetPath, "/chat/send")
+	recipient := ""
+	if isSend {
+		recipient, err = normalizeSendBody(c)
+		var invalid *recipientError
+		switch {
+		case errors.As(err, &invalid):
+			respondInvalidRecipient(c, err)
+			return
+		case errors.Is(err, errSendBodyTooLarge):
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"message": err.Error()})
+			return
+		case err != nil:
+			c.JSON(http.StatusBadRequest, gin.H{"message": "failed to read request body"})
+			return
+		}
+		blocked, err := isRecipientBlocked(session.UserID, recipient)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"message": "failed to check recipient blocklist"})
+			return
+		}
+		if blocked {
+			setResponseCode(c, codeRecipientBlocked)
+			c.JSON(http.StatusForbidden, gin.H{"message": "recipient has opted out", "recipient": recipient})
 			return
 		}
 	}
 
-	status, body, err := proxyToWAServer(c, targetPath, false)
-	if err != nil {
-		c.JSON(http.StatusBadGateway, gin.H{"message": err.Error()})
+	node, ok := sessionNodeOrAbort(c, session)
+	if !ok {
+		return
+	}
+
+	// Duplicates are answered here, before any quota or counter is touched.
+	idem, handled := beginIdempotentRequest(c, session.SessionID, targetPath)
+	if handled {
 		return
 	}
 
-	if c.Request.Method == http.MethodPost && strings.HasPrefix(targetPath, "/chat/send") {
-		incSent := int64(0)
-		incFail := int64(1)
-		if status >= 200 && status < 300 {
-			incSent = 1
-			incFail = 0
+	var reservation *models.QuotaReservation
+	if isSend {
+		reservation, err = reserveMessageQuota(sub, session.SessionID)
+		if errors.Is(err, errQuotaExceeded) {
+			abandonIdempotentRequest(idem)
+			respondError(c, http.StatusForbidden, codeQuotaExceeded, "message quota exceeded")
+			return
 		}
-		_ = database.GetDB().Model(&models.WhatsAppSession{}).
-			Where("id = ?", session.ID).
-			Updates(map[string]interface{}{
-				"last_message_sent": gorm.Expr("last_message_sent + ?", incSent),
-				"last_message_fail": gorm.Expr("last_message_fail + ?", incFail),
-				"last_activity_at":  time.Now(),
-			}).Error
+		if err != nil {
+			abandonIdempotentRequest(idem)
+			c.JSON(http.StatusInternalServerError, gin.H{"message": "failed to reserve message quota"})
+			return
+		}
+	}
 
-		messageType := detectMessageType(targetPath)
-		_ = upsertMessageStat(session.UserID, session.SessionID, messageType, incSent, incFail)
+	// Session, send and idempotent responses are needed after streaming;
+	// everything else (media, documents) is passed through as-is.
+	captureBody := strings.HasPrefix(targetPath, "/session") || isSend || idem != nil
+	status, body, err := proxyToWAServer(c, node, targetPath, captureBody, idem != nil)
+	var invalid *recipientError
+	if errors.As(err, &invalid) {
+		// A second recipient field cut the upload short; the provider got
+		// truncated JSON and sent nothing.
+		_ = releaseMessageQuota(reservation)
+		abandonIdempotentRequest(idem)
+		respondInvalidRecipient(c, err)
+		return
 	}
+	if err != nil {
+		if upstreamNeverSent(err) {
+			_ = releaseMessageQuota(reservation)
+			abandonIdempotentRequest(idem)
+		} else {
+			// The provider may have sent it: count the message and answer
+			// retries with this failure instead of sending again.
+			_ = commitMessageQuota(reservation)
+			failIdempotentRequest(idem, err)
+		}
+		respondProviderError(c, err)
+		return
+	}
+	completeIdempotentRequest(idem, status, c.Writer.Header().Get("Content-Type"), body)
 
-	if strings.HasPrefix(targetPath, "/session") && status >= 200 && status < 300 {
-		_ = syncSessionFromResponse(session.UserID, body)
+	if isSend {
+		success := status >= 200 && status < 300
+		if success {
+			_ = commitMessageQuota(reservation)
+		} else {
+			_ = releaseMessageQuota(reservation)
+		}
+		recordSendOutcome(session, sendRecord{
+			MessageType: detectMessageType(targetPath),
+			Recipient:   recipient,
+			Source:      ledgerSourceGateway,
+			HTTPStatus:  status,
+			Body:        body,
+			Success:     success,
+		})
 	}
 
-	c.Data(status, "application/json", body)
+	if strings.HasPrefix(targetPath, "/session") && body != nil && status >= 200 && status < 300 {
+		_ = syncSessionFromResponse(session, body)
+	}
+	if strings.HasPrefix(targetPath, "/session") {
+		noteSessionCommand(session, c.Request.Method, targetPath, status)
+	}
 }
 
 func validateSessionToken(token string) (models.WhatsAppSession, models.UserSubscription, error) {
 	var session models.WhatsAppSession
-	if err := database.GetDB().Where("session_token = ?", token).First(&session).Error; err != nil {
-		return session, models.UserSubscription{}, err
+	hash := hashAPIKey(token)
+	if err := database.GetDB().Where("token_hash = ? OR (prev_token_hash = ? AND prev_token_until > ?)", hash, hash, time.Now()).
+		First(&session).Error; err != nil {
+		return session, models.UserSubscription{}, errInvalidSessionToken
 	}
-	sub, err := getActiveSubscription(session.UserID)
+	sub, err := getActiveSubscription(session.UserID, session.Provider)
 	if err != nil {
 		return session, models.UserSubscription{}, err
 	}
 	return session, sub, nil
 }
 
-func getActiveSubscription(userID string) (models.UserSubscription, error) {
+// sessionTokenAuth is a validateSessionToken result kept on the request.
+type sessionTokenAuth struct {
+	session models.WhatsAppSession
+	sub     models.UserSubscription
+	err     error
+}
+
+// resolveSessionToken validates a /wa token once per request, so the rate
+// limiter and the gateway share one lookup.
+func resolveSessionToken(c *gin.Context, token string) (models.WhatsAppSession, models.UserSubscription, error) {
+	if value, ok := c.Get("session_auth"); ok {
+		auth := value.(sessionTokenAuth)
+		return auth.session, auth.sub, auth.err
+	}
+	session, sub, err := validateSessionToken(token)
+	c.Set("session_auth", sessionTokenAuth{session: session, sub: sub, err: err})
+	return session, sub, err
+}
+
+// getActiveSubscription returns the user's active subscription for provider;
+// an empty provider means the default genfity-wa backend.
+func getActiveSubscription(userID, provider string) (models.UserSubscription, error) {
+	if provider == "" {
+		provider = defaultProviderName
+	}
 	var sub models.UserSubscription
-	err := database.GetDB().Where("user_id = ? AND status = ?", userID, models.SubscriptionActive).Order("updated_at desc").First(&sub).Error
+	err := database.GetDB().Where("user_id = ? AND provider = ? AND status = ?", userID, provider, models.SubscriptionActive).Order("updated_at desc").First(&sub).Error
 	if err != nil {
 		return sub, err
 	}
 	if time.Now().After(sub.ExpiresAt) {
 		sub.Status = models.SubscriptionExpired
 		_ = database.GetDB().Save(&sub).Error
-		return sub, errors.New("subscription expired")
+		return sub, errSubscriptionExpired
 	}
 	return sub, nil
 }
@@ -440,65 +669,127 @@ func getTokenFromRequest(c *gin.Context) string {
 	return authHeader
 }
 
-func proxyToWAServer(c *gin.Context, path string, useAdminToken bool) (int, []byte, error) {
-	waServerURL := strings.TrimRight(os.Getenv("WA_SERVER_URL"), "/")
-	targetURL := waServerURL + path
+// hopHeaders are connection-level headers that must not be forwarded by a proxy.
+var hopHeaders = map[string]bool{
+	"Connection":          true,
+	"Keep-Alive":          true,
+	"Proxy-Authenticate":  true,
+	"Proxy-Authorization": true,
+	"Te":                  true,
+	"Trailer":             true,
+	"Transfer-Encoding":   true,
+	"Upgrade":             true,
+}
+
+// maxCapturedBody caps how much of a streamed upstream response is kept in
+// memory for post-response hooks.
+const maxCapturedBody = 1 << 20
+
+// cappedBuffer keeps at most limit bytes and silently drops the rest so it can
+// be used as the secondary writer of an io.MultiWriter without failing the copy.
+type cappedBuffer struct {
+	buf       bytes.Buffer
+	limit     int
+	truncated bool
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	room := b.limit - b.buf.Len()
+	if room <= 0 {
+		b.truncated = b.truncated || len(p) > 0
+		return len(p), nil
+	}
+	if len(p) > room {
+		b.buf.Write(p[:room])
+		b.truncated = true
+		return len(p), nil
+	}
+	b.buf.Write(p)
+	return len(p), nil
+}
+
+// proxyToWAServer streams the incoming request to the session's node and the upstream
+// response straight back to the client. When capture is true, up to
+// maxCapturedBody bytes of the response are also returned so callers can run
+// post-response hooks; a nil body means nothing (or too much) was captured.
+// A non-nil error is only returned when nothing has been written to the client.
+// With detach the upstream call outlives a client that disconnects (bounded
+// by the client timeout), so a claimed Idempotency-Key ends with the
+// provider's answer rather than a cancelled send.
+func proxyToWAServer(c *gin.Context, node models.ProviderNode, path string, capture, detach bool) (int, []byte, error) {
+	targetURL := node.URL(path)
 	if c.Request.URL.RawQuery != "" {
 		targetURL += "?" + c.Request.URL.RawQuery
 	}
-	bodyBytes, _ := io.ReadAll(c.Request.Body)
-	req, err := http.NewRequest(c.Request.Method, targetURL, bytes.NewBuffer(bodyBytes))
+	ctx := c.Request.Context()
+	if detach {
+		ctx = context.WithoutCancel(ctx)
+	}
+	req, err := http.NewRequestWithContext(ctx, c.Request.Method, targetURL, c.Request.Body)
 	if err != nil {
-		return http.StatusInternalServerError, nil, err
+		return http.StatusInternalServerError, nil, fmt.Errorf("%w: %v", errUpstreamNotSent, err)
 	}
+	req.ContentLength = c.Request.ContentLength
 
 	for k, values := range c.Request.Header {
+		if hopHeaders[k] {
+			continue
+		}
 		for _, v := range values {
 			req.Header.Add(k, v)
 		}
 	}
-	if useAdminToken {
-		req.Header.Set("Authorization", "Bearer "+os.Getenv("WA_ADMIN_TOKEN"))
+	if capture {
+		// Let the transport negotiate compression so captured bytes are plain JSON.
+		req.Header.Del("Accept-Encoding")
 	}
 
-	resp, err := http.DefaultClient.Do(req)
+	_, streamClient := upstreamClients()
+	resp, err := doUpstream(streamClient, node, req)
 	if err != nil {
 		return http.StatusBadGateway, nil, err
 	}
 	defer resp.Body.Close()
 
-	respBody, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return http.StatusInternalServerError, nil, err
-	}
-	return resp.StatusCode, respBody, nil
-}
-
-func proxyJSONToWAServer(method string, path string, payload interface{}) (int, []byte, error) {
-	waServerURL := strings.TrimRight(os.Getenv("WA_SERVER_URL"), "/")
-	targetURL := waServerURL + path
-	body, _ := json.Marshal(payload)
-	req, err := http.NewRequest(method, targetURL, bytes.NewBuffer(body))
-	if err != nil {
-		return http.StatusInternalServerError, nil, err
+	for k, values := range resp.Header {
+		if hopHeaders[k] {
+			continue
+		}
+		for _, v := range values {
+			c.Writer.Header().Add(k, v)
+		}
 	}
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer "+os.Getenv("WA_ADMIN_TOKEN"))
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return http.StatusBadGateway, nil, err
+	markUpstreamResponse(c)
+	c.Status(resp.StatusCode)
+
+	var captured *cappedBuffer
+	var dst io.Writer = c.Writer
+	if capture {
+		captured = &cappedBuffer{limit: maxCapturedBody}
+		// captured first: it never fails, so it still sees the chunk a
+		// disconnected client could not take.
+		dst = io.MultiWriter(captured, c.Writer)
+	}
+	if _, err := io.Copy(dst, resp.Body); err != nil {
+		log.Printf("Gateway stream %s %s interrupted: %v", c.Request.Method, path, err)
+		if !detach || captured == nil {
+			return resp.StatusCode, nil, nil
+		}
+		// The client is gone; keep reading so the response can be replayed.
+		if _, err := io.Copy(captured, resp.Body); err != nil {
+			return resp.StatusCode, nil, nil
+		}
 	}
-	defer resp.Body.Close()
-	respBody, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return http.StatusInternalServerError, nil, err
+	c.Writer.Flush()
+
+	if captured == nil || captured.truncated {
+		return resp.StatusCode, nil, nil
 	}
-	return resp.StatusCode, respBody, nil
+	return resp.StatusCode, captured.buf.Bytes(), nil
 }
 
-func proxyAdminToWAServer(method string, path string, payload interface{}) (int, []byte, error) {
-	waServerURL := strings.TrimRight(os.Getenv("WA_SERVER_URL"), "/")
-	targetURL := waServerURL + path
+func proxyAdminToWAServer(node models.ProviderNode, method string, path string, payload interface{}) (int, []byte, error) {
+	targetURL := node.URL(path)
 
 	var reader io.Reader
 	if payload != nil {
@@ -511,8 +802,9 @@ func proxyAdminToWAServer(method string, path string, payload interface{}) (int,
 		return http.StatusInternalServerError, nil, err
 	}
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", os.Getenv("WA_ADMIN_TOKEN"))
-	resp, err := http.DefaultClient.Do(req)
+	req.Header.Set("Authorization", nodeAdminToken(node))
+	apiClient, _ := upstreamClients()
+	resp, err := doUpstream(apiClient, node, req)
 	if err != nil {
 		return http.StatusBadGateway, nil, err
 	}
@@ -525,9 +817,8 @@ func proxyAdminToWAServer(method string, path string, payload interface{}) (int,
 	return resp.StatusCode, respBody, nil
 }
 
-func proxyWithToken(method string, path string, token string, payload interface{}) (int, []byte, error) {
-	waServerURL := strings.TrimRight(os.Getenv("WA_SERVER_URL"), "/")
-	targetURL := waServerURL + path
+func proxyWithToken(node models.ProviderNode, method string, path string, token string, payload interface{}) (int, []byte, error) {
+	targetURL := node.URL(path)
 
 	var reader io.Reader
 	if payload != nil {
@@ -541,7 +832,8 @@ func proxyWithToken(method string, path string, token string, payload interface{
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("token", token)
 
-	resp, err := http.DefaultClient.Do(req)
+	apiClient, _ := upstreamClients()
+	resp, err := doUpstream(apiClient, node, req)
 	if err != nil {
 		return http.StatusBadGateway, nil, err
 	}
@@ -554,19 +846,36 @@ func proxyWithToken(method string, path string, token string, payload interface{
 	return resp.StatusCode, respBody, nil
 }
 
-func parseWAAdminUserResponse(body []byte) (id string, token string, webhook string) {
-	var payload map[string]interface{}
-	if err := json.Unmarshal(body, &payload); err != nil {
-		return "", "", ""
-	}
-	data, _ := payload["data"].(map[string]interface{})
-	if data == nil {
-		data = payload
-	}
-	id, _ = data["id"].(string)
-	token, _ = data["token"].(string)
-	webhook, _ = data["webhook"].(string)
-	return
+// sendRecord describes the outcome of one send for accounting.
+type sendRecord struct {
+	MessageType string
+	Recipient   string
+	Source      string
+	HTTPStatus  int
+	Body        []byte
+	Success     bool
+}
+
+// recordSendOutcome updates the session counters and per-type message stats
+// and appends the send ledger row, whichever path (gateway, API, queue,
+// scheduler) performed the send.
+func recordSendOutcome(session models.WhatsAppSession, rec sendRecord) {
+	incSent := int64(0)
+	incFail := int64(1)
+	if rec.Success {
+		incSent = 1
+		incFail = 0
+	}
+	_ = database.GetDB().Model(&models.WhatsAppSession{}).
+		Where("id = ?", session.ID).
+		Updates(map[string]interface{}{
+			"last_message_sent": gorm.Expr("last_message_sent + ?", incSent),
+			"last_message_fail": gorm.Expr("last_message_fail + ?", incFail),
+			"last_activity_at":  time.Now(),
+		}).Error
+
+	_ = upsertMessageStat(session.UserID, session.SessionID, rec.MessageType, incSent, incFail)
+	appendSendLedger(session, rec)
 }
 
 func detectMessageType(path string) string {
@@ -612,55 +921,16 @@ func upsertMessageStat(userID, sessionID, messageType string, sent, failed int64
 	return db.Model(&models.SessionMessageStat{}).Where("id = ?", stat.ID).Updates(updates).Error
 }
 
-func upsertContacts(userID, sessionID string, raw []byte) (int, error) {
-	var payload map[string]interface{}
-	if err := json.Unmarshal(raw, &payload); err != nil {
-		return 0, fmt.Errorf("invalid contacts response")
-	}
-
+func upsertContacts(userID, sessionID string, contacts []providerContact) int {
 	now := time.Now()
 	db := database.GetDB()
 	count := 0
-
-	// Format 1: genfity-wa returns map[jid]contactInfo
-	for key, value := range payload {
-		entry, ok := value.(map[string]interface{})
-		if !ok {
-			continue
-		}
-		if upsertContactRow(db, userID, sessionID, key, entry, now) {
-			count++
-		}
-	}
-
-	if count > 0 {
-		return count, nil
-	}
-
-	// Format 2: array response under data/contacts
-	listAny := payload["data"]
-	if listAny == nil {
-		listAny = payload["contacts"]
-	}
-	list, ok := listAny.([]interface{})
-	if !ok {
-		return 0, nil
-	}
-
-	for _, item := range list {
-		entry, ok := item.(map[string]interface{})
-		if !ok {
-			continue
-		}
-		jid, _ := entry["jid"].(string)
-		if jid == "" {
-			jid, _ = entry["id"].(string)
-		}
-		if upsertContactRow(db, userID, sessionID, jid, entry, now) {
+	for _, contact := range contacts {
+		if upsertContactRow(db, userID, sessionID, contact.JID, contact.Fields, now) {
 			count++
 		}
 	}
-	return count, nil
+	return count
 }
 
 func upsertContactRow(db *gorm.DB, userID, sessionID, jid string, entry map[string]interface{}, now time.Time) bool {
@@ -709,7 +979,10 @@ func normalizePhoneFromJID(jid string) string {
 	return left
 }
 
-func syncSessionFromResponse(userID string, body []byte) error {
+// syncSessionFromResponse refreshes the session described by a /session*
+// response. A session ID the service does not know yet is stored for the
+// owner of the calling session, on the same provider and node.
+func syncSessionFromResponse(owner models.WhatsAppSession, body []byte) error {
 	var payload map[string]interface{}
 	if err := json.Unmarshal(body, &payload); err != nil {
 		return nil
@@ -735,29 +1008,43 @@ func syncSessionFromResponse(userID string, body []byte) error {
 
 	var session models.WhatsAppSession
 	db := database.GetDB()
-	if err := db.Where("user_id = ? AND session_id = ?", userID, sessionID).First(&session).Error; err != nil {
+	if err := db.Where("user_id = ? AND session_id = ?", owner.UserID, sessionID).First(&session).Error; err != nil {
 		session = models.WhatsAppSession{
-			UserID:       userID,
+			UserID:       owner.UserID,
+			Provider:     owner.Provider,
+			NodeID:       owner.NodeID,
 			SessionID:    sessionID,
 			SessionName:  name,
-			SessionToken: token,
 			JID:          jid,
 			Status:       status,
 			Connected:    connected,
 			LoggedIn:     loggedIn,
 			LastSyncedAt: &now,
 		}
+		if err := setSessionToken(&session, token); err != nil {
+			return err
+		}
 		return db.Create(&session).Error
 	}
 
-	session.SessionName = name
-	if token != "" {
-		session.SessionToken = token
-	}
-	session.JID = jid
-	session.Status = status
-	session.Connected = connected
-	session.LoggedIn = loggedIn
-	session.LastSyncedAt = &now
-	return db.Save(&session).Error
+	next := sessionState{Status: status, Connected: connected, LoggedIn: loggedIn, JID: jid}
+	return db.Transaction(func(tx *gorm.DB) error {
+		if next != stateOf(session) {
+			if err := recordSessionTransition(tx, session, next, models.SessionStatusSourceSync, "", ""); err != nil {
+				return err
+			}
+		}
+		session.SessionName = name
+		if token != "" && hashAPIKey(token) != session.TokenHash {
+			if err := setSessionToken(&session, token); err != nil {
+				return err
+			}
+		}
+		session.JID = jid
+		session.Status = status
+		session.Connected = connected
+		session.LoggedIn = loggedIn
+		session.LastSyncedAt = &now
+		return tx.Save(&session).Error
+	})
 }
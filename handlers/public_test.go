@@ -0,0 +1,23 @@
+package handlers
+
+import "testing"
+
+func TestGatewayTargetPathCleansBeforeChecks(t *testing.T) {
+	for requestPath, want := range map[string]string{
+		"/wa":                    "/",
+		"/wa/":                   "/",
+		"/wa//admin/users":       "/admin/users",
+		"/wa/./admin/users":      "/admin/users",
+		"/wa/chat//send/text":    "/chat/send/text",
+		"/wa/./chat/send/text":   "/chat/send/text",
+		"/wa//chat/./send/image": "/chat/send/image",
+		"/wa/chat/../admin/x":    "/admin/x",
+		"/wa/webhook/":           "/webhook/",
+		"/wa//webhook":           "/webhook",
+		"/wa/session/./connect":  "/session/connect",
+	} {
+		if got := gatewayTargetPath(requestPath); got != want {
+			t.Errorf("gatewayTargetPath(%q) = %q, want %q", requestPath, got, want)
+		}
+	}
+}
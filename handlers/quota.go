@@ -0,0 +1,187 @@
+package handlers
+
+import (
+	"errors"
+	"time"
+
+	"genfity-wa-support/database"
+	"genfity-wa-support/models"
+
+	"gorm.io/gorm"
+)
+
+var errQuotaExceeded = errors.New("message quota exceeded")
+
+// quotaReservationTTL bounds how long a unit stays held when a send never
+// settles; the expiry cron releases it afterwards.
+const quotaReservationTTL = 10 * time.Minute
+
+// reserveMessageQuota atomically holds one message unit on the subscription.
+// The conditional UPDATE is evaluated under the row lock, so concurrent sends
+// from any of the user's sessions cannot overshoot max_messages.
+func reserveMessageQuota(sub models.UserSubscription, sessionID string) (*models.QuotaReservation, error) {
+	reservation := &models.QuotaReservation{
+		SubscriptionID: sub.ID,
+		UserID:         sub.UserID,
+		SessionID:      sessionID,
+		Status:         models.QuotaReserved,
+		ExpiresAt:      time.Now().Add(quotaReservationTTL),
+	}
+
+	err := database.GetDB().Transaction(func(tx *gorm.DB) error {
+		res := tx.Model(&models.UserSubscription{}).
+			Where("id = ? AND (max_messages <= 0 OR messages_used + messages_reserved < max_messages)", sub.ID).
+			Update("messages_reserved", gorm.Expr("messages_reserved + 1"))
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return errQuotaExceeded
+		}
+		return tx.Create(reservation).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return reservation, nil
+}
+
+// commitMessageQuota turns a reservation into a counted message.
+func commitMessageQuota(reservation *models.QuotaReservation) error {
+	return settleQuotaReservation(reservation, models.QuotaCommitted)
+}
+
+// releaseMessageQuota gives the reserved unit back without counting it.
+func releaseMessageQuota(reservation *models.QuotaReservation) error {
+	return settleQuotaReservation(reservation, models.QuotaReleased)
+}
+
+func settleQuotaReservation(reservation *models.QuotaReservation, status models.QuotaReservationStatus) error {
+	if reservation == nil {
+		return nil
+	}
+	return database.GetDB().Transaction(func(tx *gorm.DB) error {
+		res := tx.Model(&models.QuotaReservation{}).
+			Where("id = ? AND status = ?", reservation.ID, models.QuotaReserved).
+			Update("status", status)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			// Already settled, or released by the cron after expiring.
+			return nil
+		}
+
+		updates := map[string]interface{}{
+			"messages_reserved": gorm.Expr("GREATEST(messages_reserved - 1, 0)"),
+		}
+		if status == models.QuotaCommitted {
+			updates["messages_used"] = gorm.Expr("messages_used + 1")
+		}
+		if err := tx.Model(&models.UserSubscription{}).Where("id = ?", reservation.SubscriptionID).Updates(updates).Error; err != nil {
+			return err
+		}
+		reservation.Status = status
+		return nil
+	})
+}
+
+// quotaUsage is the current-period view of a subscription's message quota.
+type quotaUsage struct {
+	Period      models.QuotaPeriod `json:"period"`
+	PeriodStart *time.Time         `json:"period_start,omitempty"`
+	PeriodEnd   *time.Time         `json:"period_end,omitempty"`
+	Limit       int                `json:"limit"`
+	Used        int64              `json:"used"`
+	Reserved    int64              `json:"reserved"`
+	Remaining   int64              `json:"remaining"`
+}
+
+// buildQuotaUsage reports remaining as -1 when the subscription is unlimited.
+func buildQuotaUsage(sub models.UserSubscription) quotaUsage {
+	usage := quotaUsage{
+		Period:      sub.QuotaPeriod,
+		PeriodStart: sub.QuotaPeriodStart,
+		PeriodEnd:   sub.QuotaPeriodEnd,
+		Limit:       sub.MaxMessages,
+		Used:        sub.MessagesUsed,
+		Reserved:    sub.MessagesReserved,
+		Remaining:   -1,
+	}
+	if usage.Period == "" {
+		usage.Period = models.QuotaPeriodNone
+	}
+	if sub.MaxMessages > 0 {
+		usage.Remaining = int64(sub.MaxMessages) - sub.MessagesUsed - sub.MessagesReserved
+		if usage.Remaining < 0 {
+			usage.Remaining = 0
+		}
+	}
+	return usage
+}
+
+// applyQuotaSettings copies the quota settings present in an upsert request
+// to the subscription; omitted fields keep their stored value. It returns the
+// columns that changed. When the schedule changes, a fresh window is started
+// and the usage counter is reset.
+func applyQuotaSettings(sub *models.UserSubscription, req upsertUserRequest, now time.Time) (map[string]interface{}, error) {
+	current, ok := models.ParseQuotaPeriod(string(sub.QuotaPeriod))
+	if !ok {
+		current = models.QuotaPeriodNone
+	}
+	period := current
+	if req.QuotaPeriod != "" {
+		if period, ok = models.ParseQuotaPeriod(req.QuotaPeriod); !ok {
+			return nil, errors.New("quota_period must be one of none, daily, weekly, monthly")
+		}
+	}
+	currentTimezone := sub.QuotaTimezone
+	if currentTimezone == "" {
+		currentTimezone = models.DefaultQuotaTimezone
+	}
+	timezone := currentTimezone
+	if req.QuotaTimezone != "" {
+		timezone = req.QuotaTimezone
+	}
+	if _, err := time.LoadLocation(timezone); err != nil {
+		return nil, errors.New("invalid quota_timezone")
+	}
+
+	anchor := sub.QuotaAnchorAt
+	if req.QuotaAnchorAt != nil {
+		anchor = req.QuotaAnchorAt
+	}
+	if anchor == nil && period.IsPeriodic() {
+		anchor = &now
+	}
+
+	updates := map[string]interface{}{}
+	if period != current {
+		updates["quota_period"] = period
+	}
+	if timezone != currentTimezone {
+		updates["quota_timezone"] = timezone
+	}
+	if anchor != nil && (sub.QuotaAnchorAt == nil || !sub.QuotaAnchorAt.Equal(*anchor)) {
+		updates["quota_anchor_at"] = anchor
+	}
+
+	sub.QuotaPeriod = period
+	sub.QuotaTimezone = timezone
+	sub.QuotaAnchorAt = anchor
+	if len(updates) == 0 {
+		return updates, nil
+	}
+
+	sub.MessagesUsed = 0
+	sub.QuotaPeriodStart = nil
+	sub.QuotaPeriodEnd = nil
+	if start, end, ok := sub.QuotaWindow(now); ok {
+		sub.QuotaPeriodStart = &start
+		sub.QuotaPeriodEnd = &end
+	}
+	updates["messages_used"] = 0
+	updates["quota_period_start"] = sub.QuotaPeriodStart
+	updates["quota_period_end"] = sub.QuotaPeriodEnd
+	return updates, nil
+}
@@ -0,0 +1,78 @@
+package handlers
+
+import (
+	"testing"
+	"time"
+
+	"genfity-wa-support/models"
+)
+
+func TestBuildQuotaUsage(t *testing.T) {
+	for _, tc := range []struct {
+		name           string
+		sub            models.UserSubscription
+		remaining      int64
+		period         models.QuotaPeriod
+		used, reserved int64
+	}{
+		{"unlimited", models.UserSubscription{MessagesUsed: 5}, -1, models.QuotaPeriodNone, 5, 0},
+		{"counts reservations", models.UserSubscription{MaxMessages: 10, MessagesUsed: 4, MessagesReserved: 2, QuotaPeriod: models.QuotaPeriodDaily}, 4, models.QuotaPeriodDaily, 4, 2},
+		{"never negative", models.UserSubscription{MaxMessages: 3, MessagesUsed: 3, MessagesReserved: 1}, 0, models.QuotaPeriodNone, 3, 1},
+	} {
+		usage := buildQuotaUsage(tc.sub)
+		if usage.Remaining != tc.remaining || usage.Period != tc.period || usage.Used != tc.used || usage.Reserved != tc.reserved {
+			t.Errorf("%s: buildQuotaUsage = %+v", tc.name, usage)
+		}
+	}
+}
+
+func TestApplyQuotaSettings(t *testing.T) {
+	if _, err := time.LoadLocation(models.DefaultQuotaTimezone); err != nil {
+		t.Skipf("timezone data unavailable: %v", err)
+	}
+	now := time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC)
+	anchor := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	t.Run("unchanged keeps usage", func(t *testing.T) {
+		sub := models.UserSubscription{QuotaPeriod: models.QuotaPeriodDaily, QuotaAnchorAt: &anchor, MessagesUsed: 7}
+		updates, err := applyQuotaSettings(&sub, upsertUserRequest{QuotaPeriod: "daily"}, now)
+		if err != nil || len(updates) != 0 || sub.MessagesUsed != 7 {
+			t.Fatalf("updates = %v, err = %v, used = %d", updates, err, sub.MessagesUsed)
+		}
+	})
+
+	t.Run("new period resets usage and opens a window", func(t *testing.T) {
+		sub := models.UserSubscription{MessagesUsed: 7}
+		updates, err := applyQuotaSettings(&sub, upsertUserRequest{QuotaPeriod: "monthly"}, now)
+		if err != nil {
+			t.Fatalf("applyQuotaSettings: %v", err)
+		}
+		if updates["quota_period"] != models.QuotaPeriodMonthly || updates["messages_used"] != 0 || sub.MessagesUsed != 0 {
+			t.Fatalf("updates = %v, used = %d", updates, sub.MessagesUsed)
+		}
+		if sub.QuotaAnchorAt == nil || !sub.QuotaAnchorAt.Equal(now) {
+			t.Fatalf("anchor = %v, want now", sub.QuotaAnchorAt)
+		}
+		if sub.QuotaPeriodStart == nil || !sub.QuotaPeriodStart.Equal(now) {
+			t.Fatalf("period start = %v, want now", sub.QuotaPeriodStart)
+		}
+	})
+
+	t.Run("back to lifetime clears the window", func(t *testing.T) {
+		sub := models.UserSubscription{QuotaPeriod: models.QuotaPeriodWeekly, QuotaAnchorAt: &anchor, MessagesUsed: 7}
+		updates, err := applyQuotaSettings(&sub, upsertUserRequest{QuotaPeriod: "none"}, now)
+		if err != nil || updates["quota_period"] != models.QuotaPeriodNone {
+			t.Fatalf("updates = %v, err = %v", updates, err)
+		}
+		if sub.QuotaPeriodStart != nil || sub.QuotaPeriodEnd != nil || sub.MessagesUsed != 0 {
+			t.Fatalf("window = %v - %v, used = %d", sub.QuotaPeriodStart, sub.QuotaPeriodEnd, sub.MessagesUsed)
+		}
+	})
+
+	for _, req := range []upsertUserRequest{{QuotaPeriod: "yearly"}, {QuotaTimezone: "Mars/Olympus"}} {
+		sub := models.UserSubscription{}
+		if _, err := applyQuotaSettings(&sub, req, now); err == nil {
+			t.Errorf("applyQuotaSettings(%+v) accepted an invalid setting", req)
+		}
+	}
+}
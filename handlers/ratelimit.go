@@ -0,0 +1,128 @@
+package handlers
+
+import (
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"genfity-wa-support/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+const defaultPlan = "basic"
+
+// planRateLimit is a token bucket refilled at PerMinute/60 tokens per second
+// holding at most Burst tokens. PerMinute <= 0 disables the limit.
+type planRateLimit struct {
+	PerMinute int
+	Burst     int
+}
+
+// loadPlanRateLimits parses RATE_LIMIT_PLANS, e.g.
+// "basic:60:20,pro:300:60,enterprise:1200:200" (plan:per_minute:burst).
+func loadPlanRateLimits() map[string]planRateLimit {
+	limits := map[string]planRateLimit{defaultPlan: {PerMinute: 60, Burst: 20}}
+	for _, entry := range strings.Split(os.Getenv("RATE_LIMIT_PLANS"), ",") {
+		parts := strings.Split(strings.TrimSpace(entry), ":")
+		if len(parts) != 3 || strings.TrimSpace(parts[0]) == "" {
+			continue
+		}
+		perMinute, err1 := strconv.Atoi(strings.TrimSpace(parts[1]))
+		burst, err2 := strconv.Atoi(strings.TrimSpace(parts[2]))
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		if burst <= 0 {
+			burst = perMinute
+		}
+		limits[strings.ToLower(strings.TrimSpace(parts[0]))] = planRateLimit{PerMinute: perMinute, Burst: burst}
+	}
+	return limits
+}
+
+func planLimitFor(limits map[string]planRateLimit, plan string) planRateLimit {
+	if limit, ok := limits[strings.ToLower(plan)]; ok {
+		return limit
+	}
+	return limits[defaultPlan]
+}
+
+// SubscriptionRateLimiter applies the plan's token bucket per customer: keyed
+// on the ServiceUser for /v1 (after CustomerAPIKeyMiddleware) and on the session
+// resolved from the token for /wa. Requests it cannot attribute are left to
+// the IP limiter and the handler's own auth checks.
+func SubscriptionRateLimiter() gin.HandlerFunc {
+	limits := loadPlanRateLimits()
+	store := getRateLimitStore()
+
+	return func(c *gin.Context) {
+		key, sub, ok := subscriptionRateKey(c)
+		if !ok {
+			c.Next()
+			return
+		}
+		limit := planLimitFor(limits, sub.Plan)
+		if limit.PerMinute <= 0 {
+			c.Next()
+			return
+		}
+
+		result, err := store.TakeToken(key, limit, time.Now())
+		if err != nil {
+			log.Printf("Rate limiter unavailable: %v", err)
+			c.Next()
+			return
+		}
+		c.Header("X-RateLimit-Limit", strconv.Itoa(limit.Burst))
+		c.Header("X-RateLimit-Remaining", strconv.Itoa(result.Remaining))
+		c.Header("X-RateLimit-Reset", strconv.Itoa(ceilSeconds(result.ResetAfter)))
+		if !result.Allowed {
+			c.Header("Retry-After", strconv.Itoa(ceilSeconds(result.RetryAfter)))
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"message": "rate limit exceeded for plan " + planLabel(sub.Plan)})
+			return
+		}
+		c.Next()
+	}
+}
+
+func subscriptionRateKey(c *gin.Context) (string, models.UserSubscription, bool) {
+	if value, ok := c.Get("user"); ok {
+		// The bucket is per user whatever ?provider= says; without an active
+		// subscription for it the default plan applies.
+		user := value.(models.ServiceUser)
+		sub, err := getActiveSubscription(user.ID, requestProvider(c))
+		if err != nil {
+			sub = models.UserSubscription{}
+		}
+		return "user:" + user.ID, sub, true
+	}
+
+	token := getTokenFromRequest(c)
+	if token == "" {
+		return "", models.UserSubscription{}, false
+	}
+	session, sub, err := resolveSessionToken(c, token)
+	if err != nil {
+		return "", sub, false
+	}
+	return "session:" + session.SessionID, sub, true
+}
+
+func planLabel(plan string) string {
+	if plan == "" {
+		return defaultPlan
+	}
+	return plan
+}
+
+func ceilSeconds(d time.Duration) int {
+	if d <= 0 {
+		return 0
+	}
+	return int(math.Ceil(d.Seconds()))
+}
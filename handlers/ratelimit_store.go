@@ -0,0 +1,267 @@
+package handlers
+
+import (
+	"log"
+	"math"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"genfity-wa-support/database"
+	"genfity-wa-support/models"
+)
+
+// rateLimitJanitorInterval is how often expired limiter state is evicted.
+const rateLimitJanitorInterval = time.Minute
+
+// rateLimitStore holds limiter state. The in-memory store is per process; the
+// Postgres store shares counters, blocks and buckets across replicas.
+type rateLimitStore interface {
+	// IncrWindow bumps the fixed-window counter for key, starting a new window
+	// of the given length when the previous one has ended.
+	IncrWindow(key string, window time.Duration, now time.Time) (count int, windowEnd time.Time, err error)
+	Block(key string, until time.Time) error
+	BlockedUntil(key string, now time.Time) (until time.Time, blocked bool, err error)
+	TakeToken(key string, limit planRateLimit, now time.Time) (tokenResult, error)
+}
+
+type tokenResult struct {
+	Allowed    bool
+	Remaining  int
+	RetryAfter time.Duration
+	ResetAfter time.Duration
+}
+
+func newTokenResult(tokens float64, allowed bool, limit planRateLimit) tokenResult {
+	rate := float64(limit.PerMinute) / 60
+	result := tokenResult{
+		Allowed:    allowed,
+		Remaining:  int(tokens),
+		ResetAfter: time.Duration((float64(limit.Burst) - tokens) / rate * float64(time.Second)),
+	}
+	if !allowed {
+		result.RetryAfter = time.Duration((1 - tokens) / rate * float64(time.Second))
+	}
+	return result
+}
+
+// bucketRefillTime is how long an empty bucket takes to fill up, i.e. how long
+// its state stays relevant after the last request.
+func bucketRefillTime(limit planRateLimit) time.Duration {
+	return time.Duration(float64(limit.Burst) / (float64(limit.PerMinute) / 60) * float64(time.Second))
+}
+
+var (
+	rateStoreOnce sync.Once
+	rateStore     rateLimitStore
+)
+
+// getRateLimitStore picks the backend from RATE_LIMIT_BACKEND (memory|postgres).
+func getRateLimitStore() rateLimitStore {
+	rateStoreOnce.Do(func() {
+		switch strings.ToLower(strings.TrimSpace(os.Getenv("RATE_LIMIT_BACKEND"))) {
+		case "postgres":
+			rateStore = newPostgresRateLimitStore()
+		default:
+			rateStore = newMemoryRateLimitStore()
+		}
+	})
+	return rateStore
+}
+
+type rateWindow struct {
+	count     int
+	windowEnd time.Time
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+	expires time.Time
+}
+
+type memoryRateLimitStore struct {
+	mu       sync.Mutex
+	counters map[string]*rateWindow
+	blocks   map[string]time.Time
+	buckets  map[string]*tokenBucket
+}
+
+func newMemoryRateLimitStore() *memoryRateLimitStore {
+	store := &memoryRateLimitStore{
+		counters: map[string]*rateWindow{},
+		blocks:   map[string]time.Time{},
+		buckets:  map[string]*tokenBucket{},
+	}
+	go func() {
+		ticker := time.NewTicker(rateLimitJanitorInterval)
+		defer ticker.Stop()
+		for now := range ticker.C {
+			store.evictExpired(now)
+		}
+	}()
+	return store
+}
+
+func (s *memoryRateLimitStore) evictExpired(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, counter := range s.counters {
+		if now.After(counter.windowEnd) {
+			delete(s.counters, key)
+		}
+	}
+	for key, until := range s.blocks {
+		if now.After(until) {
+			delete(s.blocks, key)
+		}
+	}
+	for key, bucket := range s.buckets {
+		if now.After(bucket.expires) {
+			delete(s.buckets, key)
+		}
+	}
+}
+
+func (s *memoryRateLimitStore) IncrWindow(key string, window time.Duration, now time.Time) (int, time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	counter := s.counters[key]
+	if counter == nil || now.After(counter.windowEnd) {
+		counter = &rateWindow{count: 0, windowEnd: now.Add(window)}
+		s.counters[key] = counter
+	}
+	counter.count++
+	return counter.count, counter.windowEnd, nil
+}
+
+func (s *memoryRateLimitStore) Block(key string, until time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if current, ok := s.blocks[key]; !ok || until.After(current) {
+		s.blocks[key] = until
+	}
+	return nil
+}
+
+func (s *memoryRateLimitStore) BlockedUntil(key string, now time.Time) (time.Time, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	until, ok := s.blocks[key]
+	if !ok || !now.Before(until) {
+		return time.Time{}, false, nil
+	}
+	return until, true, nil
+}
+
+func (s *memoryRateLimitStore) TakeToken(key string, limit planRateLimit, now time.Time) (tokenResult, error) {
+	rate := float64(limit.PerMinute) / 60
+	capacity := float64(limit.Burst)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	bucket := s.buckets[key]
+	if bucket == nil {
+		bucket = &tokenBucket{tokens: capacity, updated: now}
+		s.buckets[key] = bucket
+	}
+	if elapsed := now.Sub(bucket.updated).Seconds(); elapsed > 0 {
+		bucket.tokens = math.Min(capacity, bucket.tokens+elapsed*rate)
+		bucket.updated = now
+	}
+	bucket.expires = now.Add(bucketRefillTime(limit))
+
+	allowed := bucket.tokens >= 1
+	if allowed {
+		bucket.tokens--
+	}
+	return newTokenResult(bucket.tokens, allowed, limit), nil
+}
+
+type postgresRateLimitStore struct{}
+
+func newPostgresRateLimitStore() *postgresRateLimitStore {
+	store := &postgresRateLimitStore{}
+	go func() {
+		ticker := time.NewTicker(rateLimitJanitorInterval)
+		defer ticker.Stop()
+		for now := range ticker.C {
+			if err := store.evictExpired(now); err != nil {
+				log.Printf("Rate limit janitor error: %v", err)
+			}
+		}
+	}()
+	return store
+}
+
+func (s *postgresRateLimitStore) evictExpired(now time.Time) error {
+	db := database.GetDB()
+	if err := db.Where("window_end < ?", now).Delete(&models.RateLimitCounter{}).Error; err != nil {
+		return err
+	}
+	if err := db.Where("until < ?", now).Delete(&models.RateLimitBlock{}).Error; err != nil {
+		return err
+	}
+	return db.Where("expires_at < ?", now).Delete(&models.RateLimitBucket{}).Error
+}
+
+func (s *postgresRateLimitStore) IncrWindow(key string, window time.Duration, now time.Time) (int, time.Time, error) {
+	var count int
+	var windowEnd time.Time
+	err := database.GetDB().Raw(`
+		INSERT INTO wa_rate_limit_counters (limit_key, count, window_end) VALUES (@key, 1, @end)
+		ON CONFLICT (limit_key) DO UPDATE SET
+			count = CASE WHEN wa_rate_limit_counters.window_end < @now THEN 1 ELSE wa_rate_limit_counters.count + 1 END,
+			window_end = CASE WHEN wa_rate_limit_counters.window_end < @now THEN EXCLUDED.window_end ELSE wa_rate_limit_counters.window_end END
+		RETURNING count, window_end`,
+		map[string]interface{}{"key": key, "end": now.Add(window), "now": now}).
+		Row().Scan(&count, &windowEnd)
+	return count, windowEnd, err
+}
+
+func (s *postgresRateLimitStore) Block(key string, until time.Time) error {
+	return database.GetDB().Exec(`
+		INSERT INTO wa_rate_limit_blocks (limit_key, until) VALUES (?, ?)
+		ON CONFLICT (limit_key) DO UPDATE SET until = GREATEST(wa_rate_limit_blocks.until, EXCLUDED.until)`,
+		key, until).Error
+}
+
+func (s *postgresRateLimitStore) BlockedUntil(key string, now time.Time) (time.Time, bool, error) {
+	var block models.RateLimitBlock
+	res := database.GetDB().Where("limit_key = ? AND until > ?", key, now).Limit(1).Find(&block)
+	if res.Error != nil || res.RowsAffected == 0 {
+		return time.Time{}, false, res.Error
+	}
+	return block.Until, true, nil
+}
+
+// TakeToken refills and consumes in a single upsert so concurrent replicas
+// serialize on the row lock; last_allowed carries the decision back.
+func (s *postgresRateLimitStore) TakeToken(key string, limit planRateLimit, now time.Time) (tokenResult, error) {
+	refilled := `LEAST(CAST(@cap AS double precision), wa_rate_limit_buckets.tokens + ` +
+		`GREATEST(EXTRACT(EPOCH FROM (CAST(@now AS timestamptz) - wa_rate_limit_buckets.updated_at)), 0) * CAST(@rate AS double precision))`
+	var tokens float64
+	var allowed bool
+	err := database.GetDB().Raw(`
+		INSERT INTO wa_rate_limit_buckets (limit_key, tokens, last_allowed, updated_at, expires_at)
+		VALUES (@key, CAST(@cap AS double precision) - 1, TRUE, @now, @expires)
+		ON CONFLICT (limit_key) DO UPDATE SET
+			tokens = CASE WHEN `+refilled+` >= 1 THEN `+refilled+` - 1 ELSE `+refilled+` END,
+			last_allowed = `+refilled+` >= 1,
+			updated_at = GREATEST(wa_rate_limit_buckets.updated_at, @now),
+			expires_at = @expires
+		RETURNING tokens, last_allowed`,
+		map[string]interface{}{
+			"key":     key,
+			"cap":     float64(limit.Burst),
+			"rate":    float64(limit.PerMinute) / 60,
+			"now":     now,
+			"expires": now.Add(bucketRefillTime(limit)),
+		}).Row().Scan(&tokens, &allowed)
+	if err != nil {
+		return tokenResult{}, err
+	}
+	return newTokenResult(tokens, allowed, limit), nil
+}
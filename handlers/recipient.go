@@ -0,0 +1,182 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// recipientPeekBytes is how much of a /session/connect body is buffered
+	// to rewrite its subscription.
+	recipientPeekBytes = 64 << 10
+
+	userJIDServer = "s.whatsapp.net"
+
+	minPhoneDigits = 8
+	maxPhoneDigits = 15
+)
+
+// passthroughJIDServers address groups, channels and other non-phone targets
+// that are forwarded without number validation.
+var passthroughJIDServers = map[string]bool{
+	"g.us":       true,
+	"newsletter": true,
+	"broadcast":  true,
+	"lid":        true,
+}
+
+// recipientKeys are the JSON fields genfity-wa and common clients use for the
+// send target, in lookup order; keys match case-insensitively.
+var recipientKeys = []string{"Phone", "to", "number", "jid"}
+
+// recipientError explains why a recipient was rejected before sending.
+type recipientError struct {
+	Recipient string
+	Reason    string
+}
+
+func (e *recipientError) Error() string {
+	return "invalid recipient: " + e.Reason
+}
+
+func respondInvalidRecipient(c *gin.Context, err error) {
+	setResponseCode(c, codeInvalidRecipient)
+	var invalid *recipientError
+	if !errors.As(err, &invalid) {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"message": err.Error()})
+		return
+	}
+	c.JSON(http.StatusUnprocessableEntity, gin.H{"message": invalid.Error(), "recipient": invalid.Recipient})
+}
+
+type multiReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+func defaultCountryCode() string {
+	code := strings.TrimPrefix(strings.TrimSpace(os.Getenv("DEFAULT_COUNTRY_CODE")), "+")
+	if code == "" {
+		return "62"
+	}
+	return code
+}
+
+// normalizeRecipient turns the ways customers write a target into what the
+// provider accepts: phone numbers become E.164 digits without "+", user JIDs
+// become <digits>@s.whatsapp.net, and group/channel JIDs pass through.
+// A leading 0 is replaced with DEFAULT_COUNTRY_CODE; other numbers must
+// already include their country code.
+func normalizeRecipient(raw string) (string, error) {
+	value := strings.TrimSpace(raw)
+	if value == "" {
+		return "", &recipientError{Recipient: raw, Reason: "recipient is empty"}
+	}
+
+	if at := strings.LastIndex(value, "@"); at >= 0 {
+		local, server := value[:at], strings.ToLower(value[at+1:])
+		if passthroughJIDServers[server] {
+			if local == "" {
+				return "", &recipientError{Recipient: raw, Reason: "JID has no user part"}
+			}
+			return local + "@" + server, nil
+		}
+		if server != userJIDServer && server != "c.us" {
+			return "", &recipientError{Recipient: raw, Reason: fmt.Sprintf("unsupported JID server %q", server)}
+		}
+		// Drop the device suffix of JIDs such as 628xx:12@s.whatsapp.net.
+		phone, err := normalizePhone(strings.Split(local, ":")[0], raw)
+		if err != nil {
+			return "", err
+		}
+		return phone + "@" + userJIDServer, nil
+	}
+
+	return normalizePhone(value, raw)
+}
+
+func normalizePhone(value, raw string) (string, error) {
+	var digits strings.Builder
+	international := false
+	for i, r := range value {
+		switch {
+		case r >= '0' && r <= '9':
+			digits.WriteRune(r)
+		case r == '+' && i == 0:
+			international = true
+		case r == ' ' || r == '-' || r == '.' || r == '(' || r == ')':
+		default:
+			return "", &recipientError{Recipient: raw, Reason: fmt.Sprintf("unexpected character %q in phone number", r)}
+		}
+	}
+
+	number := digits.String()
+	switch {
+	case international:
+	case strings.HasPrefix(number, "00"):
+		number = strings.TrimPrefix(number, "00")
+	case strings.HasPrefix(number, "0"):
+		number = defaultCountryCode() + strings.TrimPrefix(number, "0")
+	}
+
+	if strings.HasPrefix(number, "0") {
+		return "", &recipientError{Recipient: raw, Reason: "country code cannot start with 0"}
+	}
+	if len(number) < minPhoneDigits {
+		return "", &recipientError{Recipient: raw, Reason: "phone number is too short"}
+	}
+	if len(number) > maxPhoneDigits {
+		return "", &recipientError{Recipient: raw, Reason: "phone number is longer than 15 digits"}
+	}
+	return number, nil
+}
+
+// payloadRecipientKey finds the recipient field of a send payload. Keys
+// match case-insensitively, like the provider's JSON decoder; two spellings
+// of the same key with different values are rejected rather than guessed.
+func payloadRecipientKey(payload map[string]interface{}) (string, error) {
+	for _, want := range recipientKeys {
+		found := ""
+		for key, value := range payload {
+			if !strings.EqualFold(key, want) {
+				continue
+			}
+			if _, ok := value.(string); !ok {
+				return "", &recipientError{Recipient: fmt.Sprint(value), Reason: fmt.Sprintf("%s must be a string", key)}
+			}
+			if found != "" && payload[found] != value {
+				return "", &recipientError{Recipient: value.(string), Reason: fmt.Sprintf("conflicting %s and %s fields", found, key)}
+			}
+			found = key
+		}
+		if found != "" && payload[found] != "" {
+			return found, nil
+		}
+	}
+	return "", nil
+}
+
+// normalizePayloadRecipient rewrites the recipient field of a send payload in
+// place and returns the normalized value, or "" when there is none.
+func normalizePayloadRecipient(payload map[string]interface{}) (string, error) {
+	key, err := payloadRecipientKey(payload)
+	if err != nil || key == "" {
+		return "", err
+	}
+	normalized, err := normalizeRecipient(payload[key].(string))
+	if err != nil {
+		return "", err
+	}
+	for other := range payload {
+		if strings.EqualFold(other, key) {
+			payload[other] = normalized
+		}
+	}
+	return normalized, nil
+}
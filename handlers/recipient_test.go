@@ -0,0 +1,90 @@
+package handlers
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestNormalizeRecipient(t *testing.T) {
+	t.Setenv("DEFAULT_COUNTRY_CODE", "")
+	for _, tc := range []struct {
+		raw, want string
+	}{
+		{"628123456789", "628123456789"},
+		{"+62 812-3456-789", "628123456789"},
+		{"(0812) 3456.789", "628123456789"},
+		{"0062812345678", "62812345678"},
+		{"628123456789@s.whatsapp.net", "628123456789@s.whatsapp.net"},
+		{"628123456789:12@S.WhatsApp.Net", "628123456789@s.whatsapp.net"},
+		{"628123456789@c.us", "628123456789@s.whatsapp.net"},
+		{"120363021234567890@g.us", "120363021234567890@g.us"},
+		{"120363021234567890@newsletter", "120363021234567890@newsletter"},
+		{"status@broadcast", "status@broadcast"},
+		{"  628123456789  ", "628123456789"},
+	} {
+		got, err := normalizeRecipient(tc.raw)
+		if err != nil {
+			t.Errorf("normalizeRecipient(%q): %v", tc.raw, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("normalizeRecipient(%q) = %q, want %q", tc.raw, got, tc.want)
+		}
+	}
+}
+
+func TestNormalizeRecipientDefaultCountryCode(t *testing.T) {
+	t.Setenv("DEFAULT_COUNTRY_CODE", "+60")
+	got, err := normalizeRecipient("012-345 6789")
+	if err != nil || got != "60123456789" {
+		t.Fatalf("normalizeRecipient = %q, %v, want 60123456789", got, err)
+	}
+}
+
+func TestNormalizeRecipientRejects(t *testing.T) {
+	t.Setenv("DEFAULT_COUNTRY_CODE", "")
+	for _, raw := range []string{
+		"",
+		"   ",
+		"@g.us",
+		"628123456789@example.com",
+		"62812abc456",
+		"62+8123456789",
+		"+0812345678",
+		"1234567",
+		"1234567890123456",
+		"abc@s.whatsapp.net",
+	} {
+		_, err := normalizeRecipient(raw)
+		var invalid *recipientError
+		if !errors.As(err, &invalid) {
+			t.Errorf("normalizeRecipient(%q) err = %v, want recipientError", raw, err)
+		}
+	}
+}
+
+func TestPayloadRecipientKey(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		payload map[string]interface{}
+		want    string
+		wantErr bool
+	}{
+		{"phone", map[string]interface{}{"Phone": "1", "Body": "x"}, "Phone", false},
+		{"lookup order", map[string]interface{}{"to": "1", "Phone": "2"}, "Phone", false},
+		{"case-insensitive", map[string]interface{}{"JID": "1"}, "JID", false},
+		{"empty falls through", map[string]interface{}{"Phone": "", "to": "1"}, "to", false},
+		{"none", map[string]interface{}{"Body": "x"}, "", false},
+		{"conflicting spellings", map[string]interface{}{"Phone": "1", "phone": "2"}, "", true},
+		{"not a string", map[string]interface{}{"Phone": 628123456789.0}, "", true},
+	} {
+		got, err := payloadRecipientKey(tc.payload)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%s: err = %v, wantErr %v", tc.name, err, tc.wantErr)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("%s: key = %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,409 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"genfity-wa-support/database"
+	"genfity-wa-support/models"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	driftOrphan   = "orphan"
+	driftMissing  = "missing"
+	driftMismatch = "mismatch"
+
+	reconcileAdopt         = "adopt"
+	reconcileDeleteOrphans = "delete_orphans"
+	reconcileMarkMissing   = "mark_missing"
+)
+
+// reconcileDrift is one difference between wa_sessions and a provider node.
+// Orphans exist only at the provider, missing sessions only locally, and
+// mismatches exist on both sides with different identity or state.
+type reconcileDrift struct {
+	Kind        string     `json:"kind"`
+	Provider    string     `json:"provider"`
+	NodeID      string     `json:"node_id"`
+	SessionID   string     `json:"session_id"`
+	UserID      string     `json:"user_id,omitempty"`
+	Name        string     `json:"name,omitempty"`
+	Fields      []string   `json:"fields,omitempty"`
+	FirstSeenAt *time.Time `json:"first_seen_at,omitempty"`
+	Action      string     `json:"action,omitempty"`
+	Error       string     `json:"error,omitempty"`
+
+	local  *models.WhatsAppSession
+	remote *providerSession
+}
+
+type reconcileNodeResult struct {
+	Provider string `json:"provider"`
+	NodeID   string `json:"node_id"`
+	Sessions int    `json:"sessions"`
+	Error    string `json:"error,omitempty"`
+}
+
+type reconcileReport struct {
+	StartedAt  time.Time             `json:"started_at"`
+	FinishedAt time.Time             `json:"finished_at"`
+	Modes      []string              `json:"modes"`
+	Nodes      []reconcileNodeResult `json:"nodes"`
+	Summary    map[string]int        `json:"summary"`
+	Drift      []reconcileDrift      `json:"drift"`
+}
+
+// lastReconcile is kept per process: GET /internal/reconcile returns the
+// latest run of the instance that serves it. Orphan first-seen times are
+// stored in wa_reconcile_orphans, so the delete grace holds across instances.
+var (
+	reconcileMu   sync.Mutex
+	lastReconcile *reconcileReport
+)
+
+// parseReconcileModes accepts a comma-separated list of fix modes.
+func parseReconcileModes(raw string) ([]string, error) {
+	modes := []string{}
+	for _, part := range strings.Split(raw, ",") {
+		mode := strings.TrimSpace(part)
+		if mode == "" {
+			continue
+		}
+		switch mode {
+		case reconcileAdopt, reconcileDeleteOrphans, reconcileMarkMissing:
+			modes = append(modes, mode)
+		default:
+			return nil, fmt.Errorf("unknown reconcile mode %q", mode)
+		}
+	}
+	return modes, nil
+}
+
+// StartSessionReconciler diffs wa_sessions against every provider node each
+// RECONCILE_INTERVAL_MINUTES, applying the fix modes in RECONCILE_AUTO_FIX.
+func StartSessionReconciler() {
+	minutes := getEnvInt("RECONCILE_INTERVAL_MINUTES", 15)
+	if minutes <= 0 {
+		return
+	}
+	modes, err := parseReconcileModes(os.Getenv("RECONCILE_AUTO_FIX"))
+	if err != nil {
+		log.Printf("Session reconciler disabled: %v", err)
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(time.Duration(minutes) * time.Minute)
+		defer ticker.Stop()
+		for range ticker.C {
+			report := runReconcile(modes)
+			if n := len(report.Drift); n > 0 {
+				log.Printf("Session reconciler found %d drift(s): %v", n, report.Summary)
+			}
+		}
+	}()
+}
+
+// runReconcile lists sessions on every node before loading wa_sessions, so
+// a session created in between shows up locally rather than as an orphan.
+func runReconcile(modes []string) reconcileReport {
+	reconcileMu.Lock()
+	defer reconcileMu.Unlock()
+
+	report := reconcileReport{StartedAt: time.Now(), Modes: modes, Summary: map[string]int{}, Drift: []reconcileDrift{}}
+	db := database.GetDB()
+
+	var nodes []models.ProviderNode
+	if err := db.Order("provider asc, id asc").Find(&nodes).Error; err != nil {
+		report.Nodes = []reconcileNodeResult{{Error: "failed to list nodes: " + err.Error()}}
+		report.FinishedAt = time.Now()
+		lastReconcile = &report
+		return report
+	}
+
+	type remoteKey struct{ nodeID, sessionID string }
+	remote := map[remoteKey]*providerSession{}
+	remoteNode := map[*providerSession]models.ProviderNode{}
+	byToken := map[string]*providerSession{}
+	listed := map[string]bool{}
+	for _, node := range nodes {
+		result := reconcileNodeResult{Provider: node.Provider, NodeID: node.ID}
+		provider, err := providerFor(node.Provider)
+		var sessions []providerSession
+		if err == nil {
+			sessions, err = provider.ListSessions(node)
+		}
+		if err != nil {
+			result.Error = err.Error()
+			report.Nodes = append(report.Nodes, result)
+			continue
+		}
+		listed[node.ID] = true
+		result.Sessions = len(sessions)
+		report.Nodes = append(report.Nodes, result)
+		for i := range sessions {
+			s := &sessions[i]
+			remote[remoteKey{node.ID, s.SessionID}] = s
+			remoteNode[s] = node
+			if s.Token != "" {
+				byToken[hashAPIKey(s.Token)] = s
+			}
+		}
+	}
+
+	var locals []models.WhatsAppSession
+	if err := db.Find(&locals).Error; err != nil {
+		report.Nodes = append(report.Nodes, reconcileNodeResult{Error: "failed to load sessions: " + err.Error()})
+		report.FinishedAt = time.Now()
+		lastReconcile = &report
+		return report
+	}
+
+	matched := map[*providerSession]bool{}
+	for i := range locals {
+		local := &locals[i]
+		nodeID := sessionNodeID(*local)
+		match := remote[remoteKey{nodeID, local.SessionID}]
+		if match == nil && local.TokenHash != "" {
+			match = byToken[local.TokenHash]
+		}
+		if match == nil {
+			if !listed[nodeID] {
+				continue
+			}
+			report.Drift = append(report.Drift, reconcileDrift{
+				Kind: driftMissing, Provider: local.Provider, NodeID: nodeID,
+				SessionID: local.SessionID, UserID: local.UserID, Name: local.SessionName, local: local,
+			})
+			continue
+		}
+		matched[match] = true
+		if fields := sessionDriftFields(*local, *match, remoteNode[match]); len(fields) > 0 {
+			report.Drift = append(report.Drift, reconcileDrift{
+				Kind: driftMismatch, Provider: remoteNode[match].Provider, NodeID: remoteNode[match].ID,
+				SessionID: match.SessionID, UserID: local.UserID, Name: local.SessionName, Fields: fields,
+				local: local, remote: match,
+			})
+		}
+	}
+
+	for s, node := range remoteNode {
+		if matched[s] {
+			continue
+		}
+		first := orphanFirstSeen(db, node.ID, s.SessionID)
+		report.Drift = append(report.Drift, reconcileDrift{
+			Kind: driftOrphan, Provider: node.Provider, NodeID: node.ID,
+			SessionID: s.SessionID, Name: s.Name, FirstSeenAt: &first, remote: s,
+		})
+	}
+	forgetResolvedOrphans(db, listed, report.Drift)
+
+	for i := range report.Drift {
+		applyReconcileFix(&report.Drift[i], modes, remoteNode)
+		report.Summary[report.Drift[i].Kind]++
+		if report.Drift[i].Action != "" {
+			report.Summary[report.Drift[i].Action]++
+		}
+	}
+
+	report.FinishedAt = time.Now()
+	lastReconcile = &report
+	return report
+}
+
+// orphanFirstSeen returns when an orphan was first seen, recording now if it
+// is new. A session the provider created a moment before our row was
+// committed is therefore never deleted as an orphan on its first sighting.
+func orphanFirstSeen(db *gorm.DB, nodeID, sessionID string) time.Time {
+	row := models.ReconcileOrphan{NodeID: nodeID, SessionID: sessionID, FirstSeenAt: time.Now()}
+	if err := db.Clauses(clause.OnConflict{DoNothing: true}).Create(&row).Error; err != nil {
+		log.Printf("Failed to record orphan %s/%s: %v", nodeID, sessionID, err)
+		return row.FirstSeenAt
+	}
+	var stored models.ReconcileOrphan
+	if err := db.Where("node_id = ? AND session_id = ?", nodeID, sessionID).First(&stored).Error; err != nil {
+		return row.FirstSeenAt
+	}
+	return stored.FirstSeenAt
+}
+
+// forgetResolvedOrphans drops first-seen rows for sessions that are no
+// longer orphans on a node listed in this run. Nodes that failed to list
+// keep theirs, so a flaky node does not restart the grace period.
+func forgetResolvedOrphans(db *gorm.DB, listed map[string]bool, drift []reconcileDrift) {
+	current := map[string]bool{}
+	for _, d := range drift {
+		if d.Kind == driftOrphan {
+			current[d.NodeID+"/"+d.SessionID] = true
+		}
+	}
+	var known []models.ReconcileOrphan
+	if err := db.Find(&known).Error; err != nil {
+		log.Printf("Failed to load reconcile orphans: %v", err)
+		return
+	}
+	for _, o := range known {
+		if listed[o.NodeID] && !current[o.NodeID+"/"+o.SessionID] {
+			db.Where("node_id = ? AND session_id = ?", o.NodeID, o.SessionID).Delete(&models.ReconcileOrphan{})
+		}
+	}
+}
+
+// sessionDriftFields lists what the local row gets wrong about the
+// provider's session.
+func sessionDriftFields(local models.WhatsAppSession, remote providerSession, node models.ProviderNode) []string {
+	fields := []string{}
+	if local.Provider != node.Provider {
+		fields = append(fields, "provider")
+	}
+	if sessionNodeID(local) != node.ID {
+		fields = append(fields, "node_id")
+	}
+	if local.SessionID != remote.SessionID {
+		fields = append(fields, "session_id")
+	}
+	if remote.Token != "" && local.TokenHash != hashAPIKey(remote.Token) {
+		fields = append(fields, "session_token")
+	}
+	if remote.JID != "" && local.JID != remote.JID {
+		fields = append(fields, "jid")
+	}
+	if local.Connected != remote.Connected || local.LoggedIn != remote.LoggedIn || local.Status == sessionStatusMissing {
+		fields = append(fields, "state")
+	}
+	return fields
+}
+
+func applyReconcileFix(drift *reconcileDrift, modes []string, nodes map[*providerSession]models.ProviderNode) {
+	enabled := func(mode string) bool {
+		for _, m := range modes {
+			if m == mode {
+				return true
+			}
+		}
+		return false
+	}
+
+	var err error
+	switch {
+	case drift.Kind == driftMismatch && enabled(reconcileAdopt):
+		err = adoptProviderSession(*drift.local, *drift.remote, nodes[drift.remote])
+		drift.Action = "adopted"
+	case drift.Kind == driftMissing && enabled(reconcileMarkMissing) && drift.local.Status != sessionStatusMissing:
+		err = markSessionMissing(*drift.local)
+		drift.Action = "marked_missing"
+	case drift.Kind == driftOrphan && enabled(reconcileDeleteOrphans):
+		grace := time.Duration(getEnvInt("RECONCILE_ORPHAN_GRACE_MINUTES", 10)) * time.Minute
+		if time.Since(*drift.FirstSeenAt) < grace {
+			return
+		}
+		var provider Provider
+		if provider, err = providerFor(drift.Provider); err == nil {
+			err = provider.DeleteSession(nodes[drift.remote], drift.SessionID)
+		}
+		drift.Action = "deleted"
+	default:
+		return
+	}
+	if err != nil {
+		drift.Action = ""
+		drift.Error = err.Error()
+	}
+}
+
+// adoptProviderSession points the local row at the provider's session and
+// takes over its connection state.
+func adoptProviderSession(local models.WhatsAppSession, remote providerSession, node models.ProviderNode) error {
+	next := stateOf(local)
+	next.Connected, next.LoggedIn = remote.Connected, remote.LoggedIn
+	if remote.JID != "" {
+		next.JID = remote.JID
+	}
+	switch {
+	case remote.Connected && remote.LoggedIn:
+		next.Status = sessionStatusConnected
+	case local.Status == sessionStatusMissing:
+		next.Status = sessionStatusDisconnected
+	}
+
+	updates := map[string]interface{}{
+		"provider":   node.Provider,
+		"node_id":    node.ID,
+		"session_id": remote.SessionID,
+		"status":     next.Status,
+		"connected":  next.Connected,
+		"logged_in":  next.LoggedIn,
+		"jid":        next.JID,
+		"updated_at": time.Now(),
+	}
+	if remote.Token != "" {
+		if err := sessionTokenUpdates(updates, remote.Token); err != nil {
+			return err
+		}
+	}
+	return database.GetDB().Transaction(func(tx *gorm.DB) error {
+		if next != stateOf(local) {
+			if err := recordSessionTransition(tx, local, next, models.SessionStatusSourceReconcile, "", "adopted from provider"); err != nil {
+				return err
+			}
+		}
+		return tx.Model(&models.WhatsAppSession{}).Where("id = ?", local.ID).Updates(updates).Error
+	})
+}
+
+func markSessionMissing(local models.WhatsAppSession) error {
+	next := sessionState{Status: sessionStatusMissing, JID: local.JID}
+	return database.GetDB().Transaction(func(tx *gorm.DB) error {
+		if err := recordSessionTransition(tx, local, next, models.SessionStatusSourceReconcile, "", "not found at provider"); err != nil {
+			return err
+		}
+		return tx.Model(&models.WhatsAppSession{}).Where("id = ?", local.ID).Updates(map[string]interface{}{
+			"status":     next.Status,
+			"connected":  false,
+			"logged_in":  false,
+			"updated_at": time.Now(),
+		}).Error
+	})
+}
+
+// InternalGetReconcileReport returns the latest reconcile report, periodic
+// or on demand.
+func InternalGetReconcileReport(c *gin.Context) {
+	if _, scoped := getInternalSourceScope(c); scoped {
+		c.JSON(http.StatusForbidden, gin.H{"message": "reconcile requires a global internal key"})
+		return
+	}
+	reconcileMu.Lock()
+	report := lastReconcile
+	reconcileMu.Unlock()
+	if report == nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "no reconcile has run yet"})
+		return
+	}
+	c.JSON(http.StatusOK, report)
+}
+
+// InternalRunReconcile runs the reconciler now with ?mode=adopt,delete_orphans,mark_missing
+// (none by default: report only).
+func InternalRunReconcile(c *gin.Context) {
+	if _, scoped := getInternalSourceScope(c); scoped {
+		c.JSON(http.StatusForbidden, gin.H{"message": "reconcile requires a global internal key"})
+		return
+	}
+	modes, err := parseReconcileModes(c.Query("mode"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, runReconcile(modes))
+}
@@ -0,0 +1,75 @@
+package handlers
+
+import (
+	"reflect"
+	"testing"
+
+	"genfity-wa-support/models"
+)
+
+func TestSessionDriftFields(t *testing.T) {
+	node := models.ProviderNode{ID: "wa-2", Provider: "genfity-wa"}
+	defaultNode := models.ProviderNode{ID: models.DefaultNodeID, Provider: "genfity-wa"}
+	local := models.WhatsAppSession{
+		Provider:  "genfity-wa",
+		NodeID:    "wa-2",
+		SessionID: "s1",
+		TokenHash: hashAPIKey("tok"),
+		JID:       "628123456789@s.whatsapp.net",
+		Connected: true,
+		LoggedIn:  true,
+		Status:    sessionStatusConnected,
+	}
+	remote := providerSession{SessionID: "s1", Token: "tok", JID: "628123456789@s.whatsapp.net", Connected: true, LoggedIn: true}
+
+	for _, tc := range []struct {
+		name   string
+		local  func(*models.WhatsAppSession)
+		remote func(*providerSession)
+		node   models.ProviderNode
+		want   []string
+	}{
+		{name: "in sync", node: node, want: []string{}},
+		{name: "legacy row on default node", local: func(s *models.WhatsAppSession) { s.NodeID = "" }, node: defaultNode, want: []string{}},
+		{name: "legacy row elsewhere", local: func(s *models.WhatsAppSession) { s.NodeID = "" }, node: node, want: []string{"node_id"}},
+		{name: "other provider", local: func(s *models.WhatsAppSession) { s.Provider = "other" }, node: node, want: []string{"provider"}},
+		{name: "matched by token", remote: func(r *providerSession) { r.SessionID = "s2" }, node: node, want: []string{"session_id"}},
+		{name: "rotated token", remote: func(r *providerSession) { r.Token = "tok2" }, node: node, want: []string{"session_token"}},
+		{name: "token not listed", remote: func(r *providerSession) { r.Token = "" }, node: node, want: []string{}},
+		{name: "jid changed", remote: func(r *providerSession) { r.JID = "628999999999@s.whatsapp.net" }, node: node, want: []string{"jid"}},
+		{name: "jid not listed", remote: func(r *providerSession) { r.JID = "" }, node: node, want: []string{}},
+		{name: "disconnected", remote: func(r *providerSession) { r.Connected = false }, node: node, want: []string{"state"}},
+		{name: "marked missing", local: func(s *models.WhatsAppSession) { s.Status = sessionStatusMissing }, node: node, want: []string{"state"}},
+		{
+			name:   "several",
+			local:  func(s *models.WhatsAppSession) { s.NodeID = "wa-1" },
+			remote: func(r *providerSession) { r.LoggedIn = false; r.Token = "tok2" },
+			node:   node,
+			want:   []string{"node_id", "session_token", "state"},
+		},
+	} {
+		l, r := local, remote
+		if tc.local != nil {
+			tc.local(&l)
+		}
+		if tc.remote != nil {
+			tc.remote(&r)
+		}
+		if got := sessionDriftFields(l, r, tc.node); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: sessionDriftFields = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestParseReconcileModes(t *testing.T) {
+	modes, err := parseReconcileModes(" adopt, ,mark_missing ")
+	if err != nil || !reflect.DeepEqual(modes, []string{reconcileAdopt, reconcileMarkMissing}) {
+		t.Fatalf("parseReconcileModes = %v, %v", modes, err)
+	}
+	if modes, err := parseReconcileModes(""); err != nil || len(modes) != 0 {
+		t.Fatalf("parseReconcileModes(\"\") = %v, %v, want none", modes, err)
+	}
+	if _, err := parseReconcileModes("adopt,delete_all"); err == nil {
+		t.Fatal("parseReconcileModes accepted an unknown mode")
+	}
+}
@@ -0,0 +1,256 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"genfity-wa-support/database"
+	"genfity-wa-support/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+type scheduleMessageRequest struct {
+	Type    string                 `json:"type" binding:"required"`
+	Payload map[string]interface{} `json:"payload" binding:"required"`
+	SendAt  time.Time              `json:"send_at" binding:"required"`
+}
+
+const (
+	scheduledDispatchInterval = 15 * time.Second
+	scheduledDispatchBatch    = 50
+	// scheduledSendingTimeout fails messages left in "sending" by a crashed
+	// dispatcher instead of risking a duplicate send. It counts from the
+	// start of each message's own send.
+	scheduledSendingTimeout = 10 * time.Minute
+)
+
+func CreateScheduledMessage(c *gin.Context) {
+	user := c.MustGet("user").(models.ServiceUser)
+	sessionID := c.Param("session_id")
+	var session models.WhatsAppSession
+	if err := database.GetDB().Where("user_id = ? AND session_id = ?", user.ID, sessionID).First(&session).Error; err != nil {
+		respondError(c, http.StatusNotFound, codeSessionNotFound, "session not found")
+		return
+	}
+
+	var req scheduleMessageRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+	messageType := strings.ToLower(strings.TrimSpace(req.Type))
+	if !messageTypePattern.MatchString(messageType) {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "invalid message type"})
+		return
+	}
+	if recipient, err := normalizePayloadRecipient(req.Payload); err != nil || recipient == "" {
+		if err == nil {
+			err = &recipientError{Reason: "recipient is required"}
+		}
+		respondInvalidRecipient(c, err)
+		return
+	}
+	if !req.SendAt.After(time.Now()) {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "send_at must be in the future"})
+		return
+	}
+	if _, err := getActiveSubscription(user.ID, session.Provider); err != nil {
+		respondError(c, http.StatusForbidden, subscriptionErrorCode(err), err.Error())
+		return
+	}
+
+	id, err := generateID("sch")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "failed to generate scheduled message id"})
+		return
+	}
+	scheduled := models.ScheduledMessage{
+		ID:          id,
+		UserID:      user.ID,
+		SessionID:   sessionID,
+		MessageType: messageType,
+		Payload:     models.JSONB(req.Payload),
+		SendAt:      req.SendAt,
+		Status:      models.ScheduledMessagePending,
+	}
+	if err := database.GetDB().Create(&scheduled).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "failed to schedule message"})
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"scheduled": scheduled})
+}
+
+func ListScheduledMessages(c *gin.Context) {
+	user := c.MustGet("user").(models.ServiceUser)
+	sessionID := c.Param("session_id")
+	if !userOwnsSession(user.ID, sessionID) {
+		respondError(c, http.StatusNotFound, codeSessionNotFound, "session not found")
+		return
+	}
+
+	page := parsePositiveInt(c.DefaultQuery("page", "1"), 1)
+	limit := parsePositiveInt(c.DefaultQuery("limit", "20"), 20)
+	if limit > 100 {
+		limit = 100
+	}
+
+	query := database.GetDB().Model(&models.ScheduledMessage{}).Where("user_id = ? AND session_id = ?", user.ID, sessionID)
+	if status := strings.TrimSpace(c.Query("status")); status != "" {
+		query = query.Where("status = ?", status)
+	}
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "failed to count scheduled messages"})
+		return
+	}
+	var items []models.ScheduledMessage
+	if err := query.Order("send_at asc").Limit(limit).Offset((page - 1) * limit).Find(&items).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "failed to list scheduled messages"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"items": items,
+		"meta":  gin.H{"page": page, "limit": limit, "total": total},
+	})
+}
+
+func CancelScheduledMessage(c *gin.Context) {
+	user := c.MustGet("user").(models.ServiceUser)
+	sessionID := c.Param("session_id")
+
+	res := database.GetDB().Model(&models.ScheduledMessage{}).
+		Where("id = ? AND user_id = ? AND session_id = ? AND status = ?", c.Param("scheduled_id"), user.ID, sessionID, models.ScheduledMessagePending).
+		Updates(map[string]interface{}{"status": models.ScheduledMessageCancelled, "updated_at": time.Now()})
+	if res.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "failed to cancel scheduled message"})
+		return
+	}
+	if res.RowsAffected == 0 {
+		var count int64
+		database.GetDB().Model(&models.ScheduledMessage{}).
+			Where("id = ? AND user_id = ? AND session_id = ?", c.Param("scheduled_id"), user.ID, sessionID).
+			Count(&count)
+		if count == 0 {
+			c.JSON(http.StatusNotFound, gin.H{"message": "scheduled message not found"})
+			return
+		}
+		c.JSON(http.StatusConflict, gin.H{"message": "scheduled message is no longer pending"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "cancelled"})
+}
+
+// StartScheduledMessageDispatcher sends due scheduled messages. Subscription,
+// policy and quota are checked at dispatch time, not when scheduling.
+func StartScheduledMessageDispatcher() {
+	go func() {
+		ticker := time.NewTicker(scheduledDispatchInterval)
+		defer ticker.Stop()
+
+		for now := range ticker.C {
+			err := database.GetDB().Model(&models.ScheduledMessage{}).
+				Where("status = ? AND updated_at < ?", models.ScheduledMessageSending, now.Add(-scheduledSendingTimeout)).
+				Updates(map[string]interface{}{"status": models.ScheduledMessageFailed, "last_error": "dispatch interrupted"}).Error
+			if err != nil {
+				log.Printf("Scheduled message sweeper error: %v", err)
+			}
+
+			// Claim one row right before sending it, so its claim time is
+			// its send start and the sweeper above never fails a row that
+			// is still queued behind others in the batch.
+			for i := 0; i < scheduledDispatchBatch; i++ {
+				scheduled, ok := claimDueScheduledMessage(now)
+				if !ok {
+					break
+				}
+				dispatchScheduledMessage(scheduled)
+			}
+		}
+	}()
+}
+
+func claimDueScheduledMessage(due time.Time) (models.ScheduledMessage, bool) {
+	var claimed []models.ScheduledMessage
+	err := database.GetDB().Raw(`
+		UPDATE wa_scheduled_messages
+		SET status = @sending, updated_at = @now
+		WHERE id IN (
+			SELECT id FROM wa_scheduled_messages
+			WHERE status = @pending AND send_at <= @due
+			ORDER BY send_at
+			LIMIT 1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING *`,
+		map[string]interface{}{
+			"sending": models.ScheduledMessageSending,
+			"pending": models.ScheduledMessagePending,
+			"due":     due,
+			"now":     time.Now(),
+		}).Scan(&claimed).Error
+	if err != nil {
+		log.Printf("Scheduled message claim error: %v", err)
+		return models.ScheduledMessage{}, false
+	}
+	if len(claimed) == 0 {
+		return models.ScheduledMessage{}, false
+	}
+	return claimed[0], true
+}
+
+func dispatchScheduledMessage(scheduled models.ScheduledMessage) {
+	now := time.Now()
+	updates := map[string]interface{}{"dispatched_at": now, "updated_at": now}
+
+	var session models.WhatsAppSession
+	if err := database.GetDB().Where("user_id = ? AND session_id = ?", scheduled.UserID, scheduled.SessionID).First(&session).Error; err != nil {
+		updates["status"] = models.ScheduledMessageFailed
+		updates["last_error"] = "session not found"
+		finishScheduledMessage(scheduled, updates)
+		return
+	}
+
+	status, body, err := dispatchSessionMessage(session, scheduled.MessageType, scheduled.Payload)
+	success := err == nil && status >= 200 && status < 300
+	var rejection *sendRejection
+	if !errors.As(err, &rejection) {
+		recordSendOutcome(session, sendRecord{
+			MessageType: scheduled.MessageType,
+			Recipient:   payloadRecipient(scheduled.Payload),
+			Source:      ledgerSourceScheduled,
+			HTTPStatus:  status,
+			Body:        body,
+			Success:     success,
+		})
+	}
+
+	updates["response_status"] = status
+	updates["response_body"] = string(body)
+	switch {
+	case success:
+		updates["status"] = models.ScheduledMessageSent
+	case errors.As(err, &rejection):
+		updates["status"] = models.ScheduledMessageFailed
+		updates["last_error"] = rejection.Message
+	case err != nil:
+		updates["status"] = models.ScheduledMessageFailed
+		updates["last_error"] = err.Error()
+	default:
+		updates["status"] = models.ScheduledMessageFailed
+		updates["last_error"] = fmt.Sprintf("upstream returned %d", status)
+	}
+	finishScheduledMessage(scheduled, updates)
+}
+
+func finishScheduledMessage(scheduled models.ScheduledMessage, updates map[string]interface{}) {
+	if err := database.GetDB().Model(&models.ScheduledMessage{}).Where("id = ?", scheduled.ID).Updates(updates).Error; err != nil {
+		log.Printf("Scheduled message %s update error: %v", scheduled.ID, err)
+	}
+}
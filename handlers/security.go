@@ -5,12 +5,12 @@ import (
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/hex"
+	"log"
 	"net"
 	"net/http"
 	"os"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 
 	"genfity-wa-support/database"
@@ -19,21 +19,6 @@ import (
 	"github.com/gin-gonic/gin"
 )
 
-type rateWindow struct {
-	count     int
-	windowEnd time.Time
-}
-
-type blockedIP struct {
-	until time.Time
-}
-
-var (
-	rateMutex       sync.Mutex
-	rateCounters    = map[string]*rateWindow{}
-	blockedIPCaches = map[string]*blockedIP{}
-)
-
 func hashAPIKey(raw string) string {
 	h := sha256.Sum256([]byte(raw))
 	return hex.EncodeToString(h[:])
@@ -48,6 +33,15 @@ func generateAPIKey(prefix string) (raw string, hashed string, err error) {
 	return raw, hashAPIKey(raw), nil
 }
 
+// generateID returns a random opaque identifier such as "job_3f9a...".
+func generateID(prefix string) (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return prefix + "_" + hex.EncodeToString(buf), nil
+}
+
 func InternalAPIKeyMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		keys := strings.Split(os.Getenv("INTERNAL_API_KEYS"), ",")
@@ -105,7 +99,7 @@ func CustomerAPIKeyMiddleware() gin.HandlerFunc {
 		hashed := hashAPIKey(apiKey)
 		var user models.ServiceUser
 		if err := database.GetDB().Where("customer_api_key = ?", hashed).First(&user).Error; err != nil {
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"message": "invalid api key"})
+			abortWithError(c, http.StatusUnauthorized, codeInvalidAPIKey, "invalid api key")
 			return
 		}
 
@@ -124,6 +118,7 @@ func PublicRateLimiter() gin.HandlerFunc {
 	maxPerWindow := getEnvInt("PUBLIC_RATE_LIMIT_MAX_REQUEST", 120)
 	spam10s := getEnvInt("PUBLIC_SPAM_MAX_PER_10S", 40)
 	blockMinutes := getEnvInt("PUBLIC_SPAM_BLOCK_MINUTES", 10)
+	store := getRateLimitStore()
 
 	return func(c *gin.Context) {
 		if strings.HasPrefix(c.Request.URL.Path, "/internal/") {
@@ -133,44 +128,48 @@ func PublicRateLimiter() gin.HandlerFunc {
 
 		ip := clientIP(c)
 		now := time.Now()
-		rateMutex.Lock()
 
-		if blocked, ok := blockedIPCaches[ip]; ok && now.Before(blocked.until) {
-			rateMutex.Unlock()
+		// Limiter backend failures fail open: availability over strictness.
+		until, blocked, err := store.BlockedUntil("ip:"+ip, now)
+		if err != nil {
+			log.Printf("Rate limiter unavailable: %v", err)
+			c.Next()
+			return
+		}
+		if blocked {
+			c.Header("Retry-After", strconv.Itoa(ceilSeconds(until.Sub(now))))
 			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"message": "ip blocked due to spam"})
 			return
 		}
 
-		globalKey := "global:" + ip
-		counter := rateCounters[globalKey]
-		if counter == nil || now.After(counter.windowEnd) {
-			counter = &rateWindow{count: 0, windowEnd: now.Add(time.Duration(windowSeconds) * time.Second)}
-			rateCounters[globalKey] = counter
+		count, windowEnd, err := store.IncrWindow("global:"+ip, time.Duration(windowSeconds)*time.Second, now)
+		if err != nil {
+			log.Printf("Rate limiter unavailable: %v", err)
+			c.Next()
+			return
 		}
-		counter.count++
-
-		spamKey := "spam:" + ip
-		spamCounter := rateCounters[spamKey]
-		if spamCounter == nil || now.After(spamCounter.windowEnd) {
-			spamCounter = &rateWindow{count: 0, windowEnd: now.Add(10 * time.Second)}
-			rateCounters[spamKey] = spamCounter
+		spamCount, _, err := store.IncrWindow("spam:"+ip, 10*time.Second, now)
+		if err != nil {
+			log.Printf("Rate limiter unavailable: %v", err)
+			c.Next()
+			return
 		}
-		spamCounter.count++
 
-		if spamCounter.count > spam10s {
-			blockedIPCaches[ip] = &blockedIP{until: now.Add(time.Duration(blockMinutes) * time.Minute)}
-			rateMutex.Unlock()
+		if spamCount > spam10s {
+			if err := store.Block("ip:"+ip, now.Add(time.Duration(blockMinutes)*time.Minute)); err != nil {
+				log.Printf("Rate limiter failed to block %s: %v", ip, err)
+			}
+			c.Header("Retry-After", strconv.Itoa(blockMinutes*60))
 			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"message": "spam detected"})
 			return
 		}
 
-		if counter.count > maxPerWindow {
-			rateMutex.Unlock()
+		if count > maxPerWindow {
+			c.Header("Retry-After", strconv.Itoa(ceilSeconds(windowEnd.Sub(now))))
 			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"message": "rate limit exceeded"})
 			return
 		}
 
-		rateMutex.Unlock()
 		c.Next()
 	}
 }
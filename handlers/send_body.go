@@ -0,0 +1,254 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// maxScannedTokenBytes bounds what the send body scanner keeps of a key
+	// or recipient value; no valid recipient key or value comes close.
+	maxScannedTokenBytes = 512
+	// defaultSendBodyMaxBytes bounds the part of a /chat/send body that is
+	// buffered while looking for its recipient. The rest is streamed.
+	defaultSendBodyMaxBytes = 32 << 20
+	sendBodyReadBuffer      = 32 << 10
+)
+
+var errSendBodyTooLarge = errors.New("send body is too large before its recipient field")
+
+// sendBodyScanner is a minimal streaming JSON lexer for /chat/send bodies.
+// It follows strings and nesting only far enough to see top-level keys, so
+// a body of any size is checked byte by byte without holding it in memory.
+// Malformed JSON is not diagnosed: the provider rejects it before sending.
+type sendBodyScanner struct {
+	offset      int
+	stack       []byte
+	closed      bool
+	inString    bool
+	escape      bool
+	expectKey   bool
+	expectValue bool
+
+	readingKey   bool
+	readingValue bool
+	raw          []byte
+	overflow     bool
+	pendingKey   string
+
+	// Set once the first recipient field has been read.
+	found      bool
+	value      string
+	valueStart int
+	valueEnd   int
+}
+
+func isRecipientKey(key string) bool {
+	for _, want := range recipientKeys {
+		if strings.EqualFold(key, want) {
+			return true
+		}
+	}
+	return false
+}
+
+// step consumes one byte and reports whether it completed the recipient
+// value. After that, any further top-level recipient key is an error: the
+// provider would let the later one win over the value that was checked.
+func (s *sendBodyScanner) step(c byte) (bool, error) {
+	s.offset++
+	if s.inString {
+		if s.readingKey || s.readingValue {
+			if len(s.raw) < maxScannedTokenBytes {
+				s.raw = append(s.raw, c)
+			} else {
+				s.overflow = true
+			}
+		}
+		if s.escape {
+			s.escape = false
+			return false, nil
+		}
+		switch c {
+		case '\\':
+			s.escape = true
+		case '"':
+			s.inString = false
+			if s.readingKey {
+				return false, s.endKey()
+			}
+			if s.readingValue {
+				return true, s.endValue()
+			}
+		}
+		return false, nil
+	}
+
+	switch c {
+	case ' ', '\t', '\n', '\r':
+		return false, nil
+	}
+	if len(s.stack) == 0 {
+		if s.closed {
+			// The provider's decoder stops after the first value.
+			return false, nil
+		}
+		if c != '{' {
+			return false, &recipientError{Reason: "send body must be a JSON object"}
+		}
+		s.stack = append(s.stack, c)
+		s.expectKey = true
+		return false, nil
+	}
+
+	top := len(s.stack) == 1
+	if top && s.expectValue {
+		s.expectValue = false
+		if s.pendingKey != "" {
+			key := s.pendingKey
+			s.pendingKey = ""
+			if c != '"' {
+				return false, &recipientError{Reason: fmt.Sprintf("%s must be a string", key)}
+			}
+			s.readingValue, s.raw, s.overflow = true, s.raw[:0], false
+			s.valueStart = s.offset - 1
+		}
+	}
+	switch c {
+	case '"':
+		s.inString = true
+		if top && s.expectKey {
+			s.expectKey = false
+			s.readingKey, s.raw, s.overflow = true, s.raw[:0], false
+		}
+		if s.readingKey || s.readingValue {
+			s.raw = append(s.raw, c)
+		}
+	case '{', '[':
+		s.stack = append(s.stack, c)
+	case '}', ']':
+		s.stack = s.stack[:len(s.stack)-1]
+		s.closed = len(s.stack) == 0
+	case ':':
+		s.expectValue = top
+	case ',':
+		s.expectKey = top
+	}
+	return false, nil
+}
+
+func (s *sendBodyScanner) endKey() error {
+	s.readingKey = false
+	if s.overflow {
+		return nil
+	}
+	var key string
+	if err := json.Unmarshal(s.raw, &key); err != nil || !isRecipientKey(key) {
+		return nil
+	}
+	if s.found {
+		return &recipientError{Reason: fmt.Sprintf("send body has more than one recipient field (%s)", key)}
+	}
+	s.pendingKey = key
+	return nil
+}
+
+func (s *sendBodyScanner) endValue() error {
+	s.readingValue = false
+	s.found = true
+	s.valueEnd = s.offset
+	if s.overflow {
+		return &recipientError{Reason: "recipient is too long"}
+	}
+	if err := json.Unmarshal(s.raw, &s.value); err != nil {
+		return &recipientError{Recipient: string(s.raw), Reason: "recipient is not a valid JSON string"}
+	}
+	if s.value == "" {
+		return &recipientError{Reason: "recipient is required"}
+	}
+	return nil
+}
+
+// scannedSendBody streams the rest of a send body through the scanner so a
+// second recipient field aborts the upload instead of reaching the provider.
+type scannedSendBody struct {
+	r       io.Reader
+	scanner *sendBodyScanner
+	err     error
+}
+
+func (b *scannedSendBody) Read(p []byte) (int, error) {
+	if b.err != nil {
+		return 0, b.err
+	}
+	n, err := b.r.Read(p)
+	for i := 0; i < n; i++ {
+		if _, scanErr := b.scanner.step(p[i]); scanErr != nil {
+			b.err = scanErr
+			return i, scanErr
+		}
+	}
+	return n, err
+}
+
+// normalizeSendBody buffers a /chat/send body only up to its recipient
+// field, normalizes the recipient in place and streams the rest, so media
+// uploads are not held in memory. The body is treated as JSON whatever its
+// Content-Type, since the provider decodes it as JSON regardless. A body
+// without a usable recipient is an error, so the blocklist cannot be
+// sidestepped; one with a second recipient field fails while streaming.
+func normalizeSendBody(c *gin.Context) (string, error) {
+	if c.Request.Body == nil {
+		return "", &recipientError{Reason: "recipient is required"}
+	}
+	limit := getEnvInt("SEND_BODY_MAX_BYTES", defaultSendBodyMaxBytes)
+	original := c.Request.Body
+	reader := bufio.NewReaderSize(original, sendBodyReadBuffer)
+	scanner := &sendBodyScanner{}
+	var prefix bytes.Buffer
+	for !scanner.found {
+		b, err := reader.ReadByte()
+		if err == io.EOF {
+			return "", &recipientError{Reason: "recipient is required"}
+		}
+		if err != nil {
+			return "", err
+		}
+		if prefix.Len() >= limit {
+			return "", errSendBodyTooLarge
+		}
+		prefix.WriteByte(b)
+		if _, err := scanner.step(b); err != nil {
+			return "", err
+		}
+	}
+
+	normalized, err := normalizeRecipient(scanner.value)
+	if err != nil {
+		return "", err
+	}
+	head := prefix.Bytes()
+	if normalized != scanner.value {
+		encoded, _ := json.Marshal(normalized)
+		rewritten := make([]byte, 0, len(head)+len(encoded))
+		rewritten = append(rewritten, head[:scanner.valueStart]...)
+		rewritten = append(rewritten, encoded...)
+		head = append(rewritten, head[scanner.valueEnd:]...)
+	}
+
+	rest := &scannedSendBody{r: reader, scanner: scanner}
+	c.Request.Body = multiReadCloser{Reader: io.MultiReader(bytes.NewReader(head), rest), Closer: original}
+	if c.Request.ContentLength >= 0 {
+		c.Request.ContentLength += int64(len(head) - prefix.Len())
+		c.Request.Header.Set("Content-Length", strconv.FormatInt(c.Request.ContentLength, 10))
+	}
+	return normalized, nil
+}
@@ -0,0 +1,91 @@
+package handlers
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func sendBodyContext(body string) *gin.Context {
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(http.MethodPost, "/wa/chat/send/text", strings.NewReader(body))
+	return c
+}
+
+func TestNormalizeSendBodyRewritesRecipient(t *testing.T) {
+	media := strings.Repeat("A", 1<<20)
+	for _, tc := range []struct {
+		name, body, recipient, forwarded string
+	}{
+		{"phone first", `{"Phone":"0812-3456-789","Body":"hi"}`, "628123456789", `{"Phone":"628123456789","Body":"hi"}`},
+		{"case-insensitive key", `{"phone" : "+62 812 3456 789"}`, "628123456789", `{"phone" : "628123456789"}`},
+		{"nested phone ignored", `{"Ctx":{"Phone":"1"},"to":"628123456789"}`, "628123456789", `{"Ctx":{"Phone":"1"},"to":"628123456789"}`},
+		{"escaped quotes", `{"Caption":"a \"Phone\": \"1\"","Phone":"628123456789"}`, "628123456789", `{"Caption":"a \"Phone\": \"1\"","Phone":"628123456789"}`},
+		{"escaped key", `{"Ph\u006fne":"0812-3456-789"}`, "628123456789", `{"Ph\u006fne":"628123456789"}`},
+		{"media after recipient", `{"Phone":"628123456789","Image":"` + media + `"}`, "628123456789", `{"Phone":"628123456789","Image":"` + media + `"}`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := sendBodyContext(tc.body)
+			recipient, err := normalizeSendBody(c)
+			if err != nil {
+				t.Fatalf("normalizeSendBody: %v", err)
+			}
+			if recipient != tc.recipient {
+				t.Fatalf("recipient = %q, want %q", recipient, tc.recipient)
+			}
+			forwarded, err := io.ReadAll(c.Request.Body)
+			if err != nil {
+				t.Fatalf("read forwarded body: %v", err)
+			}
+			if string(forwarded) != tc.forwarded {
+				t.Fatalf("forwarded body differs (%d bytes, want %d)", len(forwarded), len(tc.forwarded))
+			}
+			if c.Request.ContentLength != int64(len(forwarded)) {
+				t.Fatalf("ContentLength = %d, want %d", c.Request.ContentLength, len(forwarded))
+			}
+		})
+	}
+}
+
+func TestNormalizeSendBodyRejectsMissingOrInvalidRecipient(t *testing.T) {
+	for _, body := range []string{
+		``,
+		`[]`,
+		`{"Body":"hi"}`,
+		`{"Phone":""}`,
+		`{"Phone":6281234567890}`,
+		`{"Phone":{"x":"6281234567890"}}`,
+		`{"Phone":"12"}`,
+	} {
+		var invalid *recipientError
+		if _, err := normalizeSendBody(sendBodyContext(body)); !errors.As(err, &invalid) {
+			t.Errorf("normalizeSendBody(%q) err = %v, want recipientError", body, err)
+		}
+	}
+}
+
+func TestNormalizeSendBodyFailsStreamOnSecondRecipient(t *testing.T) {
+	c := sendBodyContext(`{"Phone":"628123456789","Body":"hi","PHONE":"628999999999"}`)
+	if _, err := normalizeSendBody(c); err != nil {
+		t.Fatalf("normalizeSendBody: %v", err)
+	}
+	var invalid *recipientError
+	if _, err := io.ReadAll(c.Request.Body); !errors.As(err, &invalid) {
+		t.Fatalf("read err = %v, want recipientError", err)
+	}
+}
+
+func TestNormalizeSendBodyLimitsOnlyThePrefix(t *testing.T) {
+	t.Setenv("SEND_BODY_MAX_BYTES", "64")
+	if _, err := normalizeSendBody(sendBodyContext(`{"Image":"` + strings.Repeat("A", 128) + `","Phone":"628123456789"}`)); !errors.Is(err, errSendBodyTooLarge) {
+		t.Fatalf("err = %v, want errSendBodyTooLarge", err)
+	}
+	if _, err := normalizeSendBody(sendBodyContext(`{"Phone":"628123456789","Image":"` + strings.Repeat("A", 128) + `"}`)); err != nil {
+		t.Fatalf("normalizeSendBody: %v", err)
+	}
+}
@@ -0,0 +1,180 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"genfity-wa-support/database"
+	"genfity-wa-support/models"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const pairWatchInterval = 3 * time.Second
+
+// pairWatchers holds the expiry of the single watcher polling each session
+// row; a new pairing code extends it instead of starting another poller.
+var (
+	pairWatchMu  sync.Mutex
+	pairWatchers = map[uint]time.Time{}
+)
+
+type pairSessionRequest struct {
+	Phone string `json:"phone" binding:"required"`
+}
+
+// PairSession logs a session in with a pairing code instead of a QR: the
+// customer enters the returned code under Linked devices > Link with phone
+// number on the phone given here.
+func PairSession(c *gin.Context) {
+	session, ok := userSessionFromParam(c)
+	if !ok {
+		return
+	}
+
+	var req pairSessionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+	raw := strings.TrimSpace(req.Phone)
+	if strings.Contains(raw, "@") {
+		respondError(c, http.StatusUnprocessableEntity, codeUnprocessable, "phone must be a phone number, not a JID")
+		return
+	}
+	phone, err := normalizePhone(raw, req.Phone)
+	if err != nil {
+		var invalid *recipientError
+		if errors.As(err, &invalid) {
+			respondError(c, http.StatusUnprocessableEntity, codeUnprocessable, invalid.Reason)
+			return
+		}
+		respondError(c, http.StatusUnprocessableEntity, codeUnprocessable, err.Error())
+		return
+	}
+
+	provider, err := providerFor(session.Provider)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": err.Error()})
+		return
+	}
+	node, ok := sessionNodeOrAbort(c, session)
+	if !ok {
+		return
+	}
+	token, err := sessionToken(session)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "failed to read session token"})
+		return
+	}
+
+	loggedIn, _, err := startSessionLogin(session, provider, node, token)
+	if err != nil {
+		respondProviderError(c, err)
+		return
+	}
+	if loggedIn {
+		respondError(c, http.StatusConflict, codeConflict, "session is already logged in")
+		return
+	}
+	code, err := provider.PairPhone(node, token, phone)
+	if err != nil {
+		respondProviderError(c, err)
+		return
+	}
+
+	ttl := time.Duration(getEnvInt("PAIR_CODE_TTL_SECONDS", 160)) * time.Second
+	if ttl <= 0 {
+		ttl = 160 * time.Second
+	}
+	expiresAt := time.Now().Add(ttl)
+	startPairWatch(session, provider, node, token, expiresAt)
+
+	c.JSON(http.StatusOK, gin.H{
+		"session_id":   session.SessionID,
+		"phone":        phone,
+		"pairing_code": code,
+		"expires_at":   expiresAt,
+		"expires_in":   int(ttl.Seconds()),
+	})
+}
+
+// startPairWatch runs watchPairing for the session unless one is running
+// already, in which case it only moves that watcher's expiry.
+func startPairWatch(session models.WhatsAppSession, provider Provider, node models.ProviderNode, token string, expiresAt time.Time) {
+	pairWatchMu.Lock()
+	defer pairWatchMu.Unlock()
+	_, running := pairWatchers[session.ID]
+	pairWatchers[session.ID] = expiresAt
+	if !running {
+		go watchPairing(session, provider, node, token)
+	}
+}
+
+// pairWatchExpired reports whether the session's watcher should stop, and
+// unregisters it if so.
+func pairWatchExpired(sessionID uint, now time.Time) bool {
+	pairWatchMu.Lock()
+	defer pairWatchMu.Unlock()
+	if now.After(pairWatchers[sessionID]) {
+		delete(pairWatchers, sessionID)
+		return true
+	}
+	return false
+}
+
+// watchPairing polls the provider until the code is used or expires, so
+// LoggedIn and JID are set even when the relay (and PairSuccess) is off.
+func watchPairing(session models.WhatsAppSession, provider Provider, node models.ProviderNode, token string) {
+	ticker := time.NewTicker(pairWatchInterval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		if pairWatchExpired(session.ID, now) {
+			return
+		}
+		remote, err := provider.SessionStatus(node, token)
+		if err != nil || !remote.LoggedIn {
+			continue
+		}
+		pairWatchMu.Lock()
+		delete(pairWatchers, session.ID)
+		pairWatchMu.Unlock()
+		if err := markSessionLoggedIn(session, remote.JID, "pairing code login"); err != nil {
+			log.Printf("Session %s pairing update failed: %v", session.SessionID, err)
+		}
+		return
+	}
+}
+
+func markSessionLoggedIn(session models.WhatsAppSession, jid, detail string) error {
+	return database.GetDB().Transaction(func(tx *gorm.DB) error {
+		var current models.WhatsAppSession
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("id = ?", session.ID).First(&current).Error; err != nil {
+			return err
+		}
+		next := stateOf(current)
+		next.Status, next.Connected, next.LoggedIn = sessionStatusConnected, true, true
+		if jid != "" {
+			next.JID = jid
+		}
+		if next == stateOf(current) {
+			return nil
+		}
+		if err := recordSessionTransition(tx, current, next, models.SessionStatusSourceSync, "", detail); err != nil {
+			return err
+		}
+		return tx.Model(&models.WhatsAppSession{}).Where("id = ?", current.ID).Updates(map[string]interface{}{
+			"status":     next.Status,
+			"connected":  next.Connected,
+			"logged_in":  next.LoggedIn,
+			"jid":        next.JID,
+			"updated_at": time.Now(),
+		}).Error
+	})
+}
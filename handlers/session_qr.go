@@ -0,0 +1,206 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"genfity-wa-support/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+const qrImagePrefix = "data:image/png;base64,"
+
+// decodeQRImage returns the PNG bytes and plain base64 of a provider QR.
+func decodeQRImage(code string) ([]byte, string, error) {
+	encoded := strings.TrimPrefix(code, qrImagePrefix)
+	if encoded == code {
+		return nil, "", errors.New("provider did not return a PNG QR code")
+	}
+	image, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, "", errors.New("provider returned an invalid QR image")
+	}
+	return image, encoded, nil
+}
+
+// startSessionLogin makes sure the session is connected so the provider can
+// hand out QR or pairing codes. loggedIn reports a session that needs no
+// login at all.
+func startSessionLogin(session models.WhatsAppSession, provider Provider, node models.ProviderNode, token string) (loggedIn bool, jid string, err error) {
+	remote, err := provider.SessionStatus(node, token)
+	if err != nil {
+		return false, "", err
+	}
+	if remote.LoggedIn {
+		return true, remote.JID, nil
+	}
+	if remote.Connected {
+		return false, "", nil
+	}
+	if err := provider.Connect(node, token, strings.Split(reconnectEvents(session), ",")); err != nil {
+		return false, "", err
+	}
+	// Same bookkeeping as a customer connect through /wa.
+	noteSessionCommand(session, http.MethodPost, "/session/connect", http.StatusOK)
+	return false, "", nil
+}
+
+// GetSessionQR serves the current login QR, as PNG for ?format=png or
+// Accept: image/png and as base64 JSON otherwise. The session is connected
+// first when needed.
+func GetSessionQR(c *gin.Context) {
+	session, ok := userSessionFromParam(c)
+	if !ok {
+		return
+	}
+	provider, err := providerFor(session.Provider)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, codeInternal, err.Error())
+		return
+	}
+	node, ok := sessionNodeOrAbort(c, session)
+	if !ok {
+		return
+	}
+	token, err := sessionToken(session)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, codeInternal, "failed to read session token")
+		return
+	}
+
+	loggedIn, _, err := startSessionLogin(session, provider, node, token)
+	if err != nil {
+		respondProviderError(c, err)
+		return
+	}
+	if loggedIn {
+		respondError(c, http.StatusConflict, codeConflict, "session is already logged in")
+		return
+	}
+	code, err := provider.QRCode(node, token)
+	if err != nil {
+		respondProviderError(c, err)
+		return
+	}
+	if code == "" {
+		c.Header("Retry-After", "2")
+		respondError(c, http.StatusNotFound, codeNotFound, "qr code is not ready yet, retry shortly")
+		return
+	}
+	image, encoded, err := decodeQRImage(code)
+	if err != nil {
+		respondError(c, http.StatusBadGateway, codeUpstreamError, err.Error())
+		return
+	}
+
+	c.Header("Cache-Control", "no-store")
+	format := strings.ToLower(c.Query("format"))
+	if format == "png" || (format == "" && strings.Contains(c.GetHeader("Accept"), "image/png")) {
+		c.Data(http.StatusOK, "image/png", image)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"session_id": session.SessionID,
+		"mime_type":  "image/png",
+		"qr_code":    encoded,
+		"data_url":   code,
+	})
+}
+
+// StreamSessionQR is a server-sent event stream for the login screen: a "qr"
+// event each time the provider refreshes the code, then "logged_in" once the
+// phone is paired. The stream also ends with "timeout" after
+// QR_STREAM_TIMEOUT_SECONDS or "error" when the provider is unreachable.
+func StreamSessionQR(c *gin.Context) {
+	session, ok := userSessionFromParam(c)
+	if !ok {
+		return
+	}
+	provider, err := providerFor(session.Provider)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, codeInternal, err.Error())
+		return
+	}
+	node, ok := sessionNodeOrAbort(c, session)
+	if !ok {
+		return
+	}
+	token, err := sessionToken(session)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, codeInternal, "failed to read session token")
+		return
+	}
+
+	loggedIn, jid, err := startSessionLogin(session, provider, node, token)
+	if err != nil {
+		respondProviderError(c, err)
+		return
+	}
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	send := func(event string, data gin.H) {
+		c.SSEvent(event, data)
+		c.Writer.Flush()
+	}
+	if loggedIn {
+		send("logged_in", gin.H{"session_id": session.SessionID, "jid": jid})
+		return
+	}
+
+	poll := time.Duration(getEnvInt("QR_STREAM_POLL_SECONDS", 2)) * time.Second
+	if poll <= 0 {
+		poll = 2 * time.Second
+	}
+	limit := time.Duration(getEnvInt("QR_STREAM_TIMEOUT_SECONDS", 180)) * time.Second
+	if limit <= 0 {
+		limit = 180 * time.Second
+	}
+	timeout := time.NewTimer(limit)
+	defer timeout.Stop()
+	ticker := time.NewTicker(poll)
+	defer ticker.Stop()
+
+	last := ""
+	for {
+		remote, err := provider.SessionStatus(node, token)
+		var httpErr *providerHTTPError
+		switch {
+		case err == nil && remote.LoggedIn:
+			if err := markSessionLoggedIn(session, remote.JID, "qr login"); err != nil {
+				log.Printf("Session %s qr login update failed: %v", session.SessionID, err)
+			}
+			send("logged_in", gin.H{"session_id": session.SessionID, "jid": remote.JID})
+			return
+		case err != nil && !errors.As(err, &httpErr):
+			send("error", gin.H{"message": err.Error()})
+			return
+		case err == nil:
+			// The provider answers /session/qr with an error while it is
+			// between codes; the next poll picks the new one up.
+			if code, err := provider.QRCode(node, token); err == nil && code != "" && code != last {
+				if _, encoded, err := decodeQRImage(code); err == nil {
+					last = code
+					send("qr", gin.H{"session_id": session.SessionID, "mime_type": "image/png", "qr_code": encoded, "data_url": code})
+				}
+			}
+		}
+
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case <-timeout.C:
+			send("timeout", gin.H{"session_id": session.SessionID})
+			return
+		case <-ticker.C:
+		}
+	}
+}
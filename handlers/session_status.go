@@ -0,0 +1,246 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"genfity-wa-support/database"
+	"genfity-wa-support/models"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	sessionStatusConnected    = "connected"
+	sessionStatusQRWaiting    = "qr_waiting"
+	sessionStatusDisconnected = "disconnected"
+	sessionStatusLoggedOut    = "logged_out"
+	// sessionStatusMissing is set by the reconciler when the provider no
+	// longer has the session.
+	sessionStatusMissing = "missing"
+	// sessionStatusStopped is a session the customer disconnected on
+	// purpose; the reconnect watchdog leaves it alone.
+	sessionStatusStopped         = "stopped"
+	sessionStatusReconnecting    = "reconnecting"
+	sessionStatusReconnectFailed = "reconnect_failed"
+)
+
+// sessionStatusEvents are always subscribed at the provider while the relay
+// is on, whatever the customer asked for, so session state stays current.
+// The customer's own webhook_url still only gets the events it asked for.
+var sessionStatusEvents = []string{"Connected", "Disconnected", "LoggedOut", "QR", "PairSuccess", "ConnectFailure", "StreamReplaced"}
+
+// sessionState is the part of a session that provider events change.
+type sessionState struct {
+	Status    string
+	Connected bool
+	LoggedIn  bool
+	JID       string
+}
+
+func stateOf(session models.WhatsAppSession) sessionState {
+	return sessionState{Status: session.Status, Connected: session.Connected, LoggedIn: session.LoggedIn, JID: session.JID}
+}
+
+// providerEvents is the event subscription sent to the provider for a
+// customer subscription of requested.
+func providerEvents(requested string) string {
+	if !webhookRelayEnabled() {
+		return requested
+	}
+	events := normalizeWebhookEvents(requested)
+	if events == "" {
+		return "All"
+	}
+	return normalizeWebhookEvents(events + "," + strings.Join(sessionStatusEvents, ","))
+}
+
+// sessionEventState applies a provider event to the current state. ok is
+// false for events that say nothing about the connection.
+func sessionEventState(current sessionState, eventType string, payload map[string]interface{}) (sessionState, bool) {
+	next := current
+	switch eventType {
+	case "QR":
+		next.Status, next.Connected, next.LoggedIn = sessionStatusQRWaiting, true, false
+	case "PairSuccess", "Connected":
+		next.Status, next.Connected, next.LoggedIn = sessionStatusConnected, true, true
+	case "Disconnected", "ConnectFailure", "StreamReplaced":
+		next.Connected = false
+		// Keep the flags that tell the watchdog to stay away.
+		if current.Status != sessionStatusStopped && current.Status != sessionStatusReconnectFailed {
+			next.Status = sessionStatusDisconnected
+		}
+	case "LoggedOut":
+		next.Status, next.Connected, next.LoggedIn = sessionStatusLoggedOut, false, false
+	default:
+		return current, false
+	}
+	if jid := eventJID(payload); jid != "" {
+		next.JID = jid
+	}
+	return next, true
+}
+
+// eventJID reads the account JID from the event envelope ("jid") or, for
+// PairSuccess, from the event itself.
+func eventJID(payload map[string]interface{}) string {
+	if jid, _ := payload["jid"].(string); jid != "" {
+		return jid
+	}
+	event, _ := payload["event"].(map[string]interface{})
+	jid, _ := event["ID"].(string)
+	return jid
+}
+
+// applySessionEvent updates the session's activity time for every event and
+// its connection state for status events, recording the transition.
+func applySessionEvent(session models.WhatsAppSession, eventType string, payload map[string]interface{}) {
+	now := time.Now()
+	db := database.GetDB()
+	if _, ok := sessionEventState(stateOf(session), eventType, payload); !ok {
+		if err := db.Model(&models.WhatsAppSession{}).Where("id = ?", session.ID).Update("last_activity_at", now).Error; err != nil {
+			log.Printf("Session %s activity update failed: %v", session.SessionID, err)
+		}
+		return
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var current models.WhatsAppSession
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("id = ?", session.ID).First(&current).Error; err != nil {
+			return err
+		}
+		updates := map[string]interface{}{"last_activity_at": now}
+		next, _ := sessionEventState(stateOf(current), eventType, payload)
+		if next != stateOf(current) {
+			updates["status"] = next.Status
+			updates["connected"] = next.Connected
+			updates["logged_in"] = next.LoggedIn
+			updates["jid"] = next.JID
+			updates["updated_at"] = now
+			if err := recordSessionTransition(tx, current, next, models.SessionStatusSourceEvent, eventType, ""); err != nil {
+				return err
+			}
+		}
+		return tx.Model(&models.WhatsAppSession{}).Where("id = ?", current.ID).Updates(updates).Error
+	})
+	if err != nil {
+		log.Printf("Session %s status event %s failed: %v", session.SessionID, eventType, err)
+	}
+}
+
+func recordSessionTransition(tx *gorm.DB, session models.WhatsAppSession, next sessionState, source, event, detail string) error {
+	return tx.Create(&models.SessionStatusChange{
+		UserID:        session.UserID,
+		SessionID:     session.SessionID,
+		Source:        source,
+		Event:         event,
+		FromStatus:    session.Status,
+		ToStatus:      next.Status,
+		FromConnected: session.Connected,
+		Connected:     next.Connected,
+		FromLoggedIn:  session.LoggedIn,
+		LoggedIn:      next.LoggedIn,
+		JID:           next.JID,
+		Detail:        detail,
+	}).Error
+}
+
+// subscribeStatusEvents rewrites the subscription of a /wa/session/connect
+// body so status events keep flowing while the relay is on, and stores what
+// the customer asked for as the session's own event filter.
+func subscribeStatusEvents(c *gin.Context, session models.WhatsAppSession) {
+	original := c.Request.Body
+	raw, err := io.ReadAll(io.LimitReader(original, recipientPeekBytes+1))
+	restore := func(body []byte) {
+		c.Request.Body = multiReadCloser{Reader: io.MultiReader(bytes.NewReader(body), original), Closer: original}
+	}
+	if err != nil || len(raw) > recipientPeekBytes {
+		restore(raw)
+		return
+	}
+
+	var body map[string]interface{}
+	if err := json.Unmarshal(raw, &body); err != nil || body == nil {
+		restore(raw)
+		return
+	}
+	key := "subscribe"
+	if _, ok := body["Subscribe"]; ok {
+		key = "Subscribe"
+	}
+	list, ok := body[key].([]interface{})
+	if !ok {
+		restore(raw)
+		return
+	}
+	requested := make([]string, 0, len(list))
+	for _, item := range list {
+		if event, ok := item.(string); ok {
+			requested = append(requested, event)
+		}
+	}
+
+	events := normalizeWebhookEvents(strings.Join(requested, ","))
+	if err := database.GetDB().Model(&models.WhatsAppSession{}).Where("id = ?", session.ID).Update("events", events).Error; err != nil {
+		log.Printf("Session %s event filter update failed: %v", session.SessionID, err)
+	}
+	body[key] = strings.Split(providerEvents(events), ",")
+
+	rewritten, err := json.Marshal(body)
+	if err != nil {
+		restore(raw)
+		return
+	}
+	restore(rewritten)
+	c.Request.ContentLength = int64(len(rewritten))
+	c.Request.Header.Set("Content-Length", strconv.Itoa(len(rewritten)))
+}
+
+// ListSessionStatusHistory returns the session's connection transitions,
+// newest first.
+func ListSessionStatusHistory(c *gin.Context) {
+	session, ok := userSessionFromParam(c)
+	if !ok {
+		return
+	}
+
+	page := parsePositiveInt(c.DefaultQuery("page", "1"), 1)
+	limit := parsePositiveInt(c.DefaultQuery("limit", "50"), 50)
+	if limit > 500 {
+		limit = 500
+	}
+
+	query := database.GetDB().Model(&models.SessionStatusChange{}).
+		Where("user_id = ? AND session_id = ?", session.UserID, session.SessionID)
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "failed to count status history"})
+		return
+	}
+	var items []models.SessionStatusChange
+	if err := query.Order("created_at desc, id desc").Limit(limit).Offset((page - 1) * limit).Find(&items).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "failed to list status history"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"session": gin.H{
+			"session_id":       session.SessionID,
+			"status":           session.Status,
+			"connected":        session.Connected,
+			"logged_in":        session.LoggedIn,
+			"jid":              session.JID,
+			"last_activity_at": session.LastActivityAt,
+		},
+		"items": items,
+		"meta":  gin.H{"page": page, "limit": limit, "total": total},
+	})
+}
@@ -0,0 +1,267 @@
+package handlers
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"genfity-wa-support/database"
+	"genfity-wa-support/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// sessionTokenPrefix marks a session_token column value as ciphertext;
+// anything else is a plaintext token from before encryption at rest.
+const sessionTokenPrefix = "v1:"
+
+var sessionTokenAEAD cipher.AEAD
+
+// InitSessionTokens loads SESSION_TOKEN_KEY and encrypts session tokens that
+// are still stored in plaintext. The service does not start without a key.
+func InitSessionTokens() {
+	aead, err := loadSessionTokenKey(os.Getenv("SESSION_TOKEN_KEY"))
+	if err != nil {
+		log.Fatal("Invalid SESSION_TOKEN_KEY: ", err)
+	}
+	sessionTokenAEAD = aead
+
+	migrated, err := encryptLegacySessionTokens()
+	if err != nil {
+		log.Fatal("Failed to encrypt session tokens: ", err)
+	}
+	if migrated > 0 {
+		log.Printf("Encrypted %d plaintext session tokens", migrated)
+	}
+}
+
+// loadSessionTokenKey accepts a 32-byte AES-256 key as base64 or hex.
+func loadSessionTokenKey(raw string) (cipher.AEAD, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return nil, errors.New("key is not set (generate one with: openssl rand -base64 32)")
+	}
+	key, err := base64.StdEncoding.DecodeString(raw)
+	if err != nil || len(key) != 32 {
+		key, err = hex.DecodeString(raw)
+	}
+	if err != nil || len(key) != 32 {
+		return nil, errors.New("key must be 32 bytes, base64 or hex encoded")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func encryptSessionToken(token string) (string, error) {
+	if sessionTokenAEAD == nil {
+		return "", errors.New("session token key is not loaded")
+	}
+	nonce := make([]byte, sessionTokenAEAD.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := sessionTokenAEAD.Seal(nonce, nonce, []byte(token), nil)
+	return sessionTokenPrefix + base64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+func decryptSessionToken(stored string) (string, error) {
+	if sessionTokenAEAD == nil {
+		return "", errors.New("session token key is not loaded")
+	}
+	if !strings.HasPrefix(stored, sessionTokenPrefix) {
+		return "", errors.New("session token is not encrypted")
+	}
+	sealed, err := base64.RawStdEncoding.DecodeString(strings.TrimPrefix(stored, sessionTokenPrefix))
+	if err != nil || len(sealed) < sessionTokenAEAD.NonceSize() {
+		return "", errors.New("malformed session token ciphertext")
+	}
+	nonceSize := sessionTokenAEAD.NonceSize()
+	plain, err := sessionTokenAEAD.Open(nil, sealed[:nonceSize], sealed[nonceSize:], nil)
+	if err != nil {
+		return "", errors.New("session token cannot be decrypted with SESSION_TOKEN_KEY")
+	}
+	return string(plain), nil
+}
+
+// setSessionToken stores token on the row as ciphertext plus the hash that
+// validateSessionToken looks it up by.
+func setSessionToken(session *models.WhatsAppSession, token string) error {
+	if token == "" {
+		session.TokenCipher, session.TokenHash = "", ""
+		return nil
+	}
+	encrypted, err := encryptSessionToken(token)
+	if err != nil {
+		return err
+	}
+	session.TokenCipher, session.TokenHash = encrypted, hashAPIKey(token)
+	return nil
+}
+
+// sessionTokenUpdates is setSessionToken for Updates maps.
+func sessionTokenUpdates(updates map[string]interface{}, token string) error {
+	var session models.WhatsAppSession
+	if err := setSessionToken(&session, token); err != nil {
+		return err
+	}
+	updates["session_token"] = session.TokenCipher
+	updates["token_hash"] = session.TokenHash
+	return nil
+}
+
+// sessionToken is the plaintext token to send upstream for the session.
+func sessionToken(session models.WhatsAppSession) (string, error) {
+	if session.TokenCipher == "" {
+		return "", nil
+	}
+	token, err := decryptSessionToken(session.TokenCipher)
+	if err != nil {
+		return "", fmt.Errorf("session %s: %w", session.SessionID, err)
+	}
+	return token, nil
+}
+
+// maskSessionToken keeps the prefix and the last four characters, enough
+// for a customer to tell tokens apart.
+func maskSessionToken(token string) string {
+	if len(token) <= 12 {
+		return strings.Repeat("*", len(token))
+	}
+	prefix := 4
+	if i := strings.Index(token, "_"); i > 0 && i < 8 {
+		prefix = i + 1
+	}
+	return token[:prefix] + strings.Repeat("*", 8) + token[len(token)-4:]
+}
+
+func maskSessionTokens(sessions []models.WhatsAppSession) {
+	for i := range sessions {
+		if token, err := sessionToken(sessions[i]); err == nil {
+			sessions[i].TokenDisplay = maskSessionToken(token)
+		}
+	}
+}
+
+// encryptLegacySessionTokens rewrites plaintext tokens in place. The update
+// is guarded on the old value so concurrent replicas do not double-encrypt.
+func encryptLegacySessionTokens() (int, error) {
+	db := database.GetDB()
+	var rows []models.WhatsAppSession
+	if err := db.Select("id", "session_id", "session_token").
+		Where("session_token <> '' AND (token_hash IS NULL OR token_hash = '')").Find(&rows).Error; err != nil {
+		return 0, err
+	}
+
+	migrated := 0
+	for _, row := range rows {
+		token := row.TokenCipher
+		if strings.HasPrefix(token, sessionTokenPrefix) {
+			plain, err := decryptSessionToken(token)
+			if err != nil {
+				return migrated, fmt.Errorf("session %s: %w", row.SessionID, err)
+			}
+			token = plain
+		}
+		updates := map[string]interface{}{}
+		if err := sessionTokenUpdates(updates, token); err != nil {
+			return migrated, err
+		}
+		res := db.Model(&models.WhatsAppSession{}).Where("id = ? AND session_token = ?", row.ID, row.TokenCipher).Updates(updates)
+		if res.Error != nil {
+			return migrated, res.Error
+		}
+		migrated += int(res.RowsAffected)
+	}
+	return migrated, nil
+}
+
+// forwardSessionToken makes a /wa request carry the session's current token
+// upstream, so a token still inside its rotation grace period keeps working.
+func forwardSessionToken(c *gin.Context, session models.WhatsAppSession, presented string) error {
+	if hashAPIKey(presented) == session.TokenHash {
+		return nil
+	}
+	current, err := sessionToken(session)
+	if err != nil {
+		return err
+	}
+	c.Request.Header.Del("Authorization")
+	c.Request.Header.Set("token", current)
+	return nil
+}
+
+// RotateSessionToken issues a new session token and pushes it to the
+// provider. The old token keeps working on /wa for
+// SESSION_TOKEN_GRACE_SECONDS (default 300) so clients can switch over.
+func RotateSessionToken(c *gin.Context) {
+	session, ok := userSessionFromParam(c)
+	if !ok {
+		return
+	}
+	provider, err := providerFor(session.Provider)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": err.Error()})
+		return
+	}
+	node, ok := sessionNodeOrAbort(c, session)
+	if !ok {
+		return
+	}
+
+	previous, err := sessionToken(session)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "failed to read session token"})
+		return
+	}
+	token, _, err := generateAPIKey("wat")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "failed generating session token"})
+		return
+	}
+	if err := provider.SetToken(node, session.SessionID, token); err != nil {
+		respondProviderError(c, err)
+		return
+	}
+
+	now := time.Now()
+	updates := map[string]interface{}{"updated_at": now, "prev_token_hash": "", "prev_token_until": nil}
+	var graceUntil *time.Time
+	if grace := getEnvInt("SESSION_TOKEN_GRACE_SECONDS", 300); grace > 0 && session.TokenHash != "" {
+		until := now.Add(time.Duration(grace) * time.Second)
+		graceUntil = &until
+		updates["prev_token_hash"] = session.TokenHash
+		updates["prev_token_until"] = until
+	}
+	err = sessionTokenUpdates(updates, token)
+	if err == nil {
+		err = database.GetDB().Model(&models.WhatsAppSession{}).Where("id = ?", session.ID).Updates(updates).Error
+	}
+	if err != nil {
+		// Put the provider back on the token we still have stored.
+		if previous != "" {
+			if err := provider.SetToken(node, session.SessionID, previous); err != nil {
+				log.Printf("Session %s token rollback at provider failed: %v", session.SessionID, err)
+			}
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "failed to store session token"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"session_id":                 session.SessionID,
+		"session_token":              token,
+		"previous_token_valid_until": graceUntil,
+	})
+}
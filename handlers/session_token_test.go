@@ -0,0 +1,111 @@
+package handlers
+
+import (
+	"crypto/cipher"
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"genfity-wa-support/models"
+)
+
+func useSessionTokenKey(t *testing.T, raw string) {
+	t.Helper()
+	aead, err := loadSessionTokenKey(raw)
+	if err != nil {
+		t.Fatalf("loadSessionTokenKey: %v", err)
+	}
+	previous := sessionTokenAEAD
+	sessionTokenAEAD = aead
+	t.Cleanup(func() { sessionTokenAEAD = previous })
+}
+
+func TestLoadSessionTokenKey(t *testing.T) {
+	key := []byte(strings.Repeat("k", 32))
+	for _, tc := range []struct {
+		name, raw string
+		wantErr   bool
+	}{
+		{"base64", base64.StdEncoding.EncodeToString(key), false},
+		{"hex", hex.EncodeToString(key), false},
+		{"padded", "  " + base64.StdEncoding.EncodeToString(key) + "\n", false},
+		{"empty", "", true},
+		{"short", base64.StdEncoding.EncodeToString(key[:16]), true},
+		{"not encoded", strings.Repeat("z", 32), true},
+	} {
+		_, err := loadSessionTokenKey(tc.raw)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%s: err = %v, wantErr %v", tc.name, err, tc.wantErr)
+		}
+	}
+}
+
+func TestSessionTokenRoundTrip(t *testing.T) {
+	useSessionTokenKey(t, base64.StdEncoding.EncodeToString([]byte(strings.Repeat("k", 32))))
+	for _, token := range []string{"wat_abc", "", strings.Repeat("x", 256)} {
+		stored, err := encryptSessionToken(token)
+		if err != nil {
+			t.Fatalf("encryptSessionToken: %v", err)
+		}
+		if !strings.HasPrefix(stored, sessionTokenPrefix) || (token != "" && strings.Contains(stored, token)) {
+			t.Fatalf("stored = %q, want opaque %s ciphertext", stored, sessionTokenPrefix)
+		}
+		got, err := decryptSessionToken(stored)
+		if err != nil || got != token {
+			t.Fatalf("decryptSessionToken = %q, %v, want %q", got, err, token)
+		}
+	}
+
+	a, _ := encryptSessionToken("wat_abc")
+	b, _ := encryptSessionToken("wat_abc")
+	if a == b {
+		t.Fatal("encrypting the same token twice gave the same ciphertext")
+	}
+}
+
+func TestDecryptSessionTokenRejects(t *testing.T) {
+	useSessionTokenKey(t, base64.StdEncoding.EncodeToString([]byte(strings.Repeat("k", 32))))
+	stored, err := encryptSessionToken("wat_abc")
+	if err != nil {
+		t.Fatalf("encryptSessionToken: %v", err)
+	}
+	tampered := []byte(stored)
+	tampered[len(tampered)-1] ^= 1
+
+	otherKey, _ := loadSessionTokenKey(hex.EncodeToString([]byte(strings.Repeat("o", 32))))
+	for _, tc := range []struct {
+		name   string
+		stored string
+		aead   cipher.AEAD
+	}{
+		{"plaintext", "wat_abc", sessionTokenAEAD},
+		{"bad base64", sessionTokenPrefix + "!!", sessionTokenAEAD},
+		{"too short", sessionTokenPrefix + "AAAA", sessionTokenAEAD},
+		{"tampered", string(tampered), sessionTokenAEAD},
+		{"other key", stored, otherKey},
+		{"no key", stored, nil},
+	} {
+		sessionTokenAEAD = tc.aead
+		if got, err := decryptSessionToken(tc.stored); err == nil {
+			t.Errorf("%s: decryptSessionToken = %q, want error", tc.name, got)
+		}
+	}
+}
+
+func TestSetSessionToken(t *testing.T) {
+	useSessionTokenKey(t, base64.StdEncoding.EncodeToString([]byte(strings.Repeat("k", 32))))
+	var session models.WhatsAppSession
+	if err := setSessionToken(&session, "wat_abc"); err != nil {
+		t.Fatalf("setSessionToken: %v", err)
+	}
+	if session.TokenHash != hashAPIKey("wat_abc") {
+		t.Fatalf("TokenHash = %q, want hash of the token", session.TokenHash)
+	}
+	if got, err := sessionToken(session); err != nil || got != "wat_abc" {
+		t.Fatalf("sessionToken = %q, %v, want wat_abc", got, err)
+	}
+	if err := setSessionToken(&session, ""); err != nil || session.TokenCipher != "" || session.TokenHash != "" {
+		t.Fatalf("clearing token left %q / %q, %v", session.TokenCipher, session.TokenHash, err)
+	}
+}
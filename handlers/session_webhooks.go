@@ -0,0 +1,341 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"genfity-wa-support/database"
+	"genfity-wa-support/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	maxWebhookHeaders        = 20
+	maxWebhookHeaderValueLen = 1024
+)
+
+// reservedWebhookHeaders are set by the relay itself and cannot be
+// overridden per endpoint; X-Webhook-* is reserved as a prefix.
+var reservedWebhookHeaders = map[string]bool{
+	"Host":              true,
+	"Content-Type":      true,
+	"Content-Length":    true,
+	"Transfer-Encoding": true,
+	"Connection":        true,
+	"User-Agent":        true,
+}
+
+type sessionWebhookRequest struct {
+	URL     *string           `json:"url"`
+	Events  *string           `json:"events"`
+	Headers map[string]string `json:"headers"`
+	Enabled *bool             `json:"enabled"`
+}
+
+// webhookTarget is one place an event of a session is forwarded to: the
+// session's own webhook_url (WebhookID empty) or a SessionWebhook.
+type webhookTarget struct {
+	WebhookID string
+	URL       string
+	Events    string
+}
+
+// normalizeWebhookEvents trims and de-duplicates a comma-separated event
+// list. "All" (any case) collapses the list to empty, meaning every event.
+func normalizeWebhookEvents(raw string) string {
+	seen := map[string]bool{}
+	events := []string{}
+	for _, part := range strings.Split(raw, ",") {
+		event := strings.TrimSpace(part)
+		if event == "" {
+			continue
+		}
+		if strings.EqualFold(event, "all") {
+			return ""
+		}
+		key := strings.ToLower(event)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		events = append(events, event)
+	}
+	return strings.Join(events, ",")
+}
+
+func webhookWantsEvent(events, eventType string) bool {
+	if events == "" {
+		return true
+	}
+	for _, event := range strings.Split(events, ",") {
+		if strings.EqualFold(event, eventType) {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeWebhookHeaders canonicalizes header names and rejects reserved
+// or malformed ones.
+func normalizeWebhookHeaders(headers map[string]string) (models.JSONB, error) {
+	if len(headers) > maxWebhookHeaders {
+		return nil, fmt.Errorf("at most %d headers are allowed", maxWebhookHeaders)
+	}
+	normalized := models.JSONB{}
+	for name, value := range headers {
+		name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+		if name == "" || strings.ContainsAny(name, " \t\r\n:") {
+			return nil, fmt.Errorf("invalid header name %q", name)
+		}
+		if reservedWebhookHeaders[name] || strings.HasPrefix(name, "X-Webhook-") {
+			return nil, fmt.Errorf("header %s is set by the relay", name)
+		}
+		if strings.ContainsAny(value, "\r\n") || len(value) > maxWebhookHeaderValueLen {
+			return nil, fmt.Errorf("invalid value for header %s", name)
+		}
+		normalized[name] = value
+	}
+	return normalized, nil
+}
+
+// sessionWebhookURL is the trimmed endpoint URL, checked by the same guard
+// as every other customer webhook so endpoints cannot target loopback,
+// private or metadata addresses.
+func sessionWebhookURL(raw string) (string, error) {
+	target := strings.TrimSpace(raw)
+	if err := validateWebhookURL(target); err != nil {
+		return "", err
+	}
+	return target, nil
+}
+
+func webhookHeaderValues(headers models.JSONB) map[string]string {
+	values := make(map[string]string, len(headers))
+	for name, value := range headers {
+		if s, ok := value.(string); ok {
+			values[name] = s
+		}
+	}
+	return values
+}
+
+// sessionWebhookTargets lists where events of the session go: its own
+// webhook_url when set, then every enabled endpoint.
+func sessionWebhookTargets(session models.WhatsAppSession) ([]webhookTarget, error) {
+	targets := []webhookTarget{}
+	if session.WebhookURL != "" {
+		targets = append(targets, webhookTarget{URL: session.WebhookURL, Events: session.Events})
+	}
+	var endpoints []models.SessionWebhook
+	if err := database.GetDB().Where("user_id = ? AND session_id = ? AND enabled = ?", session.UserID, session.SessionID, true).
+		Order("created_at asc").Find(&endpoints).Error; err != nil {
+		return nil, err
+	}
+	for _, endpoint := range endpoints {
+		targets = append(targets, webhookTarget{WebhookID: endpoint.ID, URL: endpoint.URL, Events: endpoint.Events})
+	}
+	return targets, nil
+}
+
+func newWebhookDelivery(session models.WhatsAppSession, event models.WebhookEvent, target webhookTarget) models.WebhookDelivery {
+	return models.WebhookDelivery{
+		EventID:       event.ID,
+		UserID:        session.UserID,
+		SessionID:     session.SessionID,
+		WebhookID:     target.WebhookID,
+		EventType:     event.EventType,
+		TargetURL:     target.URL,
+		Status:        models.WebhookDeliveryPending,
+		MaxAttempts:   getEnvInt("WEBHOOK_MAX_ATTEMPTS", 8),
+		NextAttemptAt: time.Now(),
+	}
+}
+
+func ListSessionWebhooks(c *gin.Context) {
+	session, ok := userSessionFromParam(c)
+	if !ok {
+		return
+	}
+	var endpoints []models.SessionWebhook
+	if err := database.GetDB().Where("user_id = ? AND session_id = ?", session.UserID, session.SessionID).
+		Order("created_at asc").Find(&endpoints).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "failed to list webhooks"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"items": endpoints})
+}
+
+func CreateSessionWebhook(c *gin.Context) {
+	session, ok := userSessionFromParam(c)
+	if !ok {
+		return
+	}
+	if !webhookRelayEnabled() {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "webhook relay is not enabled on this server"})
+		return
+	}
+
+	var req sessionWebhookRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+	if req.URL == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "url is required"})
+		return
+	}
+	target, err := sessionWebhookURL(*req.URL)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+	endpoint := models.SessionWebhook{
+		UserID:    session.UserID,
+		SessionID: session.SessionID,
+		URL:       target,
+		Enabled:   true,
+	}
+	if req.Events != nil {
+		endpoint.Events = normalizeWebhookEvents(*req.Events)
+	}
+	headers, err := normalizeWebhookHeaders(req.Headers)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+	endpoint.Headers = headers
+	if req.Enabled != nil {
+		endpoint.Enabled = *req.Enabled
+	}
+
+	var count int64
+	database.GetDB().Model(&models.SessionWebhook{}).Where("user_id = ? AND session_id = ?", session.UserID, session.SessionID).Count(&count)
+	if limit := getEnvInt("WEBHOOKS_PER_SESSION_MAX", 10); int(count) >= limit {
+		c.JSON(http.StatusConflict, gin.H{"message": fmt.Sprintf("session already has %d webhooks", limit)})
+		return
+	}
+
+	if endpoint.ID, err = generateID("wh"); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "failed to generate webhook id"})
+		return
+	}
+	if endpoint.Secret, _, err = generateAPIKey("whsec"); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "failed to generate webhook secret"})
+		return
+	}
+	if err := database.GetDB().Create(&endpoint).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "failed to store webhook"})
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"webhook": endpoint, "webhook_secret": endpoint.Secret})
+}
+
+func GetSessionWebhook(c *gin.Context) {
+	endpoint, ok := sessionWebhookFromParam(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"webhook": endpoint, "webhook_secret": endpoint.Secret})
+}
+
+func UpdateSessionWebhook(c *gin.Context) {
+	endpoint, ok := sessionWebhookFromParam(c)
+	if !ok {
+		return
+	}
+
+	var req sessionWebhookRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+	updates := map[string]interface{}{"updated_at": time.Now()}
+	if req.URL != nil || (req.Enabled != nil && *req.Enabled && !endpoint.Enabled) {
+		// Re-enabling checks the stored URL too: it may predate the guard
+		// or resolve somewhere else by now.
+		raw := endpoint.URL
+		if req.URL != nil {
+			raw = *req.URL
+		}
+		target, err := sessionWebhookURL(raw)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+			return
+		}
+		updates["url"] = target
+	}
+	if req.Events != nil {
+		updates["events"] = normalizeWebhookEvents(*req.Events)
+	}
+	if req.Headers != nil {
+		headers, err := normalizeWebhookHeaders(req.Headers)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+			return
+		}
+		updates["headers"] = headers
+	}
+	if req.Enabled != nil {
+		updates["enabled"] = *req.Enabled
+	}
+
+	db := database.GetDB()
+	if err := db.Model(&models.SessionWebhook{}).Where("id = ?", endpoint.ID).Updates(updates).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "failed to update webhook"})
+		return
+	}
+	if err := db.Where("id = ?", endpoint.ID).First(&endpoint).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "failed to load webhook"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"webhook": endpoint})
+}
+
+// DeleteSessionWebhook removes the endpoint; its queued deliveries are
+// dead-lettered by the relay worker when they come up.
+func DeleteSessionWebhook(c *gin.Context) {
+	endpoint, ok := sessionWebhookFromParam(c)
+	if !ok {
+		return
+	}
+	if err := database.GetDB().Where("id = ?", endpoint.ID).Delete(&models.SessionWebhook{}).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "failed to delete webhook"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "webhook deleted"})
+}
+
+func RotateSessionWebhookSecret(c *gin.Context) {
+	endpoint, ok := sessionWebhookFromParam(c)
+	if !ok {
+		return
+	}
+	secret, _, err := generateAPIKey("whsec")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "failed to generate webhook secret"})
+		return
+	}
+	if err := database.GetDB().Model(&models.SessionWebhook{}).Where("id = ?", endpoint.ID).
+		Updates(map[string]interface{}{"secret": secret, "updated_at": time.Now()}).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "failed to rotate webhook secret"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"webhook_id": endpoint.ID, "webhook_secret": secret})
+}
+
+func sessionWebhookFromParam(c *gin.Context) (models.SessionWebhook, bool) {
+	var endpoint models.SessionWebhook
+	session, ok := userSessionFromParam(c)
+	if !ok {
+		return endpoint, false
+	}
+	if err := database.GetDB().Where("id = ? AND user_id = ? AND session_id = ?", c.Param("webhook_id"), session.UserID, session.SessionID).
+		First(&endpoint).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "webhook not found"})
+		return endpoint, false
+	}
+	return endpoint, true
+}
@@ -0,0 +1,40 @@
+package handlers
+
+import "testing"
+
+func TestSessionWebhookURLRejectsPrivateTargets(t *testing.T) {
+	for _, raw := range []string{
+		"http://127.0.0.1/hook",
+		"http://[::1]:8080/hook",
+		"https://10.20.30.40/hook",
+		"http://169.254.169.254/latest/meta-data/",
+		"http://localhost/hook",
+		"",
+	} {
+		if _, err := sessionWebhookURL(raw); err == nil {
+			t.Errorf("sessionWebhookURL(%q) = nil error, want rejection", raw)
+		}
+	}
+}
+
+func TestSessionWebhookURLTrimsPublicTarget(t *testing.T) {
+	got, err := sessionWebhookURL("  https://93.184.216.34/wa \n")
+	if err != nil {
+		t.Fatalf("sessionWebhookURL: %v", err)
+	}
+	if got != "https://93.184.216.34/wa" {
+		t.Fatalf("sessionWebhookURL = %q", got)
+	}
+}
+
+func TestNormalizeWebhookHeadersRejectsReserved(t *testing.T) {
+	for _, name := range []string{"Host", "content-type", "X-Webhook-Signature", "Bad Name"} {
+		if _, err := normalizeWebhookHeaders(map[string]string{name: "x"}); err == nil {
+			t.Errorf("normalizeWebhookHeaders(%q) = nil error, want rejection", name)
+		}
+	}
+	headers, err := normalizeWebhookHeaders(map[string]string{"authorization": "Bearer t"})
+	if err != nil || headers["Authorization"] != "Bearer t" {
+		t.Fatalf("normalizeWebhookHeaders = %v, %v", headers, err)
+	}
+}
@@ -0,0 +1,253 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"genfity-wa-support/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+type breakerState string
+
+const (
+	breakerClosed   breakerState = "closed"
+	breakerOpen     breakerState = "open"
+	breakerHalfOpen breakerState = "half_open"
+)
+
+var (
+	upstreamOnce         sync.Once
+	upstreamAPIClient    *http.Client
+	upstreamStreamClient *http.Client
+
+	breakersMu sync.Mutex
+	breakers   = map[string]*circuitBreaker{}
+)
+
+// circuitOpenError is returned without contacting the node while its breaker
+// is open.
+type circuitOpenError struct {
+	NodeID     string
+	RetryAfter time.Duration
+}
+
+func (e *circuitOpenError) Error() string {
+	return fmt.Sprintf("provider node %s is unavailable, retry later", e.NodeID)
+}
+
+// errUpstreamNotSent marks failures that happened before the request was
+// built, so the provider cannot have seen it.
+var errUpstreamNotSent = errors.New("upstream request not sent")
+
+// upstreamNeverSent reports whether err proves the provider never received
+// the request: an open breaker, a failed dial or a request that was never
+// built. Anything else (timeouts, resets) may have reached the provider.
+func upstreamNeverSent(err error) bool {
+	var openErr *circuitOpenError
+	if errors.As(err, &openErr) || errors.Is(err, errUpstreamNotSent) {
+		return true
+	}
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// upstreamClients returns the client for buffered API calls and the one used
+// to stream gateway traffic. Both share a transport with connect and
+// response-header timeouts; the streaming client gets a longer total timeout
+// so large media transfers are not cut off.
+func upstreamClients() (*http.Client, *http.Client) {
+	upstreamOnce.Do(func() {
+		transport := &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			DialContext: (&net.Dialer{
+				Timeout:   time.Duration(getEnvInt("UPSTREAM_CONNECT_TIMEOUT_SECONDS", 5)) * time.Second,
+				KeepAlive: 30 * time.Second,
+			}).DialContext,
+			ResponseHeaderTimeout: time.Duration(getEnvInt("UPSTREAM_RESPONSE_HEADER_TIMEOUT_SECONDS", 30)) * time.Second,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ExpectContinueTimeout: time.Second,
+			MaxIdleConns:          200,
+			MaxIdleConnsPerHost:   50,
+			IdleConnTimeout:       90 * time.Second,
+			ForceAttemptHTTP2:     true,
+		}
+		upstreamAPIClient = &http.Client{
+			Transport: transport,
+			Timeout:   time.Duration(getEnvInt("UPSTREAM_TIMEOUT_SECONDS", 60)) * time.Second,
+		}
+		upstreamStreamClient = &http.Client{
+			Transport: transport,
+			Timeout:   time.Duration(getEnvInt("UPSTREAM_STREAM_TIMEOUT_SECONDS", 300)) * time.Second,
+		}
+	})
+	return upstreamAPIClient, upstreamStreamClient
+}
+
+// doUpstream sends req to node through its circuit breaker. GET requests
+// (which carry no body) are retried up to UPSTREAM_GET_RETRIES times on
+// transport errors and 502/503/504 before the failure is reported.
+func doUpstream(client *http.Client, node models.ProviderNode, req *http.Request) (*http.Response, error) {
+	breaker := breakerFor(node.ID)
+	if wait, ok := breaker.allow(time.Now()); !ok {
+		return nil, &circuitOpenError{NodeID: node.ID, RetryAfter: wait}
+	}
+
+	retries := 0
+	if req.Method == http.MethodGet {
+		retries = getEnvInt("UPSTREAM_GET_RETRIES", 2)
+	}
+
+	for attempt := 0; ; attempt++ {
+		resp, err := client.Do(req)
+		if err != nil && req.Context().Err() != nil {
+			// The caller went away; that says nothing about the node.
+			breaker.cancel()
+			return nil, err
+		}
+		failed := err != nil || isUpstreamUnavailable(resp.StatusCode)
+		if !failed || attempt >= retries {
+			breaker.record(!failed, time.Now())
+			return resp, err
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+
+		select {
+		case <-time.After(time.Duration(200<<attempt) * time.Millisecond):
+		case <-req.Context().Done():
+			breaker.cancel()
+			return nil, req.Context().Err()
+		}
+	}
+}
+
+func isUpstreamUnavailable(status int) bool {
+	return status == http.StatusBadGateway || status == http.StatusServiceUnavailable || status == http.StatusGatewayTimeout
+}
+
+// circuitBreaker opens after UPSTREAM_BREAKER_FAILURES consecutive failures,
+// rejects calls for UPSTREAM_BREAKER_COOLDOWN_SECONDS, then lets a single
+// probe through: success closes it, failure opens it again.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	nodeID    string
+	state     breakerState
+	failures  int
+	openedAt  time.Time
+	probing   bool
+	threshold int
+	cooldown  time.Duration
+}
+
+type breakerSnapshot struct {
+	State     breakerState `json:"state"`
+	Failures  int          `json:"failures"`
+	OpenedAt  *time.Time   `json:"opened_at,omitempty"`
+	RetryInMs int64        `json:"retry_in_ms,omitempty"`
+}
+
+func breakerFor(nodeID string) *circuitBreaker {
+	breakersMu.Lock()
+	defer breakersMu.Unlock()
+	breaker, ok := breakers[nodeID]
+	if !ok {
+		breaker = &circuitBreaker{
+			nodeID:    nodeID,
+			state:     breakerClosed,
+			threshold: getEnvInt("UPSTREAM_BREAKER_FAILURES", 5),
+			cooldown:  time.Duration(getEnvInt("UPSTREAM_BREAKER_COOLDOWN_SECONDS", 30)) * time.Second,
+		}
+		breakers[nodeID] = breaker
+	}
+	return breaker
+}
+
+func (b *circuitBreaker) allow(now time.Time) (time.Duration, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		reopenAt := b.openedAt.Add(b.cooldown)
+		if now.Before(reopenAt) {
+			return reopenAt.Sub(now), false
+		}
+		b.transition(breakerHalfOpen)
+		b.probing = true
+		return 0, true
+	case breakerHalfOpen:
+		if b.probing {
+			return b.cooldown, false
+		}
+		b.probing = true
+		return 0, true
+	}
+	return 0, true
+}
+
+func (b *circuitBreaker) record(success bool, now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.probing = false
+	if success {
+		b.failures = 0
+		if b.state != breakerClosed {
+			b.transition(breakerClosed)
+		}
+		return
+	}
+
+	b.failures++
+	if b.state == breakerHalfOpen || (b.state == breakerClosed && b.threshold > 0 && b.failures >= b.threshold) {
+		b.openedAt = now
+		b.transition(breakerOpen)
+	}
+}
+
+// cancel gives up a half-open probe without counting it either way.
+func (b *circuitBreaker) cancel() {
+	b.mu.Lock()
+	b.probing = false
+	b.mu.Unlock()
+}
+
+func (b *circuitBreaker) transition(to breakerState) {
+	log.Printf("Provider node %s circuit %s -> %s (failures=%d)", b.nodeID, b.state, to, b.failures)
+	b.state = to
+}
+
+func (b *circuitBreaker) snapshot(now time.Time) breakerSnapshot {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	snap := breakerSnapshot{State: b.state, Failures: b.failures}
+	if b.state != breakerClosed {
+		openedAt := b.openedAt
+		snap.OpenedAt = &openedAt
+	}
+	if b.state == breakerOpen {
+		if wait := b.openedAt.Add(b.cooldown).Sub(now); wait > 0 {
+			snap.RetryInMs = wait.Milliseconds()
+		}
+	}
+	return snap
+}
+
+func respondCircuitOpen(c *gin.Context, err *circuitOpenError) {
+	retryAfter := ceilSeconds(err.RetryAfter)
+	if retryAfter < 1 {
+		retryAfter = 1
+	}
+	c.Header("Retry-After", strconv.Itoa(retryAfter))
+	respondError(c, http.StatusServiceUnavailable, codeUpstreamUnavailable, err.Error())
+}
@@ -0,0 +1,254 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"genfity-wa-support/database"
+	"genfity-wa-support/models"
+
+	"gorm.io/gorm"
+)
+
+const (
+	reconnectBaseBackoff = 15 * time.Second
+	reconnectMaxBackoff  = 10 * time.Minute
+	// reconnectLease keeps other replicas off a session while one of them
+	// is talking to the provider about it.
+	reconnectLease = 2 * time.Minute
+	// reconnectBatch bounds how many sessions one tick works through.
+	reconnectBatch = 100
+)
+
+// reconnectSkipStatuses are logged-in sessions the watchdog must not touch.
+var reconnectSkipStatuses = []string{sessionStatusStopped, sessionStatusReconnectFailed, sessionStatusLoggedOut, sessionStatusMissing}
+
+// StartReconnectWatchdog reconnects sessions that are logged in but not
+// connected. A session is first left alone for RECONNECT_GRACE_SECONDS so
+// the provider's own reconnect can win, then /session/connect is retried
+// with jittered exponential backoff up to RECONNECT_MAX_ATTEMPTS times
+// before the session is flagged reconnect_failed.
+func StartReconnectWatchdog() {
+	seconds := getEnvInt("RECONNECT_WATCHDOG_INTERVAL_SECONDS", 30)
+	if seconds <= 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(time.Duration(seconds) * time.Second)
+		defer ticker.Stop()
+		for now := range ticker.C {
+			if err := scheduleReconnects(now); err != nil {
+				log.Printf("Reconnect watchdog error: %v", err)
+				continue
+			}
+			for i := 0; i < reconnectBatch; i++ {
+				session, ok := claimReconnect(time.Now())
+				if !ok {
+					break
+				}
+				reconnectSession(session)
+			}
+		}
+	}()
+}
+
+// scheduleReconnects clears the counters of sessions that recovered and
+// gives newly disconnected ones their grace period.
+func scheduleReconnects(now time.Time) error {
+	db := database.GetDB()
+	if err := db.Model(&models.WhatsAppSession{}).
+		Where("(connected = ? OR logged_in = ?) AND (reconnect_tries > 0 OR next_reconnect_at IS NOT NULL)", true, false).
+		Updates(map[string]interface{}{"reconnect_tries": 0, "next_reconnect_at": nil}).Error; err != nil {
+		return err
+	}
+	grace := time.Duration(getEnvInt("RECONNECT_GRACE_SECONDS", 60)) * time.Second
+	return db.Model(&models.WhatsAppSession{}).
+		Where("logged_in = ? AND connected = ? AND status NOT IN ? AND next_reconnect_at IS NULL", true, false, reconnectSkipStatuses).
+		Update("next_reconnect_at", now.Add(grace)).Error
+}
+
+func claimReconnect(now time.Time) (models.WhatsAppSession, bool) {
+	var session models.WhatsAppSession
+	res := database.GetDB().Raw(`
+		UPDATE wa_sessions
+		SET next_reconnect_at = @lease
+		WHERE id = (
+			SELECT id FROM wa_sessions
+			WHERE logged_in = true AND connected = false AND status NOT IN @skip
+			AND next_reconnect_at <= @now
+			ORDER BY next_reconnect_at
+			LIMIT 1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING *`,
+		map[string]interface{}{
+			"lease": now.Add(reconnectLease),
+			"skip":  reconnectSkipStatuses,
+			"now":   now,
+		}).Scan(&session)
+	if res.Error != nil {
+		log.Printf("Reconnect watchdog claim error: %v", res.Error)
+		return session, false
+	}
+	return session, res.RowsAffected > 0 && session.ID != 0
+}
+
+// reconnectSession asks the provider first, since our state may be stale
+// when the relay is off, and only then spends an attempt on /session/connect.
+func reconnectSession(session models.WhatsAppSession) {
+	provider, err := providerFor(session.Provider)
+	if err != nil {
+		log.Printf("Reconnect watchdog skipped session %s: %v", session.SessionID, err)
+		return
+	}
+	node, err := resolveSessionNode(session)
+	if err != nil {
+		log.Printf("Reconnect watchdog skipped session %s: %v", session.SessionID, err)
+		rescheduleReconnect(session, time.Now().Add(reconnectMaxBackoff))
+		return
+	}
+	maxTries := getEnvInt("RECONNECT_MAX_ATTEMPTS", 5)
+	token, err := sessionToken(session)
+	if err != nil {
+		log.Printf("Reconnect watchdog skipped session %s: %v", session.SessionID, err)
+		rescheduleReconnect(session, time.Now().Add(reconnectMaxBackoff))
+		return
+	}
+
+	remote, err := provider.SessionStatus(node, token)
+	var openErr *circuitOpenError
+	switch {
+	case errors.As(err, &openErr):
+		// The node is down; that is not the session's fault.
+		wait := openErr.RetryAfter
+		if wait < reconnectBaseBackoff {
+			wait = reconnectBaseBackoff
+		}
+		rescheduleReconnect(session, time.Now().Add(wait))
+		return
+	case err == nil && remote.Connected && remote.LoggedIn:
+		next := stateOf(session)
+		next.Status, next.Connected, next.LoggedIn = sessionStatusConnected, true, true
+		finishReconnect(session, next, "provider reports connected")
+		return
+	case err == nil && !remote.LoggedIn:
+		next := stateOf(session)
+		next.Status, next.Connected, next.LoggedIn = sessionStatusLoggedOut, false, false
+		finishReconnect(session, next, "provider reports logged out")
+		return
+	}
+
+	if session.ReconnectTries >= maxTries {
+		next := stateOf(session)
+		next.Status = sessionStatusReconnectFailed
+		finishReconnect(session, next, fmt.Sprintf("gave up after %d attempts", session.ReconnectTries))
+		return
+	}
+
+	tries := session.ReconnectTries + 1
+	err = provider.Connect(node, token, strings.Split(reconnectEvents(session), ","))
+	detail := fmt.Sprintf("attempt %d/%d", tries, maxTries)
+	if err != nil {
+		detail += ": " + err.Error()
+	}
+
+	next := stateOf(session)
+	next.Status = sessionStatusReconnecting
+	err = database.GetDB().Transaction(func(tx *gorm.DB) error {
+		if err := recordSessionTransition(tx, session, next, models.SessionStatusSourceWatchdog, "reconnect", detail); err != nil {
+			return err
+		}
+		return tx.Model(&models.WhatsAppSession{}).Where("id = ?", session.ID).Updates(map[string]interface{}{
+			"status":            next.Status,
+			"reconnect_tries":   tries,
+			"next_reconnect_at": time.Now().Add(retryBackoff(tries, reconnectBaseBackoff, reconnectMaxBackoff)),
+			"updated_at":        time.Now(),
+		}).Error
+	})
+	if err != nil {
+		log.Printf("Reconnect watchdog update for session %s failed: %v", session.SessionID, err)
+	}
+}
+
+// reconnectEvents is the subscription sent with a watchdog connect. Sessions
+// created before events were stored locally fall back to everything.
+func reconnectEvents(session models.WhatsAppSession) string {
+	if events := providerEvents(session.Events); events != "" {
+		return events
+	}
+	return "All"
+}
+
+func rescheduleReconnect(session models.WhatsAppSession, at time.Time) {
+	if err := database.GetDB().Model(&models.WhatsAppSession{}).Where("id = ?", session.ID).
+		Update("next_reconnect_at", at).Error; err != nil {
+		log.Printf("Reconnect watchdog reschedule for session %s failed: %v", session.SessionID, err)
+	}
+}
+
+// finishReconnect stops watching the session with its final state.
+func finishReconnect(session models.WhatsAppSession, next sessionState, detail string) {
+	err := database.GetDB().Transaction(func(tx *gorm.DB) error {
+		if err := recordSessionTransition(tx, session, next, models.SessionStatusSourceWatchdog, "", detail); err != nil {
+			return err
+		}
+		return tx.Model(&models.WhatsAppSession{}).Where("id = ?", session.ID).Updates(map[string]interface{}{
+			"status":            next.Status,
+			"connected":         next.Connected,
+			"logged_in":         next.LoggedIn,
+			"reconnect_tries":   0,
+			"next_reconnect_at": nil,
+			"updated_at":        time.Now(),
+		}).Error
+	})
+	if err != nil {
+		log.Printf("Reconnect watchdog update for session %s failed: %v", session.SessionID, err)
+	}
+}
+
+// noteSessionCommand keeps the watchdog in step with what the customer does
+// through /wa: a deliberate disconnect is not reconnected, and a connect
+// clears an earlier give-up.
+func noteSessionCommand(session models.WhatsAppSession, method, targetPath string, status int) {
+	if method != http.MethodPost || status < 200 || status >= 300 {
+		return
+	}
+	next := stateOf(session)
+	detail := ""
+	switch strings.TrimRight(targetPath, "/") {
+	case "/session/disconnect":
+		next.Status, next.Connected = sessionStatusStopped, false
+		detail = "disconnected by customer"
+	case "/session/connect":
+		if session.Status != sessionStatusStopped && session.Status != sessionStatusReconnectFailed {
+			return
+		}
+		next.Status = sessionStatusDisconnected
+		detail = "connect requested by customer"
+	default:
+		return
+	}
+
+	err := database.GetDB().Transaction(func(tx *gorm.DB) error {
+		if next != stateOf(session) {
+			if err := recordSessionTransition(tx, session, next, models.SessionStatusSourceSync, "", detail); err != nil {
+				return err
+			}
+		}
+		return tx.Model(&models.WhatsAppSession{}).Where("id = ?", session.ID).Updates(map[string]interface{}{
+			"status":            next.Status,
+			"connected":         next.Connected,
+			"reconnect_tries":   0,
+			"next_reconnect_at": nil,
+			"updated_at":        time.Now(),
+		}).Error
+	})
+	if err != nil {
+		log.Printf("Session %s command bookkeeping failed: %v", session.SessionID, err)
+	}
+}
@@ -0,0 +1,317 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"genfity-wa-support/database"
+	"genfity-wa-support/models"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// maxWebhookReplayBatch caps how many events one range replay re-queues.
+const maxWebhookReplayBatch = 1000
+
+type webhookReplayRequest struct {
+	From      string `json:"from" binding:"required"`
+	To        string `json:"to" binding:"required"`
+	EventType string `json:"event_type"`
+	WebhookID string `json:"webhook_id"`
+	// OnlyFailed limits the replay to endpoints whose last delivery of the
+	// event is dead.
+	OnlyFailed bool `json:"only_failed"`
+}
+
+func userSessionFromParam(c *gin.Context) (models.WhatsAppSession, bool) {
+	user := c.MustGet("user").(models.ServiceUser)
+	var session models.WhatsAppSession
+	if err := database.GetDB().Where("user_id = ? AND session_id = ?", user.ID, c.Param("session_id")).First(&session).Error; err != nil {
+		respondError(c, http.StatusNotFound, codeSessionNotFound, "session not found")
+		return session, false
+	}
+	return session, true
+}
+
+// ListWebhookDeliveries serves ?status=&event_type=&webhook_id=&event_id=&from=&to=&page=&limit=
+// for one session, newest first.
+func ListWebhookDeliveries(c *gin.Context) {
+	session, ok := userSessionFromParam(c)
+	if !ok {
+		return
+	}
+
+	query := database.GetDB().Model(&models.WebhookDelivery{}).
+		Where("user_id = ? AND session_id = ?", session.UserID, session.SessionID)
+	if raw := strings.TrimSpace(c.Query("from")); raw != "" {
+		from, err := parseLedgerTime(raw, false)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"message": "invalid from, use RFC3339 or YYYY-MM-DD"})
+			return
+		}
+		query = query.Where("created_at >= ?", from)
+	}
+	if raw := strings.TrimSpace(c.Query("to")); raw != "" {
+		to, err := parseLedgerTime(raw, true)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"message": "invalid to, use RFC3339 or YYYY-MM-DD"})
+			return
+		}
+		query = query.Where("created_at < ?", to)
+	}
+	if status := strings.TrimSpace(c.Query("status")); status != "" {
+		query = query.Where("status = ?", status)
+	}
+	if eventType := strings.TrimSpace(c.Query("event_type")); eventType != "" {
+		query = query.Where("event_type = ?", eventType)
+	}
+	if webhookID := strings.TrimSpace(c.Query("webhook_id")); webhookID != "" {
+		query = query.Where("webhook_id = ?", webhookID)
+	}
+	if eventID := strings.TrimSpace(c.Query("event_id")); eventID != "" {
+		query = query.Where("event_id = ?", eventID)
+	}
+
+	page := parsePositiveInt(c.DefaultQuery("page", "1"), 1)
+	limit := parsePositiveInt(c.DefaultQuery("limit", "50"), 50)
+	if limit > 500 {
+		limit = 500
+	}
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "failed to count deliveries"})
+		return
+	}
+	var deliveries []models.WebhookDelivery
+	if err := query.Order("created_at desc, id desc").Limit(limit).Offset((page - 1) * limit).Find(&deliveries).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "failed to list deliveries"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"items": deliveries,
+		"meta":  gin.H{"page": page, "limit": limit, "total": total},
+	})
+}
+
+// GetWebhookDelivery returns one delivery with its attempt log.
+func GetWebhookDelivery(c *gin.Context) {
+	session, ok := userSessionFromParam(c)
+	if !ok {
+		return
+	}
+	delivery, ok := sessionWebhookDelivery(c, session)
+	if !ok {
+		return
+	}
+
+	var attempts []models.WebhookDeliveryAttempt
+	if err := database.GetDB().Where("delivery_id = ?", delivery.ID).Order("attempt asc, id asc").Find(&attempts).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "failed to load attempts"})
+		return
+	}
+	// Rows logged before the target guard existed may hold an internal
+	// service's response, so only bodies marked at delivery time are shown.
+	for i := range attempts {
+		if !attempts[i].BodyVisible {
+			attempts[i].ResponseBody = ""
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"delivery": delivery, "attempts": attempts})
+}
+
+// ReplayWebhookDelivery queues the delivery's event again, to the current URL
+// of the same endpoint, as a new delivery linked through replay_of.
+func ReplayWebhookDelivery(c *gin.Context) {
+	session, ok := userSessionFromParam(c)
+	if !ok {
+		return
+	}
+	delivery, ok := sessionWebhookDelivery(c, session)
+	if !ok {
+		return
+	}
+
+	target := webhookTarget{WebhookID: delivery.WebhookID, URL: session.WebhookURL}
+	if delivery.WebhookID != "" {
+		var endpoint models.SessionWebhook
+		if err := database.GetDB().Where("id = ?", delivery.WebhookID).First(&endpoint).Error; err != nil {
+			c.JSON(http.StatusGone, gin.H{"message": "webhook endpoint no longer exists"})
+			return
+		}
+		target.URL = endpoint.URL
+	}
+	if target.URL == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "session has no webhook_url"})
+		return
+	}
+
+	var event models.WebhookEvent
+	if err := database.GetDB().Select("id", "event_type").Where("id = ?", delivery.EventID).First(&event).Error; err != nil {
+		c.JSON(http.StatusGone, gin.H{"message": "event is no longer retained"})
+		return
+	}
+
+	replay := newWebhookDelivery(session, event, target)
+	replay.ReplayOf = &delivery.ID
+	if err := database.GetDB().Create(&replay).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "failed to queue replay"})
+		return
+	}
+	c.JSON(http.StatusAccepted, gin.H{"delivery": replay})
+}
+
+// ReplayWebhookDeliveries re-queues every retained event of the session in
+// [from, to) to each endpoint whose filter matches, or only to webhook_id
+// when given. With only_failed, an event is replayed to an endpoint only if
+// its latest delivery there is dead.
+func ReplayWebhookDeliveries(c *gin.Context) {
+	session, ok := userSessionFromParam(c)
+	if !ok {
+		return
+	}
+
+	var req webhookReplayRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+	from, err := parseLedgerTime(strings.TrimSpace(req.From), false)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "invalid from, use RFC3339 or YYYY-MM-DD"})
+		return
+	}
+	to, err := parseLedgerTime(strings.TrimSpace(req.To), true)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "invalid to, use RFC3339 or YYYY-MM-DD"})
+		return
+	}
+	if !to.After(from) {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "to must be after from"})
+		return
+	}
+
+	targets, err := sessionWebhookTargets(session)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "failed to load webhooks"})
+		return
+	}
+	if req.WebhookID != "" {
+		selected := targets[:0]
+		for _, target := range targets {
+			if target.WebhookID == req.WebhookID {
+				selected = append(selected, target)
+			}
+		}
+		targets = selected
+	}
+	if len(targets) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "no enabled webhook to replay to"})
+		return
+	}
+
+	db := database.GetDB()
+	query := db.Model(&models.WebhookEvent{}).Select("id", "event_type").
+		Where("user_id = ? AND session_id = ? AND created_at >= ? AND created_at < ?", session.UserID, session.SessionID, from, to)
+	if req.EventType != "" {
+		query = query.Where("event_type = ?", req.EventType)
+	}
+	if req.OnlyFailed {
+		query = query.Where(`EXISTS (
+			SELECT 1 FROM wa_webhook_deliveries d
+			WHERE d.event_id = wa_webhook_events.id AND d.status = ?
+			AND NOT EXISTS (
+				SELECT 1 FROM wa_webhook_deliveries n
+				WHERE n.event_id = d.event_id AND COALESCE(n.webhook_id, '') = COALESCE(d.webhook_id, '') AND n.id > d.id
+			)
+		)`, models.WebhookDeliveryDead)
+	}
+
+	var events []models.WebhookEvent
+	if err := query.Order("created_at asc").Limit(maxWebhookReplayBatch + 1).Find(&events).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "failed to load events"})
+		return
+	}
+	truncated := len(events) > maxWebhookReplayBatch
+	if truncated {
+		events = events[:maxWebhookReplayBatch]
+	}
+
+	failed := map[string]bool{}
+	if req.OnlyFailed && len(events) > 0 {
+		if failed, err = deadWebhookTargets(events); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"message": "failed to load deliveries"})
+			return
+		}
+	}
+
+	replays := []models.WebhookDelivery{}
+	for _, event := range events {
+		for _, target := range targets {
+			if !webhookWantsEvent(target.Events, event.EventType) {
+				continue
+			}
+			if req.OnlyFailed && !failed[event.ID+"|"+target.WebhookID] {
+				continue
+			}
+			replays = append(replays, newWebhookDelivery(session, event, target))
+		}
+	}
+	if len(replays) > 0 {
+		err := db.Transaction(func(tx *gorm.DB) error {
+			return tx.CreateInBatches(&replays, 200).Error
+		})
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"message": "failed to queue replay"})
+			return
+		}
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{"events": len(events), "queued": len(replays), "truncated": truncated})
+}
+
+// deadWebhookTargets returns "<event_id>|<webhook_id>" for every event and
+// endpoint pair whose latest delivery is dead.
+func deadWebhookTargets(events []models.WebhookEvent) (map[string]bool, error) {
+	ids := make([]string, 0, len(events))
+	for _, event := range events {
+		ids = append(ids, event.ID)
+	}
+	var latest []struct {
+		EventID   string
+		WebhookID string
+		Status    models.WebhookDeliveryStatus
+	}
+	err := database.GetDB().Raw(`
+		SELECT DISTINCT ON (event_id, COALESCE(webhook_id, ''))
+			event_id, COALESCE(webhook_id, '') AS webhook_id, status
+		FROM wa_webhook_deliveries
+		WHERE event_id IN ?
+		ORDER BY event_id, COALESCE(webhook_id, ''), id DESC`, ids).Scan(&latest).Error
+	if err != nil {
+		return nil, err
+	}
+	dead := map[string]bool{}
+	for _, row := range latest {
+		if row.Status == models.WebhookDeliveryDead {
+			dead[row.EventID+"|"+row.WebhookID] = true
+		}
+	}
+	return dead, nil
+}
+
+func sessionWebhookDelivery(c *gin.Context, session models.WhatsAppSession) (models.WebhookDelivery, bool) {
+	var delivery models.WebhookDelivery
+	id, err := strconv.ParseUint(c.Param("delivery_id"), 10, 64)
+	if err == nil {
+		err = database.GetDB().Where("id = ? AND user_id = ? AND session_id = ?", id, session.UserID, session.SessionID).First(&delivery).Error
+	}
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "delivery not found"})
+		return delivery, false
+	}
+	return delivery, true
+}
@@ -0,0 +1,150 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const webhookResolveTimeout = 5 * time.Second
+
+var errWebhookTargetBlocked = errors.New("webhook target address is not allowed")
+
+// blockedWebhookPrefixes are ranges a customer webhook must never reach:
+// loopback, private, link-local (cloud metadata lives at 169.254.169.254
+// and fd00:ec2::254), shared, reserved and multicast space.
+var blockedWebhookPrefixes = mustParsePrefixes(
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.0.0.0/24",
+	"192.0.2.0/24",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"198.51.100.0/24",
+	"203.0.113.0/24",
+	"224.0.0.0/4",
+	"240.0.0.0/4",
+	"::/128",
+	"::1/128",
+	"64:ff9b::/96",
+	"100::/64",
+	"2001:db8::/32",
+	"fc00::/7",
+	"fe80::/10",
+	"ff00::/8",
+)
+
+func mustParsePrefixes(values ...string) []netip.Prefix {
+	prefixes := make([]netip.Prefix, 0, len(values))
+	for _, value := range values {
+		prefixes = append(prefixes, netip.MustParsePrefix(value))
+	}
+	return prefixes
+}
+
+func webhookAddrBlocked(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if !addr.IsValid() {
+		return true
+	}
+	for _, prefix := range blockedWebhookPrefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// validateWebhookURL is the single check for every customer-supplied
+// webhook URL: absolute http(s), and a host that only resolves to public
+// addresses. The dialer of webhookClient repeats the address check, since
+// DNS may change after the URL was saved.
+func validateWebhookURL(raw string) error {
+	parsed, err := url.Parse(raw)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Hostname() == "" {
+		return errors.New("url must be an absolute http(s) URL")
+	}
+	if parsed.User != nil {
+		return errors.New("url must not contain credentials")
+	}
+
+	host := parsed.Hostname()
+	if addr, err := netip.ParseAddr(host); err == nil {
+		if webhookAddrBlocked(addr) {
+			return fmt.Errorf("url host %s is not a public address", host)
+		}
+		return nil
+	}
+	if strings.EqualFold(strings.TrimSuffix(host, "."), "localhost") || strings.HasSuffix(strings.ToLower(strings.TrimSuffix(host, ".")), ".localhost") {
+		return fmt.Errorf("url host %s is not a public address", host)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), webhookResolveTimeout)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil || len(addrs) == 0 {
+		return fmt.Errorf("url host %s does not resolve", host)
+	}
+	for _, addr := range addrs {
+		if webhookAddrBlocked(addr) {
+			return fmt.Errorf("url host %s resolves to a non-public address", host)
+		}
+	}
+	return nil
+}
+
+// validateSessionWebhookURL checks a session's own webhook_url; empty
+// clears it.
+func validateSessionWebhookURL(raw string) error {
+	if strings.TrimSpace(raw) == "" {
+		return nil
+	}
+	return validateWebhookURL(strings.TrimSpace(raw))
+}
+
+// webhookDialControl runs after DNS resolution for every connection the
+// webhook client opens, so a rebinding host still cannot reach us.
+func webhookDialControl(network, address string, _ syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil || webhookAddrBlocked(addrPort.Addr()) {
+		return errWebhookTargetBlocked
+	}
+	return nil
+}
+
+// newWebhookClient never uses a proxy (it would hide the real target from
+// the dial check) and does not follow redirects: a 3xx counts as a failed
+// delivery, so a public URL cannot bounce the request inward.
+func newWebhookClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout:   webhookResolveTimeout,
+		KeepAlive: 30 * time.Second,
+		Control:   webhookDialControl,
+	}
+	return &http.Client{
+		Timeout: webhookDeliveryTimeout,
+		Transport: &http.Transport{
+			Proxy:                 nil,
+			DialContext:           dialer.DialContext,
+			ForceAttemptHTTP2:     true,
+			MaxIdleConns:          100,
+			IdleConnTimeout:       90 * time.Second,
+			TLSHandshakeTimeout:   webhookResolveTimeout,
+			ExpectContinueTimeout: time.Second,
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
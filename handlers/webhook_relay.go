@@ -0,0 +1,602 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"genfity-wa-support/database"
+	"genfity-wa-support/models"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const (
+	maxWebhookEventBytes    = 10 << 20
+	webhookPollInterval     = 2 * time.Second
+	webhookBaseBackoff      = 10 * time.Second
+	webhookMaxBackoff       = time.Hour
+	webhookDeliveryTimeout  = 10 * time.Second
+	webhookDeliveryStaleAge = 5 * time.Minute
+	webhookRegisterInterval = time.Minute
+	// webhookResponseLogBytes is how much of the customer's response body
+	// is kept in the attempt log.
+	webhookResponseLogBytes = 2 << 10
+)
+
+var webhookClient = newWebhookClient()
+
+// webhookRelayEnabled is true when the provider can reach our ingest
+// endpoint; otherwise customer webhook URLs are handed to the provider as-is.
+func webhookRelayEnabled() bool {
+	return os.Getenv("PUBLIC_BASE_URL") != "" && os.Getenv("WEBHOOK_INGEST_SECRET") != ""
+}
+
+// ingestToken authenticates the provider's calls to the ingest endpoint
+// without storing anything per session. The scope is "<node_id>/<session_id>",
+// since provider session IDs are only unique per node; URLs registered
+// before that carry a token over the bare session ID.
+func ingestToken(scope string) string {
+	mac := hmac.New(sha256.New, []byte(os.Getenv("WEBHOOK_INGEST_SECRET")))
+	mac.Write([]byte(scope))
+	return hex.EncodeToString(mac.Sum(nil))[:32]
+}
+
+func ingestURL(session models.WhatsAppSession) string {
+	base := strings.TrimRight(os.Getenv("PUBLIC_BASE_URL"), "/")
+	nodeID := sessionNodeID(session)
+	return base + "/webhooks/ingest/" + url.PathEscape(session.SessionID) +
+		"?node=" + url.QueryEscape(nodeID) + "&key=" + ingestToken(nodeID+"/"+session.SessionID)
+}
+
+// upstreamWebhookURL is the URL registered with the provider for a session.
+func upstreamWebhookURL(session models.WhatsAppSession, customerURL string) string {
+	if webhookRelayEnabled() {
+		return ingestURL(session)
+	}
+	return customerURL
+}
+
+// setRelayRegistered records whether the provider posts the session's events
+// to the ingest endpoint. Sessions left unregistered while the relay is on
+// are picked up by registerIngestWebhooks.
+func setRelayRegistered(session models.WhatsAppSession, registered bool) {
+	registered = registered && webhookRelayEnabled()
+	if err := database.GetDB().Model(&models.WhatsAppSession{}).Where("id = ?", session.ID).
+		Update("relay_registered", registered).Error; err != nil {
+		log.Printf("Session %s relay registration flag update failed: %v", session.SessionID, err)
+	}
+}
+
+// registerIngestWebhooks points every session the relay does not cover yet
+// at the ingest endpoint: sessions created before the relay was turned on
+// and ones whose registration failed earlier.
+func registerIngestWebhooks() {
+	var sessions []models.WhatsAppSession
+	if err := database.GetDB().Where("relay_registered = ?", false).Find(&sessions).Error; err != nil {
+		log.Printf("Webhook relay registration pass failed: %v", err)
+		return
+	}
+	failed := 0
+	for _, session := range sessions {
+		provider, err := providerFor(session.Provider)
+		if err != nil {
+			failed++
+			continue
+		}
+		token, err := sessionToken(session)
+		var node models.ProviderNode
+		if err == nil {
+			node, err = resolveSessionNode(session)
+		}
+		if err == nil {
+			err = provider.SetWebhook(node, token, ingestURL(session))
+		}
+		if err != nil {
+			failed++
+			continue
+		}
+		setRelayRegistered(session, true)
+	}
+	if failed > 0 {
+		log.Printf("Webhook relay registration pending for %d session(s), retrying in %s", failed, webhookRegisterInterval)
+	}
+}
+
+// ensureWebhookSecret gives the session a signing secret on first use.
+func ensureWebhookSecret(session *models.WhatsAppSession) (string, error) {
+	if session.WebhookSecret != "" {
+		return session.WebhookSecret, nil
+	}
+	secret, _, err := generateAPIKey("whsec")
+	if err != nil {
+		return "", err
+	}
+	res := database.GetDB().Model(&models.WhatsAppSession{}).
+		Where("id = ? AND (webhook_secret IS NULL OR webhook_secret = '')", session.ID).
+		Update("webhook_secret", secret)
+	if res.Error != nil {
+		return "", res.Error
+	}
+	if res.RowsAffected == 0 {
+		// Another request set it first.
+		if err := database.GetDB().Select("webhook_secret").Where("id = ?", session.ID).First(session).Error; err != nil {
+			return "", err
+		}
+		return session.WebhookSecret, nil
+	}
+	session.WebhookSecret = secret
+	return secret, nil
+}
+
+func RotateWebhookSecret(c *gin.Context) {
+	user := c.MustGet("user").(models.ServiceUser)
+	var session models.WhatsAppSession
+	if err := database.GetDB().Where("user_id = ? AND session_id = ?", user.ID, c.Param("session_id")).First(&session).Error; err != nil {
+		respondError(c, http.StatusNotFound, codeSessionNotFound, "session not found")
+		return
+	}
+	secret, _, err := generateAPIKey("whsec")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "failed to generate webhook secret"})
+		return
+	}
+	if err := database.GetDB().Model(&models.WhatsAppSession{}).Where("id = ?", session.ID).Update("webhook_secret", secret).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "failed to rotate webhook secret"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"session_id": session.SessionID, "webhook_secret": secret})
+}
+
+// interceptWebhookPath answers /wa/webhook calls locally while the relay is
+// on, so customers cannot point the provider away from the ingest endpoint
+// or read its key. It reports whether the request was handled.
+func interceptWebhookPath(c *gin.Context, session models.WhatsAppSession, targetPath string) bool {
+	if !webhookRelayEnabled() || strings.TrimRight(targetPath, "/") != "/webhook" {
+		return false
+	}
+
+	switch c.Request.Method {
+	case http.MethodGet:
+		markUpstreamResponse(c)
+		c.JSON(http.StatusOK, gin.H{"code": http.StatusOK, "success": true, "data": gin.H{"webhook": session.WebhookURL}})
+	case http.MethodPost, http.MethodPut:
+		var req struct {
+			WebhookURL *string `json:"webhookURL"`
+			Webhook    *string `json:"webhook"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+			return true
+		}
+		target := req.WebhookURL
+		if target == nil {
+			target = req.Webhook
+		}
+		if target == nil {
+			c.JSON(http.StatusBadRequest, gin.H{"message": "webhookURL is required"})
+			return true
+		}
+		if err := validateSessionWebhookURL(*target); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+			return true
+		}
+		if err := database.GetDB().Model(&models.WhatsAppSession{}).Where("id = ?", session.ID).
+			Updates(map[string]interface{}{"webhook_url": *target, "updated_at": time.Now()}).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"message": "failed to update webhook"})
+			return true
+		}
+		if provider, err := providerFor(session.Provider); err == nil {
+			token, err := sessionToken(session)
+			var node models.ProviderNode
+			if err == nil {
+				node, err = resolveSessionNode(session)
+			}
+			if err == nil {
+				err = provider.SetWebhook(node, token, ingestURL(session))
+			}
+			if err != nil {
+				log.Printf("Session %s webhook relay registration failed, retrying in background: %v", session.SessionID, err)
+			}
+			setRelayRegistered(session, err == nil)
+		}
+		markUpstreamResponse(c)
+		c.JSON(http.StatusOK, gin.H{"code": http.StatusOK, "success": true, "data": gin.H{"webhook": *target}})
+	default:
+		return false
+	}
+	return true
+}
+
+// ingestSession authenticates an ingest call and loads its session, scoped
+// to the node in the URL. A legacy URL without a node is accepted only while
+// its session ID is unambiguous, and its session is queued for registration
+// with the scoped URL either way.
+func ingestSession(c *gin.Context) (models.WhatsAppSession, bool) {
+	sessionID := c.Param("session_id")
+	nodeID := c.Query("node")
+	scope := sessionID
+	if nodeID != "" {
+		scope = nodeID + "/" + sessionID
+	}
+	var session models.WhatsAppSession
+	if !hmac.Equal([]byte(c.Query("key")), []byte(ingestToken(scope))) {
+		c.JSON(http.StatusUnauthorized, gin.H{"message": "invalid ingest key"})
+		return session, false
+	}
+
+	db := database.GetDB()
+	if nodeID != "" {
+		query := db.Where("session_id = ?", sessionID)
+		if nodeID == models.DefaultNodeID {
+			query = query.Where("node_id = ? OR node_id = '' OR node_id IS NULL", nodeID)
+		} else {
+			query = query.Where("node_id = ?", nodeID)
+		}
+		if err := query.First(&session).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"message": "session not found"})
+			return session, false
+		}
+		return session, true
+	}
+
+	var sessions []models.WhatsAppSession
+	if err := db.Where("session_id = ?", sessionID).Limit(2).Find(&sessions).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "failed to load session"})
+		return session, false
+	}
+	if len(sessions) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"message": "session not found"})
+		return session, false
+	}
+	if err := db.Model(&models.WhatsAppSession{}).Where("session_id = ?", sessionID).
+		Update("relay_registered", false).Error; err != nil {
+		log.Printf("Session %s legacy ingest URL re-registration failed: %v", sessionID, err)
+	}
+	if len(sessions) > 1 {
+		c.JSON(http.StatusConflict, gin.H{"message": "session id is ambiguous without a node"})
+		return session, false
+	}
+	return sessions[0], true
+}
+
+// IngestWebhookEvent receives provider events for one session, stores them
+// and queues a delivery to every customer endpoint that wants the event.
+func IngestWebhookEvent(c *gin.Context) {
+	if !webhookRelayEnabled() {
+		c.JSON(http.StatusUnauthorized, gin.H{"message": "invalid ingest key"})
+		return
+	}
+	session, ok := ingestSession(c)
+	if !ok {
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(c.Request.Body, maxWebhookEventBytes+1))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "failed to read event"})
+		return
+	}
+	if len(body) > maxWebhookEventBytes {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"message": "event too large"})
+		return
+	}
+
+	eventID, err := generateID("evt")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "failed to generate event id"})
+		return
+	}
+	payload := decodeWebhookPayload(c.ContentType(), body)
+	eventType, _ := payload["type"].(string)
+	event := models.WebhookEvent{
+		ID:          eventID,
+		UserID:      session.UserID,
+		SessionID:   session.SessionID,
+		EventType:   eventType,
+		ContentType: c.GetHeader("Content-Type"),
+		Body:        body,
+	}
+
+	targets, err := sessionWebhookTargets(session)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "failed to load webhooks"})
+		return
+	}
+	deliveries := []models.WebhookDelivery{}
+	for _, target := range targets {
+		if webhookWantsEvent(target.Events, event.EventType) {
+			deliveries = append(deliveries, newWebhookDelivery(session, event, target))
+		}
+	}
+
+	err = database.GetDB().Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&event).Error; err != nil {
+			return err
+		}
+		if len(deliveries) == 0 {
+			return nil
+		}
+		return tx.Create(&deliveries).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "failed to store event"})
+		return
+	}
+
+	applySessionEvent(session, eventType, payload)
+	applyOptOutKeyword(session, payload)
+	c.JSON(http.StatusOK, gin.H{"event_id": event.ID})
+}
+
+// decodeWebhookPayload reads the provider event as JSON, or from the
+// jsonData field when it was posted as a form.
+func decodeWebhookPayload(contentType string, body []byte) map[string]interface{} {
+	raw := body
+	if strings.Contains(contentType, "form") {
+		values, err := url.ParseQuery(string(body))
+		if err != nil {
+			return map[string]interface{}{}
+		}
+		raw = []byte(values.Get("jsonData"))
+	}
+	var payload map[string]interface{}
+	if err := json.Unmarshal(raw, &payload); err != nil || payload == nil {
+		return map[string]interface{}{}
+	}
+	return payload
+}
+
+// StartWebhookRelayWorkers starts WEBHOOK_RELAY_WORKERS goroutines delivering
+// queued events, plus a sweeper for deliveries abandoned mid-attempt.
+func StartWebhookRelayWorkers() {
+	workers := getEnvInt("WEBHOOK_RELAY_WORKERS", 4)
+	for i := 0; i < workers; i++ {
+		go func() {
+			for {
+				delivery, ok := claimWebhookDelivery()
+				if !ok {
+					time.Sleep(webhookPollInterval)
+					continue
+				}
+				processWebhookDelivery(delivery)
+			}
+		}()
+	}
+
+	if webhookRelayEnabled() {
+		go func() {
+			registerIngestWebhooks()
+			ticker := time.NewTicker(webhookRegisterInterval)
+			defer ticker.Stop()
+			for range ticker.C {
+				registerIngestWebhooks()
+			}
+		}()
+	} else {
+		// With the relay off, customers can repoint the provider directly;
+		// every session is registered again once it is turned back on.
+		if err := database.GetDB().Model(&models.WhatsAppSession{}).Where("relay_registered = ?", true).
+			Update("relay_registered", false).Error; err != nil {
+			log.Printf("Webhook relay registration reset failed: %v", err)
+		}
+	}
+
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		for now := range ticker.C {
+			err := database.GetDB().Model(&models.WebhookDelivery{}).
+				Where("status = ? AND locked_at < ?", models.WebhookDeliveryDelivering, now.Add(-webhookDeliveryStaleAge)).
+				Updates(map[string]interface{}{"status": models.WebhookDeliveryPending, "next_attempt_at": now}).Error
+			if err != nil {
+				log.Printf("Webhook relay sweeper error: %v", err)
+			}
+		}
+	}()
+}
+
+func claimWebhookDelivery() (models.WebhookDelivery, bool) {
+	var delivery models.WebhookDelivery
+	now := time.Now()
+	res := database.GetDB().Raw(`
+		UPDATE wa_webhook_deliveries
+		SET status = @delivering, locked_at = @now, attempts = attempts + 1, updated_at = @now
+		WHERE id = (
+			SELECT id FROM wa_webhook_deliveries
+			WHERE status = @pending AND next_attempt_at <= @now
+			ORDER BY next_attempt_at
+			LIMIT 1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING *`,
+		map[string]interface{}{
+			"delivering": models.WebhookDeliveryDelivering,
+			"pending":    models.WebhookDeliveryPending,
+			"now":        now,
+		}).Scan(&delivery)
+	if res.Error != nil {
+		log.Printf("Webhook relay claim error: %v", res.Error)
+		return delivery, false
+	}
+	return delivery, res.RowsAffected > 0 && delivery.ID != 0
+}
+
+func processWebhookDelivery(delivery models.WebhookDelivery) {
+	db := database.GetDB()
+	var event models.WebhookEvent
+	if err := db.Where("id = ?", delivery.EventID).First(&event).Error; err != nil {
+		deadLetterWebhookDelivery(delivery, 0, "event not found")
+		return
+	}
+	var session models.WhatsAppSession
+	if err := db.Where("user_id = ? AND session_id = ?", delivery.UserID, delivery.SessionID).First(&session).Error; err != nil {
+		deadLetterWebhookDelivery(delivery, 0, "session not found")
+		return
+	}
+	secret, headers := "", map[string]string(nil)
+	if delivery.WebhookID == "" {
+		var err error
+		if secret, err = ensureWebhookSecret(&session); err != nil {
+			retryWebhookDelivery(delivery, 0, "failed to load webhook secret")
+			return
+		}
+	} else {
+		var endpoint models.SessionWebhook
+		if err := db.Where("id = ?", delivery.WebhookID).First(&endpoint).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				deadLetterWebhookDelivery(delivery, 0, "webhook endpoint deleted")
+			} else {
+				retryWebhookDelivery(delivery, 0, "failed to load webhook endpoint")
+			}
+			return
+		}
+		if !endpoint.Enabled {
+			deadLetterWebhookDelivery(delivery, 0, "webhook endpoint disabled")
+			return
+		}
+		secret, headers = endpoint.Secret, webhookHeaderValues(endpoint.Headers)
+	}
+
+	started := time.Now()
+	status, responseBody, err := sendWebhook(delivery.TargetURL, secret, headers, event)
+	attempt := models.WebhookDeliveryAttempt{
+		DeliveryID:   delivery.ID,
+		EventID:      delivery.EventID,
+		SessionID:    delivery.SessionID,
+		Attempt:      delivery.Attempts,
+		HTTPStatus:   status,
+		LatencyMs:    time.Since(started).Milliseconds(),
+		ResponseBody: responseBody,
+		// sendWebhook dials through the target guard, so any response it
+		// returns came from an allowed address.
+		BodyVisible: status > 0,
+	}
+	if err != nil {
+		attempt.Error = err.Error()
+	}
+	if err := db.Create(&attempt).Error; err != nil {
+		log.Printf("Webhook delivery %d attempt log error: %v", delivery.ID, err)
+	}
+
+	switch {
+	case errors.Is(err, errWebhookTargetBlocked):
+		deadLetterWebhookDelivery(delivery, 0, err.Error())
+	case err != nil:
+		retryWebhookDelivery(delivery, 0, err.Error())
+	case status >= 200 && status < 300:
+		now := time.Now()
+		err := db.Model(&models.WebhookDelivery{}).Where("id = ?", delivery.ID).Updates(map[string]interface{}{
+			"status":       models.WebhookDeliveryDelivered,
+			"last_status":  status,
+			"last_error":   "",
+			"delivered_at": now,
+			"locked_at":    nil,
+		}).Error
+		if err != nil {
+			log.Printf("Webhook delivery %d finish error: %v", delivery.ID, err)
+		}
+	default:
+		retryWebhookDelivery(delivery, status, fmt.Sprintf("customer endpoint returned %d", status))
+	}
+}
+
+// sendWebhook posts the stored event body to target with the endpoint's
+// own headers and returns the status and the head of the response body.
+// The signature covers "<timestamp>.<body>" so receivers can reject replays
+// of old requests.
+func sendWebhook(target, secret string, headers map[string]string, event models.WebhookEvent) (int, string, error) {
+	req, err := http.NewRequest(http.MethodPost, target, bytes.NewReader(event.Body))
+	if err != nil {
+		return 0, "", err
+	}
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	contentType := event.ContentType
+	if contentType == "" {
+		contentType = "application/json"
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("User-Agent", "genfity-wa-support-webhook")
+	req.Header.Set("X-Webhook-Id", event.ID)
+	req.Header.Set("X-Webhook-Event", event.EventType)
+	req.Header.Set("X-Webhook-Session", event.SessionID)
+	req.Header.Set("X-Webhook-Timestamp", timestamp)
+	req.Header.Set("X-Webhook-Signature", "sha256="+signWebhook(secret, timestamp, event.Body))
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+	head, _ := io.ReadAll(io.LimitReader(resp.Body, webhookResponseLogBytes))
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	return resp.StatusCode, strings.ReplaceAll(strings.ToValidUTF8(string(head), ""), "\x00", ""), nil
+}
+
+func signWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func retryWebhookDelivery(delivery models.WebhookDelivery, status int, reason string) {
+	if delivery.Attempts >= delivery.MaxAttempts {
+		deadLetterWebhookDelivery(delivery, status, reason)
+		return
+	}
+	err := database.GetDB().Model(&models.WebhookDelivery{}).Where("id = ?", delivery.ID).Updates(map[string]interface{}{
+		"status":          models.WebhookDeliveryPending,
+		"next_attempt_at": time.Now().Add(retryBackoff(delivery.Attempts, webhookBaseBackoff, webhookMaxBackoff)),
+		"last_status":     status,
+		"last_error":      reason,
+		"locked_at":       nil,
+	}).Error
+	if err != nil {
+		log.Printf("Webhook delivery %d reschedule error: %v", delivery.ID, err)
+	}
+}
+
+// deadLetterWebhookDelivery parks a delivery that will not be retried.
+func deadLetterWebhookDelivery(delivery models.WebhookDelivery, status int, reason string) {
+	err := database.GetDB().Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&models.WebhookDelivery{}).Where("id = ?", delivery.ID).Updates(map[string]interface{}{
+			"status":      models.WebhookDeliveryDead,
+			"last_status": status,
+			"last_error":  reason,
+			"locked_at":   nil,
+		}).Error; err != nil {
+			return err
+		}
+		return tx.Create(&models.WebhookDeadLetter{
+			DeliveryID: delivery.ID,
+			EventID:    delivery.EventID,
+			UserID:     delivery.UserID,
+			SessionID:  delivery.SessionID,
+			TargetURL:  delivery.TargetURL,
+			Attempts:   delivery.Attempts,
+			LastStatus: status,
+			LastError:  reason,
+		}).Error
+	})
+	if err != nil {
+		log.Printf("Webhook delivery %d dead-letter error: %v", delivery.ID, err)
+	}
+}
@@ -19,7 +19,14 @@ func main() {
 
 	// Initialize database
 	database.InitDatabase()
+	handlers.InitSessionTokens()
 	database.StartSubscriptionExpiryCron()
+	handlers.StartMessageQueueWorkers()
+	handlers.StartScheduledMessageDispatcher()
+	handlers.StartProviderHealthChecks()
+	handlers.StartWebhookRelayWorkers()
+	handlers.StartSessionReconciler()
+	handlers.StartReconnectWatchdog()
 
 	// Setup Gin router
 	router := gin.Default()
@@ -28,7 +35,8 @@ func main() {
 	router.Use(func(c *gin.Context) {
 		c.Header("Access-Control-Allow-Origin", "*")
 		c.Header("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		c.Header("Access-Control-Allow-Headers", "Content-Type, Authorization, token, x-api-key, x-internal-api-key")
+		c.Header("Access-Control-Allow-Headers", "Content-Type, Authorization, token, x-api-key, x-internal-api-key, Idempotency-Key, X-Response-Envelope")
+		c.Header("Access-Control-Expose-Headers", "X-RateLimit-Limit, X-RateLimit-Remaining, X-RateLimit-Reset, Retry-After, Idempotent-Replayed")
 
 		if c.Request.Method == "OPTIONS" {
 			c.AbortWithStatus(204)
@@ -45,6 +53,10 @@ func main() {
 	router.GET("/health", handlers.HealthCheck)
 	router.HEAD("/health", handlers.HealthCheck)
 
+	// Provider event ingestion for the webhook relay, authenticated by the
+	// per-session key in the registered URL.
+	router.POST("/webhooks/ingest/:session_id", handlers.IngestWebhookEvent)
+
 	internal := router.Group("/internal")
 	internal.Use(handlers.InternalAPIKeyMiddleware())
 	{
@@ -54,12 +66,28 @@ func main() {
 		internal.PUT("/users/:user_id", handlers.InternalUpdateUser)
 		internal.GET("/users/:user_id/apikey", handlers.InternalGetUserAPIKey)
 		internal.POST("/users/:user_id/apikey/rotate", handlers.InternalRotateUserAPIKey)
+		internal.GET("/users/:user_id/ledger", handlers.InternalListSendLedger)
+		internal.GET("/users/:user_id/blocklist", handlers.InternalListBlocklist)
+		internal.POST("/users/:user_id/blocklist", handlers.InternalAddBlocklist)
+		internal.POST("/users/:user_id/blocklist/remove", handlers.InternalRemoveBlocklist)
+		internal.DELETE("/users/:user_id/blocklist/:recipient", handlers.InternalRemoveBlocklistRecipient)
+		internal.GET("/users/:user_id/policies", handlers.InternalListUserPolicies)
+		internal.POST("/users/:user_id/policies", handlers.InternalCreateUserPolicy)
+		internal.DELETE("/users/:user_id/policies/:policy_id", handlers.InternalDeleteUserPolicy)
+		internal.GET("/policies", handlers.InternalListPlanPolicies)
+		internal.POST("/policies", handlers.InternalCreatePlanPolicy)
+		internal.DELETE("/policies/:policy_id", handlers.InternalDeletePlanPolicy)
+		internal.GET("/nodes", handlers.InternalListProviderNodes)
+		internal.POST("/nodes", handlers.InternalCreateProviderNode)
+		internal.PUT("/nodes/:node_id", handlers.InternalUpdateProviderNode)
+		internal.GET("/reconcile", handlers.InternalGetReconcileReport)
+		internal.POST("/reconcile", handlers.InternalRunReconcile)
 	}
 
 	public := router.Group("/v1")
-	public.Use(handlers.PublicRateLimiter(), handlers.CustomerAPIKeyMiddleware())
+	public.Use(handlers.ResponseEnvelope(), handlers.PublicRateLimiter(), handlers.CustomerAPIKeyMiddleware(), handlers.ProviderParamMiddleware(), handlers.SubscriptionRateLimiter())
 	wa := router.Group("/wa")
-	wa.Use(handlers.PublicRateLimiter())
+	wa.Use(handlers.ResponseEnvelope(), handlers.PublicRateLimiter(), handlers.SubscriptionRateLimiter())
 	{
 		public.GET("/me", handlers.GetCurrentUser)
 		public.GET("/sessions", handlers.ListSessions)
@@ -68,8 +96,34 @@ func main() {
 		public.DELETE("/sessions/:session_id", handlers.DeleteSession)
 		public.GET("/sessions/:session_id/settings", handlers.GetSessionSettings)
 		public.PUT("/sessions/:session_id/settings", handlers.UpdateSessionSettings)
+		public.GET("/sessions/:session_id/status/history", handlers.ListSessionStatusHistory)
+		public.GET("/sessions/:session_id/qr", handlers.GetSessionQR)
+		public.GET("/sessions/:session_id/qr/stream", handlers.StreamSessionQR)
+		public.POST("/sessions/:session_id/pair", handlers.PairSession)
+		public.POST("/sessions/:session_id/token/rotate", handlers.RotateSessionToken)
+		public.POST("/sessions/:session_id/webhook/secret/rotate", handlers.RotateWebhookSecret)
+		public.GET("/sessions/:session_id/webhooks", handlers.ListSessionWebhooks)
+		public.POST("/sessions/:session_id/webhooks", handlers.CreateSessionWebhook)
+		public.GET("/sessions/:session_id/webhooks/:webhook_id", handlers.GetSessionWebhook)
+		public.PUT("/sessions/:session_id/webhooks/:webhook_id", handlers.UpdateSessionWebhook)
+		public.DELETE("/sessions/:session_id/webhooks/:webhook_id", handlers.DeleteSessionWebhook)
+		public.POST("/sessions/:session_id/webhooks/:webhook_id/secret/rotate", handlers.RotateSessionWebhookSecret)
+		public.GET("/sessions/:session_id/webhooks/deliveries", handlers.ListWebhookDeliveries)
+		public.POST("/sessions/:session_id/webhooks/deliveries/replay", handlers.ReplayWebhookDeliveries)
+		public.GET("/sessions/:session_id/webhooks/deliveries/:delivery_id", handlers.GetWebhookDelivery)
+		public.POST("/sessions/:session_id/webhooks/deliveries/:delivery_id/replay", handlers.ReplayWebhookDelivery)
 		public.GET("/sessions/:session_id/contacts", handlers.ListSessionContacts)
 		public.POST("/sessions/:session_id/contacts/sync", handlers.SyncSessionContacts)
+		public.POST("/sessions/:session_id/messages", handlers.SendSessionMessage)
+		public.GET("/sessions/:session_id/scheduled", handlers.ListScheduledMessages)
+		public.POST("/sessions/:session_id/scheduled", handlers.CreateScheduledMessage)
+		public.DELETE("/sessions/:session_id/scheduled/:scheduled_id", handlers.CancelScheduledMessage)
+		public.GET("/messages/:job_id", handlers.GetMessageJob)
+		public.GET("/ledger", handlers.ListSendLedger)
+		public.GET("/blocklist", handlers.ListBlocklist)
+		public.POST("/blocklist", handlers.AddBlocklist)
+		public.POST("/blocklist/remove", handlers.RemoveBlocklist)
+		public.DELETE("/blocklist/:recipient", handlers.RemoveBlocklistRecipient)
 
 		wa.Any("/*path", handlers.WhatsAppGateway)
 	}
@@ -54,32 +54,79 @@ type UserSubscription struct {
 	ID          uint               `json:"id" gorm:"primaryKey"`
 	UserID      string             `json:"user_id" gorm:"type:varchar(64);index;not null"`
 	Provider    string             `json:"provider" gorm:"type:varchar(32);default:'genfity-wa';index"`
+	Plan        string             `json:"plan" gorm:"type:varchar(32);default:'basic';index"`
 	MaxSessions int                `json:"max_sessions" gorm:"default:1"`
 	MaxMessages int                `json:"max_messages" gorm:"default:0"`
 	ExpiresAt   time.Time          `json:"expires_at" gorm:"index;not null"`
 	Status      SubscriptionStatus `json:"status" gorm:"type:varchar(16);default:'active';index"`
 	CreatedAt   time.Time          `json:"created_at"`
 	UpdatedAt   time.Time          `json:"updated_at"`
+
+	// Quota ledger, shared by every session of the user. MessagesUsed is reset
+	// at the start of every quota period unless QuotaPeriod is "none".
+	MessagesUsed     int64       `json:"messages_used" gorm:"default:0"`
+	MessagesReserved int64       `json:"messages_reserved" gorm:"default:0"`
+	QuotaPeriod      QuotaPeriod `json:"quota_period" gorm:"type:varchar(16);default:'none'"`
+	QuotaAnchorAt    *time.Time  `json:"quota_anchor_at"`
+	QuotaTimezone    string      `json:"quota_timezone" gorm:"type:varchar(64);default:'Asia/Jakarta'"`
+	QuotaPeriodStart *time.Time  `json:"quota_period_start"`
+	QuotaPeriodEnd   *time.Time  `json:"quota_period_end" gorm:"index"`
 }
 
 func (UserSubscription) TableName() string {
 	return "wa_user_subscriptions"
 }
 
+type QuotaReservationStatus string
+
+const (
+	QuotaReserved  QuotaReservationStatus = "reserved"
+	QuotaCommitted QuotaReservationStatus = "committed"
+	QuotaReleased  QuotaReservationStatus = "released"
+)
+
+// QuotaReservation is one message unit held against a subscription while the
+// send is in flight. Reservations not settled before ExpiresAt are released
+// by the expiry cron.
+type QuotaReservation struct {
+	ID             uint                   `json:"id" gorm:"primaryKey"`
+	SubscriptionID uint                   `json:"subscription_id" gorm:"index;not null"`
+	UserID         string                 `json:"user_id" gorm:"type:varchar(64);index;not null"`
+	SessionID      string                 `json:"session_id" gorm:"type:varchar(128);index"`
+	Status         QuotaReservationStatus `json:"status" gorm:"type:varchar(16);default:'reserved';index"`
+	ExpiresAt      time.Time              `json:"expires_at" gorm:"index;not null"`
+	CreatedAt      time.Time              `json:"created_at"`
+	UpdatedAt      time.Time              `json:"updated_at"`
+}
+
+func (QuotaReservation) TableName() string {
+	return "wa_quota_reservations"
+}
+
 type WhatsAppSession struct {
 	ID              uint       `json:"id" gorm:"primaryKey"`
 	UserID          string     `json:"user_id" gorm:"type:varchar(64);index;not null"`
 	Provider        string     `json:"provider" gorm:"type:varchar(32);default:'genfity-wa';index"`
+	NodeID          string     `json:"node_id" gorm:"type:varchar(64);index"`
 	SessionID       string     `json:"session_id" gorm:"type:varchar(128);index;not null"`
 	SessionName     string     `json:"session_name" gorm:"type:varchar(255)"`
-	SessionToken    string     `json:"session_token" gorm:"type:text;uniqueIndex"`
+	TokenCipher     string     `json:"-" gorm:"column:session_token;type:text"`
+	TokenHash       string     `json:"-" gorm:"type:varchar(64);uniqueIndex"`
+	PrevTokenHash   string     `json:"-" gorm:"type:varchar(64);index"`
+	PrevTokenUntil  *time.Time `json:"-"`
+	TokenDisplay    string     `json:"session_token,omitempty" gorm:"-"`
 	WebhookURL      string     `json:"webhook_url" gorm:"type:text"`
+	WebhookSecret   string     `json:"-" gorm:"type:varchar(128)"`
+	RelayRegistered bool       `json:"-" gorm:"default:false;index"`
+	Events          string     `json:"events" gorm:"type:varchar(512)"`
 	Connected       bool       `json:"connected" gorm:"default:false"`
 	LoggedIn        bool       `json:"logged_in" gorm:"default:false"`
 	JID             string     `json:"jid" gorm:"type:varchar(255)"`
 	Status          string     `json:"status" gorm:"type:varchar(64);default:'inactive';index"`
 	LastSyncedAt    *time.Time `json:"last_synced_at"`
 	LastActivityAt  *time.Time `json:"last_activity_at"`
+	ReconnectTries  int        `json:"reconnect_tries" gorm:"default:0"`
+	NextReconnectAt *time.Time `json:"next_reconnect_at,omitempty" gorm:"index"`
 	LastMessageSent int64      `json:"last_message_sent" gorm:"default:0"`
 	LastMessageFail int64      `json:"last_message_fail" gorm:"default:0"`
 	CreatedAt       time.Time  `json:"created_at"`
@@ -124,8 +171,10 @@ func (SessionContact) TableName() string {
 	return "wa_session_contacts"
 }
 
+// GatewayResponse is the opt-in envelope for /v1 and /wa responses.
 type GatewayResponse struct {
 	Status  int         `json:"status"`
+	Code    string      `json:"code"`
 	Message string      `json:"message"`
 	Data    interface{} `json:"data,omitempty"`
 }
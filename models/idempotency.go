@@ -0,0 +1,31 @@
+package models
+
+import "time"
+
+type IdempotencyStatus string
+
+const (
+	IdempotencyInFlight  IdempotencyStatus = "in_flight"
+	IdempotencyCompleted IdempotencyStatus = "completed"
+)
+
+// IdempotencyRecord remembers the first upstream response for an
+// Idempotency-Key so retries of the same gateway call can be replayed.
+type IdempotencyRecord struct {
+	ID             uint              `json:"id" gorm:"primaryKey"`
+	SessionID      string            `json:"session_id" gorm:"type:varchar(128);not null;uniqueIndex:idx_wa_idempotency_session_key"`
+	IdempotencyKey string            `json:"idempotency_key" gorm:"type:varchar(255);not null;uniqueIndex:idx_wa_idempotency_session_key"`
+	Method         string            `json:"method" gorm:"type:varchar(16)"`
+	Path           string            `json:"path" gorm:"type:text"`
+	Status         IdempotencyStatus `json:"status" gorm:"type:varchar(16);index"`
+	ResponseStatus int               `json:"response_status"`
+	ContentType    string            `json:"content_type" gorm:"type:varchar(255)"`
+	ResponseBody   []byte            `json:"-" gorm:"type:bytea"`
+	ExpiresAt      time.Time         `json:"expires_at" gorm:"index;not null"`
+	CreatedAt      time.Time         `json:"created_at"`
+	UpdatedAt      time.Time         `json:"updated_at"`
+}
+
+func (IdempotencyRecord) TableName() string {
+	return "wa_idempotency_keys"
+}
@@ -0,0 +1,37 @@
+package models
+
+import "time"
+
+type MessageJobStatus string
+
+const (
+	MessageJobQueued     MessageJobStatus = "queued"
+	MessageJobProcessing MessageJobStatus = "processing"
+	MessageJobSucceeded  MessageJobStatus = "succeeded"
+	MessageJobFailed     MessageJobStatus = "failed"
+)
+
+// MessageJob is an outbound send accepted with ?async=true and dispatched by
+// the queue workers, retried with exponential backoff until MaxAttempts.
+type MessageJob struct {
+	ID             string           `json:"job_id" gorm:"primaryKey;type:varchar(64)"`
+	UserID         string           `json:"user_id" gorm:"type:varchar(64);index;not null"`
+	SessionID      string           `json:"session_id" gorm:"type:varchar(128);index;not null"`
+	MessageType    string           `json:"type" gorm:"type:varchar(64)"`
+	Payload        JSONB            `json:"payload" gorm:"type:jsonb"`
+	Status         MessageJobStatus `json:"status" gorm:"type:varchar(16);default:'queued';index"`
+	Attempts       int              `json:"attempts" gorm:"default:0"`
+	MaxAttempts    int              `json:"max_attempts" gorm:"default:5"`
+	NextAttemptAt  time.Time        `json:"next_attempt_at" gorm:"index"`
+	LockedAt       *time.Time       `json:"-"`
+	LastError      string           `json:"last_error,omitempty" gorm:"type:text"`
+	ResponseStatus int              `json:"response_status,omitempty"`
+	ResponseBody   string           `json:"response_body,omitempty" gorm:"type:text"`
+	CompletedAt    *time.Time       `json:"completed_at"`
+	CreatedAt      time.Time        `json:"created_at"`
+	UpdatedAt      time.Time        `json:"updated_at"`
+}
+
+func (MessageJob) TableName() string {
+	return "wa_message_jobs"
+}
@@ -0,0 +1,30 @@
+package models
+
+import "time"
+
+type PolicyEffect string
+
+const (
+	PolicyAllow PolicyEffect = "allow"
+	PolicyDeny  PolicyEffect = "deny"
+)
+
+// PathPolicyRule allows or denies /wa gateway calls by method and path glob.
+// A rule is attached either to a plan (UserSubscription.Plan) or to a single
+// subscription; subscription rules are evaluated before plan rules.
+type PathPolicyRule struct {
+	ID             uint         `json:"id" gorm:"primaryKey"`
+	Plan           string       `json:"plan,omitempty" gorm:"type:varchar(32);index"`
+	SubscriptionID *uint        `json:"subscription_id,omitempty" gorm:"index"`
+	Effect         PolicyEffect `json:"effect" gorm:"type:varchar(8);not null"`
+	Method         string       `json:"method" gorm:"type:varchar(64);default:'*'"`
+	PathGlob       string       `json:"path_glob" gorm:"type:varchar(255);not null"`
+	Entitlement    string       `json:"entitlement" gorm:"type:varchar(64)"`
+	Priority       int          `json:"priority" gorm:"default:100"`
+	CreatedAt      time.Time    `json:"created_at"`
+	UpdatedAt      time.Time    `json:"updated_at"`
+}
+
+func (PathPolicyRule) TableName() string {
+	return "wa_path_policies"
+}
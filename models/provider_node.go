@@ -0,0 +1,43 @@
+package models
+
+import (
+	"strings"
+	"time"
+)
+
+type ProviderNodeStatus string
+
+const (
+	NodeHealthy  ProviderNodeStatus = "healthy"
+	NodeDead     ProviderNodeStatus = "dead"
+	NodeDraining ProviderNodeStatus = "draining"
+)
+
+// DefaultNodeID is the node seeded from WA_SERVER_URL; sessions created before
+// node placement existed (empty NodeID) live on it.
+const DefaultNodeID = "default"
+
+// ProviderNode is one provider backend (e.g. a genfity-wa instance). New
+// sessions are only placed on healthy nodes below Capacity (0 = unlimited).
+type ProviderNode struct {
+	ID            string             `json:"id" gorm:"primaryKey;type:varchar(64)"`
+	Provider      string             `json:"provider" gorm:"type:varchar(32);default:'genfity-wa';index"`
+	BaseURL       string             `json:"base_url" gorm:"type:text;not null"`
+	AdminToken    string             `json:"-" gorm:"type:text"`
+	Capacity      int                `json:"capacity" gorm:"default:0"`
+	Status        ProviderNodeStatus `json:"status" gorm:"type:varchar(16);default:'healthy';index"`
+	FailCount     int                `json:"fail_count" gorm:"default:0"`
+	LastError     string             `json:"last_error,omitempty" gorm:"type:text"`
+	LastCheckedAt *time.Time         `json:"last_checked_at"`
+	CreatedAt     time.Time          `json:"created_at"`
+	UpdatedAt     time.Time          `json:"updated_at"`
+}
+
+func (ProviderNode) TableName() string {
+	return "wa_provider_nodes"
+}
+
+// URL joins the node base URL with a provider path.
+func (n ProviderNode) URL(path string) string {
+	return strings.TrimRight(n.BaseURL, "/") + path
+}
@@ -0,0 +1,103 @@
+package models
+
+import (
+	"strings"
+	"time"
+)
+
+type QuotaPeriod string
+
+const (
+	QuotaPeriodNone    QuotaPeriod = "none"
+	QuotaPeriodDaily   QuotaPeriod = "daily"
+	QuotaPeriodWeekly  QuotaPeriod = "weekly"
+	QuotaPeriodMonthly QuotaPeriod = "monthly"
+)
+
+// DefaultQuotaTimezone matches the timezone the expiry cron runs in.
+const DefaultQuotaTimezone = "Asia/Jakarta"
+
+// ParseQuotaPeriod accepts an empty value as QuotaPeriodNone.
+func ParseQuotaPeriod(raw string) (QuotaPeriod, bool) {
+	switch p := QuotaPeriod(strings.ToLower(strings.TrimSpace(raw))); p {
+	case "", QuotaPeriodNone:
+		return QuotaPeriodNone, true
+	case QuotaPeriodDaily, QuotaPeriodWeekly, QuotaPeriodMonthly:
+		return p, true
+	default:
+		return "", false
+	}
+}
+
+// IsPeriodic reports whether the quota counter resets on a schedule.
+func (p QuotaPeriod) IsPeriodic() bool {
+	return p == QuotaPeriodDaily || p == QuotaPeriodWeekly || p == QuotaPeriodMonthly
+}
+
+// QuotaLocation returns the timezone quota windows are computed in.
+func (s UserSubscription) QuotaLocation() *time.Location {
+	name := s.QuotaTimezone
+	if name == "" {
+		name = DefaultQuotaTimezone
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
+
+// QuotaWindow returns the quota period containing now. Windows start at the
+// anchor's wall-clock time in the subscription timezone; monthly windows on
+// days the month does not have (e.g. the 31st) start on the month's last day.
+func (s UserSubscription) QuotaWindow(now time.Time) (start, end time.Time, ok bool) {
+	if !s.QuotaPeriod.IsPeriodic() {
+		return time.Time{}, time.Time{}, false
+	}
+	loc := s.QuotaLocation()
+	anchor := s.CreatedAt
+	if s.QuotaAnchorAt != nil {
+		anchor = *s.QuotaAnchorAt
+	}
+	anchor = anchor.In(loc)
+	now = now.In(loc)
+
+	step := func(n int) time.Time {
+		switch s.QuotaPeriod {
+		case QuotaPeriodDaily:
+			return anchor.AddDate(0, 0, n)
+		case QuotaPeriodWeekly:
+			return anchor.AddDate(0, 0, 7*n)
+		default:
+			return addMonthsClamped(anchor, n)
+		}
+	}
+
+	var n int
+	switch s.QuotaPeriod {
+	case QuotaPeriodDaily:
+		n = int(now.Sub(anchor).Hours() / 24)
+	case QuotaPeriodWeekly:
+		n = int(now.Sub(anchor).Hours() / (24 * 7))
+	default:
+		n = (now.Year()-anchor.Year())*12 + int(now.Month()) - int(anchor.Month())
+	}
+	// The estimate can be off by one around DST changes and month lengths.
+	for step(n).After(now) {
+		n--
+	}
+	for !step(n + 1).After(now) {
+		n++
+	}
+	return step(n), step(n + 1), true
+}
+
+func addMonthsClamped(t time.Time, months int) time.Time {
+	year, month, day := t.Date()
+	first := time.Date(year, month+time.Month(months), 1, t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), t.Location())
+	lastDay := first.AddDate(0, 1, -1).Day()
+	if day > lastDay {
+		day = lastDay
+	}
+	return time.Date(first.Year(), first.Month(), day, t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), t.Location())
+}
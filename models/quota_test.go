@@ -0,0 +1,60 @@
+package models
+
+import (
+	"testing"
+	"time"
+)
+
+func TestQuotaWindow(t *testing.T) {
+	jakarta, err := time.LoadLocation(DefaultQuotaTimezone)
+	if err != nil {
+		t.Skipf("timezone data unavailable: %v", err)
+	}
+	at := func(year int, month time.Month, day, hour int) time.Time {
+		return time.Date(year, month, day, hour, 0, 0, 0, jakarta)
+	}
+	for _, tc := range []struct {
+		name       string
+		period     QuotaPeriod
+		anchor     time.Time
+		now        time.Time
+		start, end time.Time
+	}{
+		{"daily same day", QuotaPeriodDaily, at(2026, 1, 1, 9), at(2026, 1, 1, 10), at(2026, 1, 1, 9), at(2026, 1, 2, 9)},
+		{"daily before anchor hour", QuotaPeriodDaily, at(2026, 1, 1, 9), at(2026, 1, 5, 8), at(2026, 1, 4, 9), at(2026, 1, 5, 9)},
+		{"daily at boundary", QuotaPeriodDaily, at(2026, 1, 1, 9), at(2026, 1, 5, 9), at(2026, 1, 5, 9), at(2026, 1, 6, 9)},
+		{"weekly", QuotaPeriodWeekly, at(2026, 1, 1, 0), at(2026, 1, 20, 12), at(2026, 1, 15, 0), at(2026, 1, 22, 0)},
+		{"monthly", QuotaPeriodMonthly, at(2026, 1, 15, 0), at(2026, 3, 20, 0), at(2026, 3, 15, 0), at(2026, 4, 15, 0)},
+		{"monthly before anchor day", QuotaPeriodMonthly, at(2026, 1, 15, 0), at(2026, 3, 10, 0), at(2026, 2, 15, 0), at(2026, 3, 15, 0)},
+		{"monthly clamps to short month", QuotaPeriodMonthly, at(2026, 1, 31, 0), at(2026, 2, 28, 12), at(2026, 2, 28, 0), at(2026, 3, 31, 0)},
+		{"monthly across years", QuotaPeriodMonthly, at(2025, 11, 30, 0), at(2026, 1, 5, 0), at(2025, 12, 30, 0), at(2026, 1, 30, 0)},
+	} {
+		anchor := tc.anchor
+		sub := UserSubscription{QuotaPeriod: tc.period, QuotaAnchorAt: &anchor}
+		start, end, ok := sub.QuotaWindow(tc.now.UTC())
+		if !ok || !start.Equal(tc.start) || !end.Equal(tc.end) {
+			t.Errorf("%s: QuotaWindow = %v, %v, %v, want %v, %v", tc.name, start, end, ok, tc.start, tc.end)
+		}
+	}
+
+	if _, _, ok := (UserSubscription{QuotaPeriod: QuotaPeriodNone}).QuotaWindow(time.Now()); ok {
+		t.Error("QuotaWindow returned a window for a lifetime quota")
+	}
+}
+
+func TestParseQuotaPeriod(t *testing.T) {
+	for raw, want := range map[string]QuotaPeriod{
+		"":          QuotaPeriodNone,
+		"none":      QuotaPeriodNone,
+		" Daily ":   QuotaPeriodDaily,
+		"WEEKLY":    QuotaPeriodWeekly,
+		"monthly":   QuotaPeriodMonthly,
+		"yearly":    "",
+		"every-day": "",
+	} {
+		got, ok := ParseQuotaPeriod(raw)
+		if got != want || ok != (want != "") {
+			t.Errorf("ParseQuotaPeriod(%q) = %q, %v, want %q", raw, got, ok, want)
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package models
+
+import "time"
+
+// Shared rate limiter state, used when RATE_LIMIT_BACKEND=postgres so that all
+// replicas enforce the same limits. Rows past ExpiresAt are pruned by the janitor.
+
+type RateLimitCounter struct {
+	LimitKey  string    `gorm:"primaryKey;type:varchar(191)"`
+	Count     int       `gorm:"not null;default:0"`
+	WindowEnd time.Time `gorm:"index;not null"`
+}
+
+func (RateLimitCounter) TableName() string {
+	return "wa_rate_limit_counters"
+}
+
+type RateLimitBlock struct {
+	LimitKey string    `gorm:"primaryKey;type:varchar(191)"`
+	Until    time.Time `gorm:"index;not null"`
+}
+
+func (RateLimitBlock) TableName() string {
+	return "wa_rate_limit_blocks"
+}
+
+type RateLimitBucket struct {
+	LimitKey    string    `gorm:"primaryKey;type:varchar(191)"`
+	Tokens      float64   `gorm:"not null"`
+	LastAllowed bool      `gorm:"not null;default:false"`
+	UpdatedAt   time.Time `gorm:"not null"`
+	ExpiresAt   time.Time `gorm:"index;not null"`
+}
+
+func (RateLimitBucket) TableName() string {
+	return "wa_rate_limit_buckets"
+}
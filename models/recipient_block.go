@@ -0,0 +1,25 @@
+package models
+
+import "time"
+
+const (
+	BlockSourceCustomer = "customer"
+	BlockSourceInternal = "internal"
+	BlockSourceKeyword  = "stop_keyword"
+)
+
+// RecipientBlock is one opted-out recipient for a user. Recipient holds the
+// normalized form (E.164 digits, or the full JID for groups/channels) and
+// applies to every session the user owns.
+type RecipientBlock struct {
+	ID        uint      `json:"id" gorm:"primaryKey"`
+	UserID    string    `json:"user_id" gorm:"type:varchar(64);not null;uniqueIndex:idx_wa_recipient_blocks_user_recipient"`
+	Recipient string    `json:"recipient" gorm:"type:varchar(128);not null;uniqueIndex:idx_wa_recipient_blocks_user_recipient"`
+	Reason    string    `json:"reason" gorm:"type:varchar(255)"`
+	Source    string    `json:"source" gorm:"type:varchar(32)"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (RecipientBlock) TableName() string {
+	return "wa_recipient_blocks"
+}
@@ -0,0 +1,16 @@
+package models
+
+import "time"
+
+// ReconcileOrphan records when the reconciler first saw a provider session
+// with no wa_sessions row, so the orphan grace period survives restarts and
+// is shared by every instance.
+type ReconcileOrphan struct {
+	NodeID      string    `json:"node_id" gorm:"primaryKey;type:varchar(64)"`
+	SessionID   string    `json:"session_id" gorm:"primaryKey;type:varchar(128)"`
+	FirstSeenAt time.Time `json:"first_seen_at"`
+}
+
+func (ReconcileOrphan) TableName() string {
+	return "wa_reconcile_orphans"
+}
@@ -0,0 +1,35 @@
+package models
+
+import "time"
+
+type ScheduledMessageStatus string
+
+const (
+	ScheduledMessagePending   ScheduledMessageStatus = "scheduled"
+	ScheduledMessageSending   ScheduledMessageStatus = "sending"
+	ScheduledMessageSent      ScheduledMessageStatus = "sent"
+	ScheduledMessageFailed    ScheduledMessageStatus = "failed"
+	ScheduledMessageCancelled ScheduledMessageStatus = "cancelled"
+)
+
+// ScheduledMessage is a send queued for a future time and dispatched once by
+// the scheduled message dispatcher.
+type ScheduledMessage struct {
+	ID             string                 `json:"scheduled_id" gorm:"primaryKey;type:varchar(64)"`
+	UserID         string                 `json:"user_id" gorm:"type:varchar(64);index;not null"`
+	SessionID      string                 `json:"session_id" gorm:"type:varchar(128);index;not null"`
+	MessageType    string                 `json:"type" gorm:"type:varchar(64)"`
+	Payload        JSONB                  `json:"payload" gorm:"type:jsonb"`
+	SendAt         time.Time              `json:"send_at" gorm:"index;not null"`
+	Status         ScheduledMessageStatus `json:"status" gorm:"type:varchar(16);default:'scheduled';index"`
+	LastError      string                 `json:"last_error,omitempty" gorm:"type:text"`
+	ResponseStatus int                    `json:"response_status,omitempty"`
+	ResponseBody   string                 `json:"response_body,omitempty" gorm:"type:text"`
+	DispatchedAt   *time.Time             `json:"dispatched_at"`
+	CreatedAt      time.Time              `json:"created_at"`
+	UpdatedAt      time.Time              `json:"updated_at"`
+}
+
+func (ScheduledMessage) TableName() string {
+	return "wa_scheduled_messages"
+}
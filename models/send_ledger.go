@@ -0,0 +1,23 @@
+package models
+
+import "time"
+
+// SendLedgerEntry is an append-only record of one counted send, kept for
+// billing reconciliation. It holds metadata only; message content is never
+// stored and the recipient is kept as a keyed hash.
+type SendLedgerEntry struct {
+	ID                uint      `json:"id" gorm:"primaryKey"`
+	UserID            string    `json:"user_id" gorm:"type:varchar(64);index;not null"`
+	SessionID         string    `json:"session_id" gorm:"type:varchar(128);index;not null"`
+	MessageType       string    `json:"message_type" gorm:"type:varchar(64)"`
+	RecipientHash     string    `json:"recipient_hash" gorm:"type:varchar(64);index"`
+	UpstreamMessageID string    `json:"upstream_message_id" gorm:"type:varchar(128)"`
+	Status            string    `json:"status" gorm:"type:varchar(16);index"`
+	HTTPStatus        int       `json:"http_status"`
+	Source            string    `json:"source" gorm:"type:varchar(16)"`
+	CreatedAt         time.Time `json:"created_at" gorm:"index"`
+}
+
+func (SendLedgerEntry) TableName() string {
+	return "wa_send_ledger"
+}
@@ -0,0 +1,38 @@
+package models
+
+import "time"
+
+const (
+	SessionStatusSourceEvent = "event"
+	SessionStatusSourceSync  = "sync"
+	// SessionStatusSourceReconcile marks changes made by the reconciler.
+	SessionStatusSourceReconcile = "reconcile"
+	// SessionStatusSourceWatchdog marks reconnect attempts and their outcome.
+	SessionStatusSourceWatchdog = "watchdog"
+)
+
+// SessionStatusChange records one transition of a session's connection
+// state. Event is the provider event behind it, or empty when the change was
+// read back from a /wa/session* response (Source "sync") or made by the
+// reconciler or reconnect watchdog. Watchdog attempts are recorded even when
+// the status does not change, with the outcome in Detail.
+type SessionStatusChange struct {
+	ID            uint      `json:"id" gorm:"primaryKey"`
+	UserID        string    `json:"user_id" gorm:"type:varchar(64);index;not null"`
+	SessionID     string    `json:"session_id" gorm:"type:varchar(128);index;not null"`
+	Source        string    `json:"source" gorm:"type:varchar(16)"`
+	Event         string    `json:"event,omitempty" gorm:"type:varchar(64)"`
+	FromStatus    string    `json:"from_status" gorm:"type:varchar(64)"`
+	ToStatus      string    `json:"to_status" gorm:"type:varchar(64)"`
+	FromConnected bool      `json:"from_connected"`
+	Connected     bool      `json:"connected"`
+	FromLoggedIn  bool      `json:"from_logged_in"`
+	LoggedIn      bool      `json:"logged_in"`
+	JID           string    `json:"jid,omitempty" gorm:"type:varchar(255)"`
+	Detail        string    `json:"detail,omitempty" gorm:"type:text"`
+	CreatedAt     time.Time `json:"created_at" gorm:"index"`
+}
+
+func (SessionStatusChange) TableName() string {
+	return "wa_session_status_history"
+}
@@ -0,0 +1,116 @@
+package models
+
+import "time"
+
+type WebhookDeliveryStatus string
+
+const (
+	WebhookDeliveryPending    WebhookDeliveryStatus = "pending"
+	WebhookDeliveryDelivering WebhookDeliveryStatus = "delivering"
+	WebhookDeliveryDelivered  WebhookDeliveryStatus = "delivered"
+	WebhookDeliveryDead       WebhookDeliveryStatus = "dead"
+)
+
+// WebhookEvent is one event received from the provider on the ingest
+// endpoint, stored exactly as received so it can be forwarded and replayed.
+type WebhookEvent struct {
+	ID          string    `json:"event_id" gorm:"primaryKey;type:varchar(64)"`
+	UserID      string    `json:"user_id" gorm:"type:varchar(64);index;not null"`
+	SessionID   string    `json:"session_id" gorm:"type:varchar(128);index;not null"`
+	EventType   string    `json:"event_type" gorm:"type:varchar(64);index"`
+	ContentType string    `json:"content_type" gorm:"type:varchar(255)"`
+	Body        []byte    `json:"-" gorm:"type:bytea"`
+	CreatedAt   time.Time `json:"created_at" gorm:"index"`
+}
+
+func (WebhookEvent) TableName() string {
+	return "wa_webhook_events"
+}
+
+// SessionWebhook is one extra customer endpoint for a session, next to the
+// session's own WebhookURL. Events is a comma-separated list of event types
+// to forward; empty or "All" forwards everything.
+type SessionWebhook struct {
+	ID        string    `json:"webhook_id" gorm:"primaryKey;type:varchar(64)"`
+	UserID    string    `json:"user_id" gorm:"type:varchar(64);index;not null"`
+	SessionID string    `json:"session_id" gorm:"type:varchar(128);index;not null"`
+	URL       string    `json:"url" gorm:"type:text;not null"`
+	Events    string    `json:"events" gorm:"type:varchar(512)"`
+	Headers   JSONB     `json:"headers" gorm:"type:jsonb"`
+	Secret    string    `json:"-" gorm:"type:varchar(128)"`
+	Enabled   bool      `json:"enabled" gorm:"not null"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func (SessionWebhook) TableName() string {
+	return "wa_session_webhooks"
+}
+
+// WebhookDelivery forwards one event to a customer endpoint, retried with
+// exponential backoff until MaxAttempts. WebhookID is empty for the
+// session's own WebhookURL.
+type WebhookDelivery struct {
+	ID            uint                  `json:"id" gorm:"primaryKey"`
+	EventID       string                `json:"event_id" gorm:"type:varchar(64);index;not null"`
+	UserID        string                `json:"user_id" gorm:"type:varchar(64);index;not null"`
+	SessionID     string                `json:"session_id" gorm:"type:varchar(128);index;not null"`
+	WebhookID     string                `json:"webhook_id,omitempty" gorm:"type:varchar(64);index"`
+	EventType     string                `json:"event_type" gorm:"type:varchar(64);index"`
+	TargetURL     string                `json:"target_url" gorm:"type:text"`
+	Status        WebhookDeliveryStatus `json:"status" gorm:"type:varchar(16);default:'pending';index"`
+	Attempts      int                   `json:"attempts" gorm:"default:0"`
+	MaxAttempts   int                   `json:"max_attempts" gorm:"default:8"`
+	NextAttemptAt time.Time             `json:"next_attempt_at" gorm:"index"`
+	LockedAt      *time.Time            `json:"-"`
+	LastStatus    int                   `json:"last_status,omitempty"`
+	LastError     string                `json:"last_error,omitempty" gorm:"type:text"`
+	ReplayOf      *uint                 `json:"replay_of,omitempty" gorm:"index"`
+	DeliveredAt   *time.Time            `json:"delivered_at"`
+	CreatedAt     time.Time             `json:"created_at" gorm:"index"`
+	UpdatedAt     time.Time             `json:"updated_at"`
+}
+
+func (WebhookDelivery) TableName() string {
+	return "wa_webhook_deliveries"
+}
+
+// WebhookDeliveryAttempt logs one HTTP attempt of a delivery. ResponseBody is
+// truncated; Error is set when no response was received. BodyVisible is set
+// when the response came through the webhook target guard; rows logged
+// before the guard existed keep it false and never show their body.
+type WebhookDeliveryAttempt struct {
+	ID           uint      `json:"id" gorm:"primaryKey"`
+	DeliveryID   uint      `json:"delivery_id" gorm:"index;not null"`
+	EventID      string    `json:"event_id" gorm:"type:varchar(64);not null"`
+	SessionID    string    `json:"session_id" gorm:"type:varchar(128);index;not null"`
+	Attempt      int       `json:"attempt"`
+	HTTPStatus   int       `json:"http_status,omitempty"`
+	LatencyMs    int64     `json:"latency_ms"`
+	Error        string    `json:"error,omitempty" gorm:"type:text"`
+	ResponseBody string    `json:"response_body,omitempty" gorm:"type:text"`
+	BodyVisible  bool      `json:"-" gorm:"default:false"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+func (WebhookDeliveryAttempt) TableName() string {
+	return "wa_webhook_delivery_attempts"
+}
+
+// WebhookDeadLetter records a delivery that exhausted its attempts.
+type WebhookDeadLetter struct {
+	ID         uint      `json:"id" gorm:"primaryKey"`
+	DeliveryID uint      `json:"delivery_id" gorm:"uniqueIndex;not null"`
+	EventID    string    `json:"event_id" gorm:"type:varchar(64);index;not null"`
+	UserID     string    `json:"user_id" gorm:"type:varchar(64);index;not null"`
+	SessionID  string    `json:"session_id" gorm:"type:varchar(128);index;not null"`
+	TargetURL  string    `json:"target_url" gorm:"type:text"`
+	Attempts   int       `json:"attempts"`
+	LastStatus int       `json:"last_status,omitempty"`
+	LastError  string    `json:"last_error,omitempty" gorm:"type:text"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+func (WebhookDeadLetter) TableName() string {
+	return "wa_webhook_dead_letters"
+}